@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/iambighead/ugoku/downloader"
+	"github.com/iambighead/ugoku/internal/admin"
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/health"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/sla"
+	"github.com/iambighead/ugoku/streamer"
+	"github.com/iambighead/ugoku/syncer"
+	"github.com/iambighead/ugoku/uploader"
+)
+
+// serviceJob is what a job is started with, a job whose serviceJob changed
+// is restarted on reload
+type serviceJob struct {
+	kind        string
+	config      interface{}
+	tempfolder  string
+	max_timeout int
+}
+
+func (s serviceJob) start() {
+	switch job_config := s.config.(type) {
+	case config.DownloaderConfig:
+		downloader.NewDownloader(job_config, s.tempfolder)
+	case config.UploaderConfig:
+		uploader.NewUploader(job_config, s.tempfolder)
+	case config.SyncerConfig:
+		syncer.NewSyncer(job_config, s.tempfolder)
+	case config.StreamerConfig:
+		streamer.NewStreamer(job_config)
+	}
+}
+
+// serviceJobs returns the enabled jobs of a config by name
+func serviceJobs(master_config config.MasterConfig) map[string]serviceJob {
+	tf := master_config.General.TempFolder
+	service_jobs := make(map[string]serviceJob)
+	for _, c := range master_config.Downloaders {
+		if c.Enabled {
+			service_jobs[c.Name] = serviceJob{"downloader", c, tf, c.MaxTimeout}
+		}
+	}
+	for _, c := range master_config.Uploaders {
+		if c.Enabled {
+			service_jobs[c.Name] = serviceJob{"uploader", c, tf, c.MaxTimeout}
+		}
+	}
+	for _, c := range master_config.Syncers {
+		if c.Enabled {
+			service_jobs[c.Name] = serviceJob{"syncer", c, tf, c.MaxTimeout}
+		}
+	}
+	for _, c := range master_config.Streamers {
+		if c.Enabled {
+			service_jobs[c.Name] = serviceJob{"streamer", c, "", c.MaxTimeout}
+		}
+	}
+	return service_jobs
+}
+
+// ReloadSummary tells which jobs a reload started, restarted and removed
+type ReloadSummary struct {
+	Added     []string `json:"added"`
+	Restarted []string `json:"restarted"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+	// sections changed in the config which only apply after a restart
+	NeedRestart []string `json:"need_restart"`
+}
+
+var running_jobs map[string]serviceJob
+var reload_lock sync.Mutex
+
+// drain lets a job finish the files it is transferring, at most for its
+// max timeout, then stops it. It tells if the job stopped, a job that did
+// not is left as it is. The expectations are kept, a job started again with
+// the same ones keeps their state.
+func drain(name string, s serviceJob) bool {
+	job := jobs.Get(name)
+	if job == nil {
+		return true
+	}
+	if !job.Drain(time.Duration(s.max_timeout) * time.Second) {
+		main_logger.Error(fmt.Sprintf("%s: did not stop, left %s, kill it or reload again", name, job.State()))
+		return false
+	}
+	jobs.Remove(job)
+	return true
+}
+
+// reload reads the config again and applies the changed jobs: new jobs are
+// started, removed jobs drained and stopped, changed jobs drained and started
+// with their new config. Unchanged jobs keep running untouched. A reload
+// is refused while the jobs of the previous one are still draining, which
+// takes at most their max timeout plus jobs.STOP_MARGIN.
+func reload() (ReloadSummary, error) {
+	summary := ReloadSummary{Added: []string{}, Restarted: []string{}, Removed: []string{}, Unchanged: []string{}, NeedRestart: []string{}}
+	if !reload_lock.TryLock() {
+		return summary, admin.ErrReloading
+	}
+	main_logger.Info(fmt.Sprintf("reloading config %s", config_path))
+	new_config, err := config.ReadConfig(config_path)
+	if err != nil {
+		reload_lock.Unlock()
+		logConfigError(err)
+		main_logger.Error("config not reloaded, the jobs keep running with the previous config")
+		return summary, err
+	}
+	err = logger.Setup(new_config.General.Logging, config.JobLogs(new_config), "UGOKU_LOG_LEVEL")
+	if err != nil {
+		reload_lock.Unlock()
+		main_logger.Error(fmt.Sprintf("config not reloaded, failed to set up logging: %v", err))
+		return summary, err
+	}
+	health.Setup(new_config.General.Health)
+
+	new_jobs := serviceJobs(new_config)
+	var draining sync.WaitGroup
+	// the jobs which did not stop keep their old config, so the next reload
+	// tries again
+	var not_stopped_lock sync.Mutex
+	not_stopped := make(map[string]serviceJob)
+	keep := func(name string, old serviceJob) {
+		not_stopped_lock.Lock()
+		defer not_stopped_lock.Unlock()
+		not_stopped[name] = old
+	}
+	for name, old := range running_jobs {
+		updated, found := new_jobs[name]
+		switch {
+		case !found:
+			summary.Removed = append(summary.Removed, name)
+			draining.Add(1)
+			go func(name string, old serviceJob) {
+				defer draining.Done()
+				if !drain(name, old) {
+					keep(name, old)
+					return
+				}
+				sla.Unregister(name)
+				main_logger.Info(fmt.Sprintf("%s: removed", name))
+			}(name, old)
+		case !reflect.DeepEqual(old, updated):
+			summary.Restarted = append(summary.Restarted, name)
+			draining.Add(1)
+			go func(name string, old serviceJob, updated serviceJob) {
+				defer draining.Done()
+				if !drain(name, old) {
+					keep(name, old)
+					main_logger.Error(fmt.Sprintf("%s: not started with the new config", name))
+					return
+				}
+				main_logger.Info(fmt.Sprintf("%s: starting with the new config", name))
+				updated.start()
+			}(name, old, updated)
+		default:
+			summary.Unchanged = append(summary.Unchanged, name)
+		}
+	}
+	for name, added := range new_jobs {
+		if _, found := running_jobs[name]; !found {
+			summary.Added = append(summary.Added, name)
+			added.start()
+		}
+	}
+	running_jobs = new_jobs
+
+	// these are set up once at startup
+	if !reflect.DeepEqual(master_config.General.Admin, new_config.General.Admin) {
+		summary.NeedRestart = append(summary.NeedRestart, "general.admin")
+	}
+	if !reflect.DeepEqual(master_config.General.History, new_config.General.History) {
+		summary.NeedRestart = append(summary.NeedRestart, "general.history")
+	}
+	if !reflect.DeepEqual(master_config.Notifiers, new_config.Notifiers) {
+		summary.NeedRestart = append(summary.NeedRestart, "notifiers")
+	}
+	if !reflect.DeepEqual(master_config.Email, new_config.Email) {
+		summary.NeedRestart = append(summary.NeedRestart, "email")
+	}
+	for _, section := range summary.NeedRestart {
+		main_logger.Warn(fmt.Sprintf("%s changed, it applies after a restart", section))
+	}
+	master_config = new_config
+
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Restarted)
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.Unchanged)
+	main_logger.Info(fmt.Sprintf("config reloaded: %d added, %d restarted, %d removed, %d unchanged",
+		len(summary.Added), len(summary.Restarted), len(summary.Removed), len(summary.Unchanged)))
+
+	go func() {
+		draining.Wait()
+		for name, old := range not_stopped {
+			running_jobs[name] = old
+		}
+		reload_lock.Unlock()
+	}()
+	return summary, nil
+}
+
+// handleReloadSignal reloads the config on every SIGHUP
+func handleReloadSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			reload()
+		}
+	}()
+}
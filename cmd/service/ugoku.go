@@ -1,15 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/downloader"
+	"github.com/iambighead/ugoku/internal/admin"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/health"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/notify"
+	"github.com/iambighead/ugoku/internal/secrets"
+	"github.com/iambighead/ugoku/internal/transform"
 	"github.com/iambighead/ugoku/internal/version"
+	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/iambighead/ugoku/streamer"
 	"github.com/iambighead/ugoku/syncer"
 	"github.com/iambighead/ugoku/uploader"
@@ -21,77 +37,98 @@ const VERSION = version.UGOKU_VERSION
 
 var main_logger logger.Logger
 var master_config config.MasterConfig
+var config_dir string
+var config_path string
+var config_err error
+
+func finishOneTime(started int, wg *sync.WaitGroup) {
+	if started > 0 {
+		wg.Wait()
+	}
+	notify.Digest()
+	notify.Flush(10 * time.Second)
+	err := dryrun.Print()
+	if err != nil {
+		main_logger.Error(fmt.Sprintf("failed to print dry run plan: %v", err))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
 
 func startDownloaders(master_config config.MasterConfig) {
 
+	var wg sync.WaitGroup
 	downloader_started := 0
 	for _, downloader_config := range master_config.Downloaders {
 		if downloader_config.Enabled {
-			go downloader.NewOneTimeDownloader(downloader_config, master_config.General.TempFolder)
+			wg.Add(1)
+			go func(downloader_config config.DownloaderConfig) {
+				defer wg.Done()
+				downloader.NewOneTimeDownloader(downloader_config, master_config.General.TempFolder)
+			}(downloader_config)
 			downloader_started++
 		}
 	}
 
 	main_logger.Info(fmt.Sprintf("started %d downloaders", downloader_started))
-
-	if downloader_started == 0 {
-		os.Exit(0)
-	}
-	<-make(chan struct{})
+	finishOneTime(downloader_started, &wg)
 }
 
 func startUploaders(master_config config.MasterConfig) {
 
+	var wg sync.WaitGroup
 	uploader_started := 0
 	for _, uploader_config := range master_config.Uploaders {
 		if uploader_config.Enabled {
-			uploader.NewOneTimeUploader(uploader_config, master_config.General.TempFolder)
+			wg.Add(1)
+			go func(uploader_config config.UploaderConfig) {
+				defer wg.Done()
+				uploader.NewOneTimeUploader(uploader_config, master_config.General.TempFolder)
+			}(uploader_config)
 			uploader_started++
 		}
 	}
 
 	main_logger.Info(fmt.Sprintf("started %d uploaders", uploader_started))
-
-	if uploader_started == 0 {
-		os.Exit(0)
-	}
-	<-make(chan struct{})
+	finishOneTime(uploader_started, &wg)
 }
 
 func startSyncers(master_config config.MasterConfig) {
 
+	var wg sync.WaitGroup
 	syncer_started := 0
 	for _, syncer_config := range master_config.Syncers {
 		if syncer_config.Enabled {
-			syncer.NewOneTimeSyncer(syncer_config, master_config.General.TempFolder)
+			wg.Add(1)
+			go func(syncer_config config.SyncerConfig) {
+				defer wg.Done()
+				syncer.NewOneTimeSyncer(syncer_config, master_config.General.TempFolder)
+			}(syncer_config)
 			syncer_started++
 		}
 	}
 
 	main_logger.Info(fmt.Sprintf("started %d syncers", syncer_started))
-
-	if syncer_started == 0 {
-		os.Exit(0)
-	}
-	<-make(chan struct{})
+	finishOneTime(syncer_started, &wg)
 }
 
 func startStreamers(master_config config.MasterConfig) {
 
+	var wg sync.WaitGroup
 	streamer_started := 0
 	for _, streamer_config := range master_config.Streamers {
 		if streamer_config.Enabled {
-			streamer.NewOneTimeStreamer(streamer_config)
+			wg.Add(1)
+			go func(streamer_config config.StreamerConfig) {
+				defer wg.Done()
+				streamer.NewOneTimeStreamer(streamer_config)
+			}(streamer_config)
 			streamer_started++
 		}
 	}
 
 	main_logger.Info(fmt.Sprintf("started %d streamers", streamer_started))
-
-	if streamer_started == 0 {
-		os.Exit(0)
-	}
-	<-make(chan struct{})
+	finishOneTime(streamer_started, &wg)
 }
 
 // --------------------------
@@ -149,10 +186,21 @@ func startStreamersService(master_config config.MasterConfig) {
 }
 
 func startServices(master_config config.MasterConfig) {
-	go startDownloadersService(master_config)
-	go startUploadersService(master_config)
-	go startSyncersService(master_config)
-	go startStreamersService(master_config)
+	// no reload until the jobs are started
+	reload_lock.Lock()
+	running_jobs = serviceJobs(master_config)
+	var wg sync.WaitGroup
+	for _, start := range []func(config.MasterConfig){startDownloadersService, startUploadersService, startSyncersService, startStreamersService} {
+		wg.Add(1)
+		go func(start func(config.MasterConfig)) {
+			defer wg.Done()
+			start(master_config)
+		}(start)
+	}
+	wg.Wait()
+	reload_lock.Unlock()
+	handleReloadSignal()
+	health.Notify()
 	<-make(chan struct{})
 }
 
@@ -162,38 +210,362 @@ func init() {
 	logger.Init("ugoku.log", "UGOKU_LOG_LEVEL")
 	main_logger = logger.NewLogger("main")
 
-	ex, err := os.Executable()
+	var err error
+	config_path, err = configPath()
 	if err != nil {
 		main_logger.Error("unable to get executable path")
 		os.Exit(1)
 	}
+	config_dir = filepath.Dir(config_path)
+	if info, err := os.Stat(config_path); err == nil && info.IsDir() {
+		config_dir = config_path
+	}
 
-	{
-		var err error
-		config_path := filepath.Join(filepath.Dir(ex), "config.yaml")
-		master_config, err = config.ReadConfig(config_path)
+	config.SetChecks(config.Checks{
+		Schedule: func(cfg config.ScheduleConfig) error {
+			_, err := gate.New(cfg, "")
+			return err
+		},
+		Transforms: transform.Validate,
+		RemoteCommands: func(cfg config.RemoteCommandsConfig) error {
+			_, err := sftplibs.NewRemoteCommands(cfg, "")
+			return err
+		},
+	})
+	master_config, config_err = config.ReadConfig(config_path)
+	if config_err == nil {
+		err = logger.Setup(master_config.General.Logging, config.JobLogs(master_config), "UGOKU_LOG_LEVEL")
 		if err != nil {
-			main_logger.Error(fmt.Sprintf("failed to read config: %v", err))
+			main_logger.Error(fmt.Sprintf("failed to set up logging: %v", err))
+			os.Exit(1)
 		}
 	}
 }
 
+// configPath returns the config given with --config, which is removed from
+// the arguments, else UGOKU_CONFIG, else config.yaml next to the executable
+func configPath() (string, error) {
+	for idx := 1; idx < len(os.Args); idx++ {
+		arg := os.Args[idx]
+		if strings.HasPrefix(arg, "--config=") {
+			os.Args = append(os.Args[:idx], os.Args[idx+1:]...)
+			return strings.TrimPrefix(arg, "--config="), nil
+		}
+		if arg == "--config" && idx+1 < len(os.Args) {
+			path := os.Args[idx+1]
+			os.Args = append(os.Args[:idx], os.Args[idx+2:]...)
+			return path, nil
+		}
+	}
+	if path := os.Getenv("UGOKU_CONFIG"); path != "" {
+		return path, nil
+	}
+	ex, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(ex), "config.yaml"), nil
+}
+
 // --------------------------
 
+// parseJobFlags parses the flags shared by the one time commands
+func parseJobFlags(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dry_run := flags.Bool("dry-run", false, "scan and print what would be transferred or deleted, without doing it")
+	plan_json := flags.Bool("json", false, "print the dry run plan as JSON")
+	plan_file := flags.String("plan-file", "", "write the dry run plan to this file instead of stdout")
+	flags.Parse(args)
+
+	if *dry_run {
+		dryrun.Enable(*plan_json, *plan_file)
+		main_logger.Info("dry run: no files will be transferred or deleted")
+	}
+}
+
+// logConfigError logs the problems of the config one per line
+func logConfigError(err error) {
+	var invalid *config.ValidationError
+	if !errors.As(err, &invalid) {
+		main_logger.Error(fmt.Sprintf("failed to read config: %v", err))
+		if errors.Is(err, fs.ErrNotExist) {
+			main_logger.Error("no usable config found, give its location with --config <path> or UGOKU_CONFIG")
+		}
+		return
+	}
+	for _, line := range strings.Split(invalid.Error(), "\n") {
+		main_logger.Error(line)
+	}
+	main_logger.Error(fmt.Sprintf("%d problem(s) found in the config", len(invalid.Problems)))
+}
+
+// runValidate checks the config, or the config file given, and exits with 1
+// if it has problems
+func runValidate(args []string) {
+	path := config_path
+	err := config_err
+	if len(args) > 0 {
+		path = args[0]
+		_, err = config.ReadConfig(path)
+	}
+	if err != nil {
+		logConfigError(err)
+		os.Exit(1)
+	}
+	main_logger.Info(fmt.Sprintf("%s is valid", path))
+}
+
+func historyPath() string {
+	if master_config.General.History.Path != "" {
+		return master_config.General.History.Path
+	}
+	return filepath.Join(config_dir, "history.jsonl")
+}
+
+// runSecret manages the encrypted secret store, it works without a valid
+// config as the config may refer to secrets not set yet
+func runSecret(args []string) {
+	usage := "usage: ugoku secret set|get|delete <name> or ugoku secret list"
+	if len(args) < 1 || (args[0] != "list" && len(args) < 2) {
+		main_logger.Error(usage)
+		os.Exit(1)
+	}
+	secrets_config := config.SecretPaths(master_config.General.Secrets, config_dir)
+	flags := flag.NewFlagSet("secret "+args[0], flag.ExitOnError)
+	value := flags.String("value", "", "the value to set, read from stdin when not given")
+	output := flags.String("output", "", "write the value to a file instead of stdout")
+	name := ""
+	if args[0] == "list" {
+		flags.Parse(args[1:])
+	} else {
+		name = args[1]
+		flags.Parse(args[2:])
+	}
+
+	if _, err := os.Stat(secrets_config.MasterKeyFile); os.IsNotExist(err) && args[0] == "set" {
+		main_logger.Info(fmt.Sprintf("creating master key %s, back it up and keep it out of git", secrets_config.MasterKeyFile))
+	}
+	key, err := secrets.ReadMasterKey(secrets_config.MasterKeyFile, args[0] == "set")
+	if err != nil {
+		main_logger.Error(fmt.Sprintf("failed to read master key: %v", err))
+		os.Exit(1)
+	}
+	store, err := secrets.Open(secrets_config.Store, key)
+	if err != nil {
+		main_logger.Error(fmt.Sprintf("failed to open secret store: %v", err))
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "set":
+		if *value == "" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				main_logger.Error(fmt.Sprintf("failed to read value: %v", err))
+				os.Exit(1)
+			}
+			*value = strings.TrimRight(line, "\r\n")
+		}
+		err = store.Set(name, *value)
+		if err == nil {
+			main_logger.Info(fmt.Sprintf("secret %s saved in %s, refer to it as secret:%s", name, secrets_config.Store, name))
+		}
+	case "get":
+		var secret string
+		secret, err = store.Get(name)
+		if err == nil {
+			if *output != "" {
+				err = os.WriteFile(*output, []byte(secret+"\n"), 0600)
+			} else {
+				fmt.Println(secret)
+			}
+		}
+	case "delete":
+		err = store.Delete(name)
+		if err == nil {
+			main_logger.Info(fmt.Sprintf("secret %s deleted", name))
+		}
+	case "list":
+		for _, name := range store.Names() {
+			fmt.Println(name)
+		}
+	default:
+		main_logger.Error(usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		main_logger.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// runAudit verifies the audit chain of the history file
+func runAudit(args []string) {
+	if len(args) < 1 || args[0] != "verify" {
+		main_logger.Error("usage: ugoku audit verify [--file <path>] [--key <secret>] [--keyfile <path>]")
+		os.Exit(1)
+	}
+	history_config := master_config.General.History
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	file := flags.String("file", historyPath(), "the history file to verify")
+	flags.StringVar(&history_config.Audit, "mode", history_config.Audit, "audit mode, chain, hmac or ed25519")
+	flags.StringVar(&history_config.AuditKey, "key", history_config.AuditKey, "hmac key")
+	flags.StringVar(&history_config.AuditKeyFile, "keyfile", history_config.AuditKeyFile, "ed25519 private or public key file")
+	flags.Parse(args[1:])
+	history_config.Audit = strings.ToLower(history_config.Audit)
+
+	verified, err := history.Verify(*file, history_config)
+	if err != nil {
+		var broken *history.BrokenError
+		if errors.As(err, &broken) {
+			main_logger.Error(fmt.Sprintf("audit chain broken after %d valid records, first broken entry at %s", verified, broken.Error()))
+		} else {
+			main_logger.Error(fmt.Sprintf("failed to verify history: %v", err))
+		}
+		os.Exit(1)
+	}
+	main_logger.Info(fmt.Sprintf("audit chain valid, %d records verified in %s", verified, *file))
+}
+
+// runHistory prints the transfers of the history file matching the flags
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	job := flags.String("job", "", "only transfers of this job")
+	pattern := flags.String("file", "", "only files whose name matches this pattern, like *.csv")
+	from := flags.String("from", "", "only transfers started at or after this date or time")
+	to := flags.String("to", "", "only transfers started before the end of this date, or before this time")
+	status := flags.String("status", "", "only transfers with this result, success or failed")
+	format := flags.String("format", "text", "output format, text, csv or json")
+	output := flags.String("output", "", "write to this file instead of stdout")
+	flags.Parse(args)
+
+	var filter history.Filter
+	var err error
+	filter.Job = *job
+	filter.Pattern = *pattern
+	filter.Result = strings.ToLower(*status)
+	if filter.From, err = history.ParseTime(*from, false); err == nil {
+		filter.To, err = history.ParseTime(*to, true)
+	}
+	if err == nil && filter.Result != "" && filter.Result != history.SUCCESS && filter.Result != history.FAILED {
+		err = fmt.Errorf("invalid status %q, expecting success or failed", *status)
+	}
+	if err != nil {
+		main_logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	entries, err := history.Query(historyPath(), filter)
+	if err != nil {
+		main_logger.Error(fmt.Sprintf("failed to read history: %v", err))
+		os.Exit(1)
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		w, err = os.Create(*output)
+		if err != nil {
+			main_logger.Error(fmt.Sprintf("failed to create output: %v", err))
+			os.Exit(1)
+		}
+		defer w.Close()
+	}
+	switch strings.ToLower(*format) {
+	case "csv":
+		err = history.WriteCsv(w, entries)
+	case "json":
+		err = history.WriteJson(w, entries)
+	default:
+		history.WriteText(w, entries)
+	}
+	if err != nil {
+		main_logger.Error(fmt.Sprintf("failed to write history: %v", err))
+		os.Exit(1)
+	}
+}
+
 func printUsage() {
 	main_logger.Info(fmt.Sprintf("Usage:"))
 	main_logger.Info(fmt.Sprintf(""))
 	main_logger.Info(fmt.Sprintf("  ugoku <command>"))
 	main_logger.Info(fmt.Sprintf(""))
-	main_logger.Info(fmt.Sprintf("command can be upload, download, sync, stream, serve"))
+	main_logger.Info(fmt.Sprintf("command can be upload, download, sync, stream, serve, validate, history, audit verify, secret"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("upload, download, sync and stream accept:"))
+	main_logger.Info(fmt.Sprintf("  --dry-run            print the plan without transferring or deleting anything"))
+	main_logger.Info(fmt.Sprintf("  --json               print the plan as JSON"))
+	main_logger.Info(fmt.Sprintf("  --plan-file <path>   write the plan to a file instead of stdout"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("history accepts:"))
+	main_logger.Info(fmt.Sprintf("  --job <name>         only transfers of this job"))
+	main_logger.Info(fmt.Sprintf("  --file <pattern>     only files whose name matches the pattern"))
+	main_logger.Info(fmt.Sprintf("  --from <date>        only transfers started from this date or time"))
+	main_logger.Info(fmt.Sprintf("  --to <date>          only transfers started up to this date or time"))
+	main_logger.Info(fmt.Sprintf("  --status <result>    success or failed"))
+	main_logger.Info(fmt.Sprintf("  --format <format>    text, csv or json"))
+	main_logger.Info(fmt.Sprintf("  --output <path>      write to a file instead of stdout"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("audit verify accepts, by default taken from the config:"))
+	main_logger.Info(fmt.Sprintf("  --file <path>        the history file"))
+	main_logger.Info(fmt.Sprintf("  --mode <mode>        chain, hmac or ed25519"))
+	main_logger.Info(fmt.Sprintf("  --key <secret>       hmac key"))
+	main_logger.Info(fmt.Sprintf("  --keyfile <path>     ed25519 private or public key"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("serve reloads the config on SIGHUP or POST /reload to the admin api"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("validate accepts the config file to check, the config by default"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("secret manages the encrypted secret store:"))
+	main_logger.Info(fmt.Sprintf("  secret set <name>    read the value from stdin, or give it with --value"))
+	main_logger.Info(fmt.Sprintf("  secret get <name>    print the value, or write it with --output <path>"))
+	main_logger.Info(fmt.Sprintf("  secret delete <name>"))
+	main_logger.Info(fmt.Sprintf("  secret list"))
+	main_logger.Info(fmt.Sprintf(""))
+	main_logger.Info(fmt.Sprintf("all commands accept:"))
+	main_logger.Info(fmt.Sprintf("  --config <path>      config file, merged with the files in conf.d next to it,"))
+	main_logger.Info(fmt.Sprintf("                       or a folder of config files. Default UGOKU_CONFIG, else"))
+	main_logger.Info(fmt.Sprintf("                       config.yaml next to ugoku"))
 	main_logger.Info(fmt.Sprintf(""))
 	main_logger.Info(fmt.Sprintf("Example:"))
 	main_logger.Info(fmt.Sprintf(""))
 	main_logger.Info(fmt.Sprintf("  ugoku sync"))
+	main_logger.Info(fmt.Sprintf("  ugoku serve --config /etc/ugoku/config.yaml"))
+	main_logger.Info(fmt.Sprintf("  ugoku download --dry-run --json"))
+	main_logger.Info(fmt.Sprintf("  ugoku validate /etc/ugoku/config.yaml"))
+	main_logger.Info(fmt.Sprintf("  ugoku history --job download1 --from 2024-01-01 --status failed --format csv"))
+	main_logger.Info(fmt.Sprintf("  ugoku audit verify --keyfile audit.pub"))
+	main_logger.Info(fmt.Sprintf("  ugoku secret set partner1-password < password.txt"))
+}
+
+// dataOnStdout tells if the command prints its data to stdout, the log then
+// goes to stderr so the output can be redirected
+func dataOnStdout(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch strings.ToLower(args[0]) {
+	case "history":
+		return true
+	case "secret":
+		return len(args) > 1 && strings.ToLower(args[1]) == "get"
+	case "upload", "download", "sync", "stream":
+		// the dry run plan, unless written to --plan-file
+		dry_run, plan_file := false, false
+		for _, arg := range args[1:] {
+			name := strings.TrimLeft(arg, "-")
+			dry_run = dry_run || name == "dry-run" || strings.HasPrefix(name, "dry-run=")
+			plan_file = plan_file || name == "plan-file" || strings.HasPrefix(name, "plan-file=")
+		}
+		return dry_run && !plan_file
+	}
+	return false
 }
 
 func main() {
 
+	if dataOnStdout(os.Args[1:]) {
+		logger.ConsoleToStderr()
+	}
 	main_logger.Info(fmt.Sprintf("ugoku-cli version %s", VERSION))
 
 	if len(os.Args) < 2 {
@@ -203,6 +575,50 @@ func main() {
 
 	cmd := strings.ToLower(os.Args[1])
 
+	switch cmd {
+	case "validate":
+		runValidate(os.Args[2:])
+		os.Exit(0)
+	case "secret":
+		runSecret(os.Args[2:])
+		os.Exit(0)
+	}
+	if config_err != nil {
+		logConfigError(config_err)
+		os.Exit(1)
+	}
+
+	switch cmd {
+	case "upload", "download", "sync", "stream":
+		parseJobFlags(cmd, os.Args[2:])
+	case "history":
+		runHistory(os.Args[2:])
+		os.Exit(0)
+	case "audit":
+		runAudit(os.Args[2:])
+		os.Exit(0)
+	}
+
+	switch cmd {
+	case "upload", "download", "sync", "stream", "serve":
+		// a dry run transfers nothing, so there is nothing to record
+		if !dryrun.Enabled() {
+			history_config := master_config.General.History
+			history_config.Path = historyPath()
+			err := history.Open(history_config)
+			if err != nil {
+				main_logger.Error(fmt.Sprintf("failed to open history: %v", err))
+				os.Exit(1)
+			}
+		}
+	}
+
+	err := notify.Setup(master_config.Notifiers, master_config.Email)
+	if err != nil {
+		main_logger.Error(fmt.Sprintf("failed to set up notifiers: %v", err))
+		os.Exit(1)
+	}
+
 	switch cmd {
 	case "upload":
 		startUploaders(master_config)
@@ -217,6 +633,13 @@ func main() {
 		startStreamers(master_config)
 		break
 	case "serve":
+		health.Setup(master_config.General.Health)
+		admin.OnReload(func() (any, error) { return reload() })
+		err = admin.Start(master_config.General.Admin)
+		if err != nil {
+			main_logger.Error(fmt.Sprintf("failed to start admin api: %v", err))
+			os.Exit(1)
+		}
 		startServices(master_config)
 		break
 	default:
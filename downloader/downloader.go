@@ -8,12 +8,24 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/notify"
+	"github.com/iambighead/ugoku/internal/packaging"
+	"github.com/iambighead/ugoku/internal/pgp"
 	siginthandler "github.com/iambighead/ugoku/internal/sigintHandler"
+	"github.com/iambighead/ugoku/internal/sla"
 	"github.com/iambighead/ugoku/internal/sleepytime"
+	"github.com/iambighead/ugoku/internal/transform"
 	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -23,9 +35,20 @@ import (
 
 var tempfolder string
 var term_signal bool
+
 var global_stop_channel = make(chan int, 10)
 var download_manager_logger logger.Logger
 
+// ErrQuarantined is returned by download for a file moved to quarantine,
+// its source is removed but it is not transferred
+var ErrQuarantined = errors.New("quarantined")
+
+// done result of a quarantined file, besides hooks.RESULT_*
+const download_quarantined = -1
+
+// quarantine_index makes the names of quarantined files unique
+var quarantine_index uint64
+
 func init() {
 	download_manager_logger = logger.NewLogger("download-manager")
 }
@@ -48,6 +71,12 @@ type SftpDownloader struct {
 	sftp_client        *sftp.Client
 	ssh_client         *ssh.Client
 	downloader_to_exit bool
+	pgp_keys           *pgp.Keys
+	hooks              *hooks.Hooks
+	remote_commands    *sftplibs.RemoteCommands
+	gate               *gate.Gate
+	job                *jobs.Job
+	hasher             *history.Hasher
 }
 
 // --------------------------------
@@ -67,20 +96,86 @@ func (dler *SftpDownloader) removeSrc(file_to_download string) {
 	}
 }
 
-func (dler *SftpDownloader) download(file_to_download string, size int64) error {
-	timeout_to_use := sftplibs.CalculateTimeout(int64(dler.Throughput), size, int64(dler.MaxTimeout))
+func (dler *SftpDownloader) outputFile(file_to_download string) string {
+	relative_download_path := strings.Replace(file_to_download, dler.SourcePath, "", 1)
+	output_file := filepath.Join(dler.TargetPath, relative_download_path)
+	if dler.Pgp.Decrypt {
+		output_file = pgp.StripExtension(output_file)
+	}
+	return output_file + packaging.CompressExtension(dler.Packaging.Compress)
+}
+
+// quarantine moves a downloaded file which failed decryption or signature
+// verification out of the way, instead of into the target folder. The name
+// gets a unique suffix so bad files of the same name do not overwrite each
+// other. The source is kept if the file could not be quarantined.
+func (dler *SftpDownloader) quarantine(file_to_download string, tempfile_path string, output_file string, reason error) error {
+	quarantine_file := filepath.Join(dler.Pgp.QuarantinePath,
+		fmt.Sprintf("%s.%d%d.pgp", filepath.Base(output_file), time.Now().UnixMilli(), atomic.AddUint64(&quarantine_index, 1)))
+	dler.logger.Error(fmt.Sprintf("pgp decrypt failed, moving to quarantine %s: %s", quarantine_file, reason.Error()))
+	err := sftplibs.MkdirAllLocal(dler.Pgp.QuarantinePath, dler.Attributes)
+	if err == nil {
+		err = sftplibs.RenameTempfile(tempfile_path, quarantine_file)
+	}
+	if err != nil {
+		os.Remove(tempfile_path)
+		dler.logger.Error(fmt.Sprintf("failed to quarantine %s, source kept: %s", quarantine_file, err.Error()))
+		return err
+	}
+	notify.Send(notify.Event{Event: notify.FILE_QUARANTINED, Job: dler.Name, Kind: "downloader",
+		Source: fmt.Sprintf("%s:%s", dler.Source, file_to_download), Target: quarantine_file, Error: reason.Error()})
+	return nil
+}
+
+// transforms adds the packaging compression to the configured transforms
+func (dler *SftpDownloader) transforms() []config.TransformConfig {
+	if dler.Packaging.Compress == "" {
+		return dler.Transforms
+	}
+	transforms := append([]config.TransformConfig{}, dler.Transforms...)
+	return append(transforms, config.TransformConfig{Type: dler.Packaging.Compress})
+}
+
+// extract unpacks a downloaded archive next to it, the archive is kept if
+// anything goes wrong
+func (dler *SftpDownloader) extract(archive_file string) {
+	extracted, err := packaging.Extract(archive_file, filepath.Dir(archive_file), sftplibs.LocalDirMode(dler.Attributes),
+		packaging.Limits{MaxBytes: int64(dler.Packaging.ExtractMaxSize) * 1024 * 1024, MaxFiles: dler.Packaging.ExtractMaxFiles})
+	if err != nil {
+		dler.logger.Error(fmt.Sprintf("failed to extract %s, archive kept, the files extracted were removed: %s", archive_file, err.Error()))
+		return
+	}
+	dler.logger.Info(fmt.Sprintf("extracted %d files from %s", len(extracted), archive_file))
+	err = os.Remove(archive_file)
+	if err != nil {
+		dler.logger.Error(fmt.Sprintf("failed to remove extracted archive: %s: %s", archive_file, err.Error()))
+	}
+}
+
+func (dler *SftpDownloader) plan(fo FileObj) {
+	dryrun.Record(dryrun.Entry{Job: dler.Name, Kind: "downloader", Action: dryrun.ACTION_TRANSFER,
+		Source: fmt.Sprintf("%s:%s", dler.Source, fo.Path), Target: dler.outputFile(fo.Path), Size: fo.Stat.Size()})
+	dryrun.Record(dryrun.Entry{Job: dler.Name, Kind: "downloader", Action: dryrun.ACTION_DELETE,
+		Source: fmt.Sprintf("%s:%s", dler.Source, fo.Path), Reason: "remove source after download"})
+}
+
+func (dler *SftpDownloader) download(file_to_download string, stat fs.FileInfo) error {
+	timeout_to_use := sftplibs.CalculateTimeout(int64(dler.Throughput), stat.Size(), int64(dler.MaxTimeout))
 	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout_to_use))
 	defer cancel()
 
 	done := make(chan int, 1)
 	cancelled := false
+	var quarantine_reason error
 	go func() {
-		relative_download_path := strings.Replace(file_to_download, dler.SourcePath, "", 1)
-		output_file := filepath.Join(dler.TargetPath, relative_download_path)
+		output_file := dler.outputFile(file_to_download)
 		dler.logger.Debug(fmt.Sprintf("downloading file %s:%s to %s, with %d seconds timeout", dler.Source, file_to_download, output_file, timeout_to_use))
 
 		output_parent_folder := filepath.Dir(output_file)
-		os.MkdirAll(output_parent_folder, fs.ModeDir|0764)
+		err := sftplibs.MkdirAllLocal(output_parent_folder, dler.Attributes)
+		if err != nil {
+			dler.logger.Error(fmt.Sprintf("unable to create output folder: %s: %s", output_parent_folder, err.Error()))
+		}
 		// dler.logger.Debug(fmt.Sprintf("created output folder %s", output_parent_folder))
 
 		start_time := time.Now().UnixMilli()
@@ -94,9 +189,23 @@ func (dler *SftpDownloader) download(file_to_download string, size int64) error
 		}
 		defer source.Close()
 
-		nBytes, tempfile_path, err := sftplibs.DownloadToTemp(ctxTimeout, tempfolder, source, dler.prefix)
+		progress := dler.job.Transfer(dler.id, fmt.Sprintf("%s:%s", dler.Source, file_to_download), output_file, stat.Size(), dler.hasher.Wrap(source))
+		transformed, err := transform.Wrap(ctxTimeout, progress, dler.transforms())
+		if err != nil {
+			dler.logger.Error(fmt.Sprintf("unable to start transforms: %s: %s", file_to_download, err.Error()))
+			done <- 0
+			return
+		}
+
+		nBytes, tempfile_path, err := sftplibs.DownloadToTemp(ctxTimeout, tempfolder, transformed, dler.prefix)
+		if transform_err := transformed.Close(); err == nil && transform_err != nil {
+			dler.logger.Error(fmt.Sprintf("error transforming file: %s: %s", file_to_download, transform_err.Error()))
+			os.Remove(tempfile_path)
+			done <- 0
+			return
+		}
 		if err != nil && !cancelled {
-			dler.logger.Error(fmt.Sprintf("error downloading file: %s: %s", file_to_download, err.Error()))
+			dler.logger.With(logger.Fields{"path": file_to_download, "error": err.Error()}).Error(fmt.Sprintf("error downloading file: %s: %s", file_to_download, err.Error()))
 			dler.downloader_to_exit = true
 			time.Sleep(1100 * time.Millisecond)
 			done <- 0
@@ -110,6 +219,22 @@ func (dler *SftpDownloader) download(file_to_download string, size int64) error
 			return
 		}
 
+		if dler.pgp_keys != nil {
+			decrypted_path := tempfile_path + ".dec"
+			err = dler.pgp_keys.DecryptFile(tempfile_path, decrypted_path)
+			if err != nil {
+				if dler.quarantine(file_to_download, tempfile_path, output_file, err) != nil {
+					done <- 0
+					return
+				}
+				quarantine_reason = err
+				done <- download_quarantined
+				return
+			}
+			os.Remove(tempfile_path)
+			tempfile_path = decrypted_path
+		}
+
 		err = sftplibs.RenameTempfile(tempfile_path, output_file)
 		if err != nil {
 			dler.logger.Error(fmt.Sprintf("error renaming file: %s to %s: %s", tempfile_path, output_file, err.Error()))
@@ -117,21 +242,33 @@ func (dler *SftpDownloader) download(file_to_download string, size int64) error
 			return
 		}
 
+		err = sftplibs.ApplyLocalAttrs(output_file, sftplibs.RemoteAttrs(stat), dler.Attributes)
+		if err != nil {
+			dler.logger.Error(fmt.Sprintf("failed to set file attributes: %s: %s", output_file, err.Error()))
+		}
+
+		if dler.Packaging.Extract && packaging.IsArchive(output_file) {
+			dler.extract(output_file)
+		}
+
 		end_time := time.Now().UnixMilli()
 
 		time_taken := end_time - start_time
 		if time_taken < 1 {
 			time_taken = 1
 		}
-		dler.logger.Info(fmt.Sprintf("downloaded %s with %d bytes in %d ms, %.1f mbps", file_to_download, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
+		dler.logger.With(logger.Fields{"path": file_to_download, "bytes": nBytes, "duration_ms": time_taken}).Info(fmt.Sprintf("downloaded %s with %d bytes in %d ms, %.1f mbps", file_to_download, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
 		done <- 1
 	}()
 
 	select {
 	case <-ctxTimeout.Done():
 		cancelled = true
-		return fmt.Errorf("download timeout: %v", ctxTimeout.Err())
+		return fmt.Errorf("download timeout: %w", ctxTimeout.Err())
 	case result := <-done:
+		if result == download_quarantined {
+			return fmt.Errorf("%w: %v", ErrQuarantined, quarantine_reason)
+		}
 		if result > 0 {
 			return nil
 		}
@@ -153,7 +290,8 @@ func (dler *SftpDownloader) connectAndGetClients() error {
 		dler.SourceServer.User,
 		dler.SourceServer.Password,
 		dler.SourceServer.KeyFile,
-		dler.SourceServer.CertFile)
+		dler.SourceServer.CertFile,
+		dler.SourceServer.KeyPassphrase)
 	if err != nil {
 		return err
 	}
@@ -168,17 +306,26 @@ func (dler *SftpDownloader) connectAndGetClients() error {
 func (dler *SftpDownloader) init() {
 	dler.started = false
 	dler.downloader_to_exit = false
-	dler.logger = logger.NewLogger(fmt.Sprintf("downloader[%s:%d]", dler.Name, dler.id))
+	dler.logger = logger.NewJobLogger(fmt.Sprintf("downloader[%s:%d]", dler.Name, dler.id), dler.Name, dler.id).With(logger.Fields{"server": dler.Source})
 	var sleepy sleepytime.Sleepytime
 	sleepy.Reset(2, 600)
 	for {
+		dler.job.WorkerState(dler.id, jobs.WAITING)
+		if !dler.gate.WaitOpen() || dler.job.Stopping() {
+			return
+		}
+		dler.job.WorkerState(dler.id, jobs.CONNECTING)
 		err := dler.connectAndGetClients()
+		notify.ConnectionState(dler.Name, "downloader", dler.Source, err)
+		metrics.Connected(dler.Name, "downloader", dler.Source, dler.id, err)
+		dler.job.Connection(dler.Source, err)
 		if err == nil {
 			break
 		}
-		dler.logger.Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
-		time.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
+		dler.logger.With(logger.Fields{"error": err.Error()}).Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
+		dler.job.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
 	}
+	dler.job.WorkerState(dler.id, jobs.IDLE)
 }
 
 // --------------------------------
@@ -199,21 +346,76 @@ func (dler *SftpDownloader) Stop() {
 
 func (dler *SftpDownloader) Start(c chan FileObj, done chan int) {
 	dler.init()
+	if dler.job.Stopping() {
+		return
+	}
 	dler.started = true
 	dler.prefix = fmt.Sprintf("%s%d", dler.Name, dler.id)
 	var file_to_download string
+	quit := make(chan bool)
+	finished := make(chan bool)
 	go func() {
+		defer close(finished)
 		for {
-			fo := <-c
+			var fo FileObj
+			select {
+			case fo = <-c:
+			case <-quit:
+				return
+			}
 			file_to_download = fo.Path
 			dler.logger.Debug(fmt.Sprintf("received file from channel: %s", file_to_download))
-			download_err := dler.download(file_to_download, fo.Stat.Size())
+			if dryrun.Enabled() {
+				dler.plan(fo)
+				done <- 1
+				continue
+			}
+			source := fmt.Sprintf("%s:%s", dler.Source, file_to_download)
+			output_file := dler.outputFile(file_to_download)
+			if !dler.hooks.BeforeTransfer(source, output_file, fo.Stat) {
+				dler.logger.Info(fmt.Sprintf("skipped by pre-transfer hook: %s", file_to_download))
+				done <- hooks.RESULT_SKIPPED
+				continue
+			}
+			remote_data := sftplibs.RemoteCommandData{Job: dler.Name, Source: file_to_download, Target: output_file, Size: fo.Stat.Size()}
+			dler.hasher = history.NewHasher()
+			started := time.Now()
+			download_err := dler.remote_commands.Before(dler.ssh_client, remote_data)
+			reason := metrics.REASON_REMOTE_COMMAND
+			if download_err == nil {
+				download_err = dler.download(file_to_download, fo.Stat)
+				reason = metrics.Reason(download_err)
+			}
+			if download_err == nil {
+				download_err = dler.remote_commands.After(dler.ssh_client, remote_data)
+				reason = metrics.REASON_REMOTE_COMMAND
+			}
+			quarantined := errors.Is(download_err, ErrQuarantined)
+			if quarantined {
+				reason = metrics.REASON_QUARANTINED
+			}
+			metrics.Result(dler.Name, "downloader", dler.Source, fo.Stat.Size(), started, reason, download_err)
+			history.Record(history.Entry{Job: dler.Name, Kind: "downloader", Direction: history.DOWNLOAD, SourceServer: dler.Source, SourcePath: file_to_download,
+				TargetPath: output_file, Size: fo.Stat.Size(), Hash: dler.hasher.Sum(), Start: started}, download_err)
+			if quarantined {
+				// already notified as quarantined, not counted as arrived
+				dler.hooks.Quarantined(source, output_file, fo.Stat, download_err)
+			} else {
+				dler.hooks.AfterTransfer(source, output_file, fo.Stat, download_err)
+			}
 			if download_err == nil {
 				// 	dler.logger.Error(fmt.Sprintf("download error: %s", download_err.Error()))
 				// } else {
 				dler.removeSrc(file_to_download)
+				done <- 1
+			} else if quarantined {
+				// the file is handled, the source can be removed
+				dler.removeSrc(file_to_download)
+				done <- 0
+			} else {
+				done <- 0
 			}
-			done <- 1
+			dler.job.WorkerState(dler.id, jobs.IDLE)
 			if dler.downloader_to_exit {
 				return
 			}
@@ -226,46 +428,97 @@ func (dler *SftpDownloader) Start(c chan FileObj, done chan int) {
 		if dler.downloader_to_exit {
 			return
 		}
+		if !dler.gate.Open() {
+			// let the current transfer finish, then disconnect
+			close(quit)
+			<-finished
+			dler.logger.Info("outside allowed window, disconnecting")
+			return
+		}
 	}
 }
 
-func setupSigHandler(new_scanner **SftpScanner, downloaders []*SftpDownloader) {
-	siginthandler.Handle("downloader", func() {
-		term_signal = true
-		if new_scanner != nil {
-			(*new_scanner).Stop()
-		}
-		for _, this_downloader := range downloaders {
-			if this_downloader != nil {
-				this_downloader.Stop()
-			}
+func stopAll(new_scanner **SftpScanner, downloaders []*SftpDownloader) {
+	if *new_scanner != nil {
+		(*new_scanner).Stop()
+	}
+	for _, this_downloader := range downloaders {
+		if this_downloader != nil {
+			this_downloader.Stop()
 		}
+	}
+}
+
+func setupSigHandler(new_scanner **SftpScanner, downloaders []*SftpDownloader) func() {
+	return siginthandler.Handle("downloader", func() {
+		term_signal = true
+		stopAll(new_scanner, downloaders)
 	})
 }
 
 func NewDownloader(downloader_config config.DownloaderConfig, tf string) {
+	if err := transform.Validate(downloader_config.Transforms); err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid transforms, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	pgp_keys, err := pgp.Load(downloader_config.Pgp)
+	if err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: unable to load pgp keys, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	job_hooks := hooks.New(downloader_config.Hooks, downloader_config.Name, "downloader")
+	if err := sla.Register(downloader_config.Name, "downloader", downloader_config.Expectations); err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid expectations, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	remote_commands, err := sftplibs.NewRemoteCommands(downloader_config.RemoteCommands, downloader_config.Name)
+	if err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	job_gate, err := gate.New(downloader_config.ScheduleConfig, downloader_config.Name)
+	if err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid schedule, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+
 	tempfolder = tf
 
 	downloaders := make([]*SftpDownloader, downloader_config.Worker)
 	var new_scanner *SftpScanner
 
-	setupSigHandler(&new_scanner, downloaders)
+	unregister_sig := setupSigHandler(&new_scanner, downloaders)
+	job := jobs.Register(downloader_config.Name, "downloader", func() {
+		NewDownloader(downloader_config, tf)
+	})
+	job_gate.StopOn(job.StopChan())
+	job.OnStop(func() {
+		stopAll(&new_scanner, downloaders)
+		unregister_sig()
+	})
 
 	// make channels
 	c := make(chan FileObj, downloader_config.Worker*2)
 	done := make(chan int, downloader_config.Worker*2)
 
 	for i := 0; i < downloader_config.Worker; i++ {
+		job.Add()
 		go func(myid int) {
+			defer job.Done()
 			for {
 				var new_downloader SftpDownloader
 				new_downloader.DownloaderConfig = downloader_config
 				new_downloader.id = myid
+				new_downloader.pgp_keys = pgp_keys
+				new_downloader.hooks = job_hooks
+				new_downloader.remote_commands = remote_commands
+				new_downloader.gate = job_gate
+				new_downloader.job = job
 				downloaders[myid] = &new_downloader
 				new_downloader.Start(c, done)
 				new_downloader.Stop()
 				downloaders[myid] = nil
-				if term_signal {
+				if term_signal || job.Stopping() {
 					return
 				}
 				download_manager_logger.Info(fmt.Sprintf("downloader [%d] exited, will recreate", myid))
@@ -273,14 +526,19 @@ func NewDownloader(downloader_config config.DownloaderConfig, tf string) {
 		}(i)
 	}
 
+	job.Add()
 	go func() {
+		defer job.Done()
 		for {
 			new_scanner = new(SftpScanner)
 			new_scanner.DownloaderConfig = downloader_config
+			new_scanner.Hooks = job_hooks
+			new_scanner.Gate = job_gate
+			new_scanner.Job = job
 			new_scanner.Start(c, done, false)
 			new_scanner.Stop()
 			new_scanner = nil
-			if term_signal {
+			if term_signal || job.Stopping() {
 				return
 			}
 			download_manager_logger.Info("scanner exited, will recreate")
@@ -289,6 +547,26 @@ func NewDownloader(downloader_config config.DownloaderConfig, tf string) {
 }
 
 func NewOneTimeDownloader(downloader_config config.DownloaderConfig, tf string) {
+	if err := transform.Validate(downloader_config.Transforms); err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid transforms, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	pgp_keys, err := pgp.Load(downloader_config.Pgp)
+	if err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: unable to load pgp keys, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	job_hooks := hooks.New(downloader_config.Hooks, downloader_config.Name, "downloader")
+	if err := sla.Register(downloader_config.Name, "downloader", downloader_config.Expectations); err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid expectations, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+	remote_commands, err := sftplibs.NewRemoteCommands(downloader_config.RemoteCommands, downloader_config.Name)
+	if err != nil {
+		download_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, downloader not started: %s", downloader_config.Name, err.Error()))
+		return
+	}
+
 	tempfolder = tf
 
 	downloaders := make([]*SftpDownloader, downloader_config.Worker)
@@ -305,6 +583,9 @@ func NewOneTimeDownloader(downloader_config config.DownloaderConfig, tf string)
 			var new_downloader SftpDownloader
 			new_downloader.DownloaderConfig = downloader_config
 			new_downloader.id = myid
+			new_downloader.pgp_keys = pgp_keys
+			new_downloader.hooks = job_hooks
+			new_downloader.remote_commands = remote_commands
 			downloaders[myid] = &new_downloader
 			new_downloader.Start(c, done)
 			new_downloader.Stop()
@@ -314,8 +595,8 @@ func NewOneTimeDownloader(downloader_config config.DownloaderConfig, tf string)
 
 	new_scanner = new(SftpScanner)
 	new_scanner.DownloaderConfig = downloader_config
+	new_scanner.Hooks = job_hooks
 	new_scanner.Start(c, done, true)
 	new_scanner.Stop()
 	new_scanner = nil
-	os.Exit(0)
 }
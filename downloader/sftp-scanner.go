@@ -5,8 +5,14 @@ import (
 	"io/fs"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/notify"
+	"github.com/iambighead/ugoku/internal/sla"
 	"github.com/iambighead/ugoku/internal/sleepytime"
 	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/pkg/sftp"
@@ -29,11 +35,14 @@ func init() {
 
 type SftpScanner struct {
 	config.DownloaderConfig
-	started            bool
-	logger             logger.Logger
-	sftp_client        *sftp.Client
-	ssh_client         *ssh.Client
-	Default_sleep_time int
+	started     bool
+	logger      logger.Logger
+	sftp_client *sftp.Client
+	ssh_client  *ssh.Client
+	Hooks       *hooks.Hooks
+	Gate        *gate.Gate
+	Job         *jobs.Job
+	batch       hooks.Batch
 }
 
 type FileObj struct {
@@ -44,8 +53,11 @@ type FileObj struct {
 func (scanner *SftpScanner) scan_once(c chan FileObj, done chan int) bool {
 	files_found := false
 	var dispatched int
+	scanner.batch.Reset()
+	scan_started := time.Now()
 	w := scanner.sftp_client.Walk(scanner.SourcePath)
 	for w.Step() {
+		scanner.Job.ScannerState(jobs.SCANNING)
 
 		if !scanner.started {
 			scanner.logger.Info("sftp scanner stopped, exiting scan")
@@ -72,13 +84,14 @@ func (scanner *SftpScanner) scan_once(c chan FileObj, done chan int) bool {
 
 			default:
 				scanner.logger.Debug(fmt.Sprintf("channel full (%d dispatched) wait for something done first", dispatched))
-				<-done
+				scanner.batch.Done(<-done)
 				dispatched--
 				scanner.logger.Debug(fmt.Sprintf("done received, %d dispatched now", dispatched))
 				c <- rf
 				dispatched++
 				scanner.logger.Debug(fmt.Sprintf("sent file to channel: %s, dispatched %d, ch %d/%d", rf.Path, dispatched, len(c), cap(c)))
 			}
+			metrics.Pending(scanner.Name, dispatched)
 		}
 		// scanner.logger.Debug(fmt.Sprintf("path=%s, isDir=%t", w.Path(), w.Stat().IsDir()))
 	}
@@ -86,28 +99,50 @@ func (scanner *SftpScanner) scan_once(c chan FileObj, done chan int) bool {
 	if dispatched > 0 {
 		scanner.logger.Debug(fmt.Sprintf("end of scan, wait for %d more dispatched to be done", dispatched))
 		for {
-			<-done
+			scanner.batch.Done(<-done)
 			dispatched--
+			metrics.Pending(scanner.Name, dispatched)
+			scanner.Job.ScannerState(jobs.SCANNING)
 			scanner.logger.Debug(fmt.Sprintf("received done, dispatched = %d", dispatched))
 			if dispatched < 1 {
 				break
 			}
 		}
 	}
+	scanner.Hooks.AfterBatch(&scanner.batch)
+	metrics.ScanDuration(scanner.Name, scanner.Source, scan_started)
 
 	return files_found
 }
 
 func (scanner *SftpScanner) scan(c chan FileObj, done chan int, scan_one_time_only bool) {
 	// walk a directory
-	sleep_time := scanner.Default_sleep_time
+	var sleepy sleepytime.Sleepytime
+	sleepy.Reset(scanner.SleepInterval, scanner.MaxSleepInterval)
+	sleep_time := scanner.SleepInterval
 	for {
-		if !scanner.started {
+		if !scanner.started || scanner.Job.Stopping() {
 			scanner.logger.Info("sftp scanner stopped, exiting scan")
 			return
 		}
+		if !scanner.Gate.Allowed(time.Now()) {
+			scanner.logger.Info("leaving active window, disconnecting")
+			return
+		}
+		if scanner.Job.Paused() {
+			scanner.Job.ScannerState(jobs.PAUSED)
+			scanner.Job.ScanSleep(1 * time.Second)
+			continue
+		}
+		scanner.Job.ScannerState(jobs.SCANNING)
 
-		files_found := scanner.scan_once(c, done)
+		sla.Check(scanner.Name)
+		files_found := false
+		if scanner.Hooks.BeforeScan() {
+			files_found = scanner.scan_once(c, done)
+		} else {
+			scanner.logger.Info("scan skipped by pre-scan hook")
+		}
 
 		if scan_one_time_only {
 			// scanner.logger.Info("scan only one time")
@@ -116,17 +151,17 @@ func (scanner *SftpScanner) scan(c chan FileObj, done chan int, scan_one_time_on
 		}
 
 		if !files_found {
-			if sleep_time < 16 {
-				sleep_time = sleep_time * 2
-			}
+			sleep_time = sleepy.GetNextSleep()
 		} else {
-			sleep_time = scanner.Default_sleep_time
+			sleepy.Reset(scanner.SleepInterval, scanner.MaxSleepInterval)
+			sleep_time = scanner.SleepInterval
 		}
 
 		// scanner.logger.Info("sleep and scan again")
 		// scanner.logger.Debug(fmt.Sprintf("sleep for %d seconds", sleep_time))
 		if scanner.started {
-			time.Sleep(time.Duration(sleep_time) * time.Second)
+			scanner.Job.ScannerState(jobs.SLEEPING)
+			scanner.Job.ScanSleep(sleepytime.Jitter(sleep_time, scanner.Jitter))
 		}
 	}
 }
@@ -139,7 +174,8 @@ func (scanner *SftpScanner) connectAndGetClients() error {
 		scanner.SourceServer.User,
 		scanner.SourceServer.Password,
 		scanner.SourceServer.KeyFile,
-		scanner.SourceServer.CertFile)
+		scanner.SourceServer.CertFile,
+		scanner.SourceServer.KeyPassphrase)
 	if err != nil {
 		return err
 	}
@@ -151,26 +187,51 @@ func (scanner *SftpScanner) connectAndGetClients() error {
 
 func (scanner *SftpScanner) init() {
 	scanner.started = false
-	scanner.logger = logger.NewLogger(fmt.Sprintf("sftp-scanner[%s]", scanner.Name))
-	if scanner.Default_sleep_time <= 0 {
-		scanner.Default_sleep_time = 1
+	scanner.logger = logger.NewJobLogger(fmt.Sprintf("sftp-scanner[%s]", scanner.Name), scanner.Name, -1).With(logger.Fields{"server": scanner.Source})
+	if scanner.SleepInterval <= 0 {
+		scanner.SleepInterval = 1
+	}
+	if scanner.MaxSleepInterval < scanner.SleepInterval {
+		scanner.MaxSleepInterval = scanner.SleepInterval
+	}
+	scanner.Job.ScannerState(jobs.WAITING)
+	if !scanner.Gate.WaitTurn() {
+		return
 	}
 
 	var sleepy sleepytime.Sleepytime
 	sleepy.Reset(2, 600)
 	for {
+		if scanner.Job.Stopping() {
+			return
+		}
+		scanner.Job.ScannerState(jobs.CONNECTING)
 		err := scanner.connectAndGetClients()
+		notify.ConnectionState(scanner.Name, "scanner", scanner.Source, err)
+		metrics.Connected(scanner.Name, "scanner", scanner.Source, -1, err)
+		scanner.Job.Connection(scanner.Source, err)
 		if err == nil {
 			break
 		}
-		scanner.logger.Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
-		time.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
+		// keep checking deadlines while the server is unreachable
+		sla.Check(scanner.Name)
+		scanner.logger.With(logger.Fields{"error": err.Error()}).Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
+		scanner.Job.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
 	}
 }
 
 func (scanner *SftpScanner) Start(c chan FileObj, done chan int, scan_one_time_only bool) {
 	scanner.init()
+	if scanner.Job.Stopping() {
+		return
+	}
 	scanner.started = true
+	if scanner.Gate.Scheduled() {
+		// one pass each time the schedule fires, workers connect meanwhile
+		scanner.Gate.Begin()
+		defer scanner.Gate.End()
+		scan_one_time_only = true
+	}
 	scanner.scan(c, done, scan_one_time_only)
 }
 
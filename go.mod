@@ -3,17 +3,20 @@ module github.com/iambighead/ugoku
 go 1.21.4
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/iambighead/goutils v0.0.3
+	github.com/klauspost/compress v1.17.11
 	github.com/pkg/sftp v1.13.5
-	golang.org/x/crypto v0.3.0
+	github.com/rs/zerolog v1.28.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.16.0
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
-	github.com/rs/zerolog v1.28.0 // indirect
-	golang.org/x/sys v0.2.0 // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 )
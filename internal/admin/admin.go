@@ -0,0 +1,229 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/health"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+)
+
+var admin_logger logger.Logger
+
+func init() {
+	admin_logger = logger.NewLogger("admin")
+}
+
+type server struct {
+	token string
+}
+
+var reload_hook func() (any, error)
+
+// ErrReloading is returned by the reload while the previous one is not done
+var ErrReloading = errors.New("a reload is still in progress")
+
+// OnReload sets how POST /reload reloads the config
+func OnReload(f func() (any, error)) {
+	reload_hook = f
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+func (s *server) authorized(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// ServeHTTP routes
+//
+//	GET  /jobs
+//	GET  /jobs/<name>
+//	POST /jobs/<name>/pause|resume|scan|stop|start|restart|kill
+//	GET  /transfers
+//	POST /reload
+//	GET  /metrics
+//	GET  /healthz
+//	GET  /readyz
+//
+// The health endpoints need no token, for the probes of the orchestrator.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		s.probe(w, health.Live)
+		return
+	case "/readyz":
+		s.probe(w, health.Ready)
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "metrics":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Write(w)
+	case len(parts) == 1 && parts[0] == "transfers":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJson(w, http.StatusOK, jobs.Transfers())
+	case len(parts) == 1 && parts[0] == "reload":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.reload(w)
+	case len(parts) == 1 && parts[0] == "jobs":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		statuses := []jobs.Status{}
+		for _, job := range jobs.List() {
+			statuses = append(statuses, job.Status())
+		}
+		writeJson(w, http.StatusOK, statuses)
+	case (len(parts) == 2 || len(parts) == 3) && parts[0] == "jobs":
+		job := jobs.Get(parts[1])
+		if job == nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no such job: %s", parts[1]))
+			return
+		}
+		if len(parts) == 2 {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			writeJson(w, http.StatusOK, job.Status())
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.action(w, job, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *server) reload(w http.ResponseWriter) {
+	if reload_hook == nil {
+		writeError(w, http.StatusNotFound, "reload is not available")
+		return
+	}
+	admin_logger.Info("reload requested")
+	summary, err := reload_hook()
+	if errors.Is(err, ErrReloading) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	// the config cannot be read or is invalid
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusAccepted, summary)
+}
+
+func (s *server) probe(w http.ResponseWriter, check func() (health.Report, bool)) {
+	report, ok := check()
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, report)
+}
+
+func (s *server) action(w http.ResponseWriter, job *jobs.Job, action string) {
+	switch action {
+	case "pause":
+		job.Pause()
+	case "resume":
+		job.Resume()
+	case "scan":
+		job.Trigger()
+	case "stop":
+		job.Stop(false)
+	case "restart":
+		job.Stop(true)
+	case "kill":
+		if !job.Kill() {
+			writeError(w, http.StatusConflict, fmt.Sprintf("job is %s, only a job stuck stopping can be killed", job.State()))
+			return
+		}
+	case "start":
+		if !job.Start() {
+			writeError(w, http.StatusConflict, fmt.Sprintf("job is %s, only a stopped job can be started", job.State()))
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown action: %s", action))
+		return
+	}
+	admin_logger.Info(fmt.Sprintf("%s: %s requested", job.Name, action))
+	// a started job registers itself again
+	if started := jobs.Get(job.Name); started != nil {
+		job = started
+	}
+	writeJson(w, http.StatusAccepted, job.Status())
+}
+
+// Start serves the admin api in the background when a listen address is
+// configured
+func Start(cfg config.AdminConfig) error {
+	if cfg.Listen == "" {
+		return nil
+	}
+	if cfg.Token == "" {
+		return errors.New("admin token is required")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("admin certfile and keyfile must be set together")
+	}
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	http_server := &http.Server{
+		Handler:           &server{token: cfg.Token},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		var err error
+		if cfg.CertFile != "" {
+			err = http_server.ServeTLS(listener, cfg.CertFile, cfg.KeyFile)
+		} else {
+			err = http_server.Serve(listener)
+		}
+		admin_logger.Error(fmt.Sprintf("admin api stopped: %v", err))
+	}()
+	admin_logger.Info(fmt.Sprintf("admin api listening on %s", listener.Addr().String()))
+	return nil
+}
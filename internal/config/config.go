@@ -1,71 +1,271 @@
 package config
 
 import (
-	"os"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
 	"strings"
-
-	"gopkg.in/yaml.v3"
+	"time"
 )
 
+// ServerConfig is an sftp server and the user to log in with. Password and
+// KeyPassphrase may be secret references, see SecretsConfig.
 type ServerConfig struct {
+	Name          string
+	Ip            string
+	Port          int
+	User          string
+	Password      string
+	KeyFile       string
+	KeyPassphrase string
+	CertFile      string
+}
+
+// AttributesConfig controls the mode, ownership and timestamps of the
+// files and folders created on the receiving side
+type AttributesConfig struct {
+	PreserveTimes bool
+	PreserveMode  bool
+	PreserveOwner bool
+	UidMap        map[int]int
+	GidMap        map[int]int
+	// octal strings, e.g. "0640"
+	FileMode string
+	DirMode  string
+	Umask    string
+	FilePerm fs.FileMode `yaml:"-"`
+	DirPerm  fs.FileMode `yaml:"-"`
+	UmaskBit fs.FileMode `yaml:"-"`
+}
+
+// PackagingConfig compresses or bundles outbound files before upload, and
+// extracts inbound archives after download. An archive unpacking to more than
+// ExtractMaxSize MB or ExtractMaxFiles files is refused.
+type PackagingConfig struct {
+	Compress        string
+	Bundle          string
+	BundleName      string
+	Extract         bool
+	ExtractMaxSize  int
+	ExtractMaxFiles int
+}
+
+// PgpConfig encrypts and signs outbound files, or decrypts and verifies
+// inbound files. Keyrings may be armored or binary.
+type PgpConfig struct {
+	Encrypt        bool
+	Sign           bool
+	Armor          bool
+	Decrypt        bool
+	Verify         bool
+	PublicKeyring  string
+	SecretKeyring  string
+	Recipients     []string
+	Passphrase     string
+	PassphraseEnv  string
+	PassphraseFile string
+	QuarantinePath string
+}
+
+// TransformConfig is one stage of the in-flight transform pipeline, type is
+// one of gzip, gunzip, crlf, lf, charset or command
+type TransformConfig struct {
+	Type    string
+	From    string
+	To      string
+	Command []string
+}
+
+// HooksConfig holds local commands run around transfers, each one a command
+// and its arguments. Timeout is in seconds.
+type HooksConfig struct {
+	PreScan     []string
+	PreTransfer []string
+	PostSuccess []string
+	PostFailure []string
+	PostBatch   []string
+	Timeout     int
+}
+
+// RemoteCommandsConfig holds shell commands run on the server through ssh
+// before and after each transfer, as text/template. Timeout is in seconds.
+type RemoteCommandsConfig struct {
+	Before  string
+	After   string
+	Timeout int
+}
+
+// ExpectationConfig is a file a job must receive: each time Schedule (cron)
+// fires, at least MinCount files matching Pattern and of MinSize bytes are
+// expected within Deadline (a duration like 7h).
+type ExpectationConfig struct {
 	Name     string
-	Ip       string
-	Port     int
-	User     string
-	Password string
-	KeyFile  string
-	CertFile string
+	Schedule string
+	Pattern  string
+	MinCount int
+	MinSize  int64
+	Deadline string
+	// parsed Deadline
+	Within time.Duration `yaml:"-"`
+}
+
+// PollingConfig sets how often a scanner looks for files, in seconds. With
+// exponential Backoff the interval doubles from SleepInterval up to
+// MaxSleepInterval while nothing is found, with none it stays at
+// SleepInterval. Each sleep is randomly spread by up to Jitter percent.
+type PollingConfig struct {
+	SleepInterval    int
+	MaxSleepInterval int
+	Backoff          string
+	Jitter           int
+}
+
+// WindowConfig is a recurring window on Days (cron day-of-week syntax like
+// mon-fri, all days when empty) From To (24h time, To before From crosses
+// midnight), or a one-off window from Start to End (2006-01-02 15:04).
+type WindowConfig struct {
+	Days  string
+	From  string
+	To    string
+	Start string
+	End   string
+}
+
+// ScheduleConfig limits when a job scans in service mode: only when a cron
+// expression of Schedule fires, inside ActiveWindows and outside Blackouts.
+// Times are in Timezone, the local time zone when empty.
+type ScheduleConfig struct {
+	Schedule      []string
+	ActiveWindows []WindowConfig
+	Blackouts     []WindowConfig
+	Timezone      string
 }
 
 type DownloaderConfig struct {
-	Name         string
-	Source       string
-	SourcePath   string
-	TargetPath   string
-	Enabled      bool
-	Worker       int
-	MaxTimeout   int
-	Throughput   int
-	SourceServer ServerConfig
+	Name           string
+	Source         string
+	SourcePath     string
+	TargetPath     string
+	Enabled        bool
+	Worker         int
+	MaxTimeout     int
+	Throughput     int
+	SourceServer   ServerConfig
+	Attributes     AttributesConfig
+	Transforms     []TransformConfig
+	Packaging      PackagingConfig
+	Pgp            PgpConfig
+	Hooks          HooksConfig
+	RemoteCommands RemoteCommandsConfig
+	Expectations   []ExpectationConfig
+	PollingConfig  `yaml:",inline"`
+	ScheduleConfig `yaml:",inline"`
+	Log            JobLogConfig
 }
 
 type UploaderConfig struct {
-	Name         string
+	Name           string
+	Target         string
+	SourcePath     string
+	TargetPath     string
+	Enabled        bool
+	Worker         int
+	MaxTimeout     int
+	Throughput     int
+	TargetServer   ServerConfig
+	Attributes     AttributesConfig
+	Transforms     []TransformConfig
+	Packaging      PackagingConfig
+	Pgp            PgpConfig
+	Hooks          HooksConfig
+	RemoteCommands RemoteCommandsConfig
+	PollingConfig  `yaml:",inline"`
+	ScheduleConfig `yaml:",inline"`
+	Log            JobLogConfig
+	// watch the source folder for changes on linux, rescanning it fully
+	// every RescanInterval seconds
+	Watch          bool
+	RescanInterval int
+}
+
+type SyncerConfig struct {
+	Name           string
+	Server         string
+	ServerPath     string
+	LocalPath      string
+	Mode           string
+	Enabled        bool
+	Worker         int
+	MaxTimeout     int
+	Throughput     int
+	SyncServer     ServerConfig
+	Attributes     AttributesConfig
+	Hooks          HooksConfig
+	RemoteCommands RemoteCommandsConfig
+	Expectations   []ExpectationConfig
+	PollingConfig  `yaml:",inline"`
+	ScheduleConfig `yaml:",inline"`
+	Log            JobLogConfig
+	// as for uploaders, in local mode
+	Watch          bool
+	RescanInterval int
+}
+
+type StreamTargetConfig struct {
 	Target       string
-	SourcePath   string
 	TargetPath   string
-	Enabled      bool
-	Worker       int
-	MaxTimeout   int
-	Throughput   int
 	TargetServer ServerConfig
 }
 
-type SyncerConfig struct {
-	Name          string
-	Server        string
-	ServerPath    string
-	LocalPath     string
-	Mode          string
-	Enabled       bool
-	SleepInterval int
-	Worker        int
-	MaxTimeout    int
-	Throughput    int
-	SyncServer    ServerConfig
+// streamTargets returns the targets of a streamer, the single Target and
+// TargetPath when it has no Targets
+func streamTargets(streamer StreamerConfig) []StreamTargetConfig {
+	if len(streamer.Targets) == 0 && streamer.Target != "" {
+		return []StreamTargetConfig{{Target: streamer.Target, TargetPath: streamer.TargetPath}}
+	}
+	return streamer.Targets
+}
+
+// expandTargets turns the single target of the streamers into Targets, once
+// validated so a problem is reported at the key in the config
+func expandTargets(config *MasterConfig) {
+	for idx, streamer := range config.Streamers {
+		config.Streamers[idx].Targets = streamTargets(streamer)
+		for target_idx, target := range config.Streamers[idx].Targets {
+			for _, server := range config.Servers {
+				if server.Name == target.Target {
+					config.Streamers[idx].Targets[target_idx].TargetServer = server
+				}
+			}
+		}
+	}
 }
 
 type StreamerConfig struct {
-	Name          string
-	Source        string
-	SourcePath    string
-	Target        string
-	TargetPath    string
-	Enabled       bool
-	SleepInterval int
-	Worker        int
-	SourceServer  ServerConfig
-	TargetServer  ServerConfig
+	Name           string
+	Source         string
+	SourcePath     string
+	Target         string
+	TargetPath     string
+	Targets        []StreamTargetConfig
+	SuccessPolicy  string
+	Quorum         int
+	Enabled        bool
+	Worker         int
+	MaxTimeout     int
+	Throughput     int
+	SourceServer   ServerConfig
+	TargetServer   ServerConfig
+	Attributes     AttributesConfig
+	Transforms     []TransformConfig
+	Pgp            PgpConfig
+	Hooks          HooksConfig
+	RemoteCommands RemoteCommandsConfig
+	Expectations   []ExpectationConfig
+	PollingConfig  `yaml:",inline"`
+	ScheduleConfig `yaml:",inline"`
+	Log            JobLogConfig
 }
 
 // type DownloaderDedupConfig struct {
@@ -77,8 +277,113 @@ type StreamerConfig struct {
 // 	SourceServer []ServerConfig
 // }
 
+// NotifierConfig is an HTTP endpoint receiving job events as JSON, or as the
+// Body template when given. Events and Jobs limit what is sent, all when empty.
+// With a Secret, the body is signed with HMAC-SHA256. Timeout is in seconds.
+type NotifierConfig struct {
+	Name    string
+	Url     string
+	Events  []string
+	Jobs    []string
+	Headers map[string]string
+	Body    string
+	Secret  string
+	Retries int
+	Timeout int
+}
+
+// EmailJobConfig selects the emails sent about one job. OnArrival holds file
+// name patterns, Deadline is a daily time (15:04) by which a file is expected.
+type EmailJobConfig struct {
+	Job       string
+	To        []string
+	OnFailure bool
+	OnArrival []string
+	Deadline  string
+	Digest    bool
+}
+
+// EmailConfig is the SMTP server used for alerts and the daily digest.
+// Security is starttls, tls or none. Digest is the daily time (15:04) the
+// digest is sent, DigestTo receives the digest of all jobs.
+type EmailConfig struct {
+	Host     string
+	Port     int
+	Security string
+	Username string
+	Password string
+	From     string
+	Digest   string
+	DigestTo []string
+	Jobs     []EmailJobConfig
+}
+
+// AdminConfig enables the admin api in service mode, with https when a
+// certificate is set. Every request needs the token as a bearer token.
+type AdminConfig struct {
+	Listen   string
+	Token    string
+	CertFile string
+	KeyFile  string
+}
+
+// HealthConfig sets what the health endpoints of the admin api check. The
+// readiness fails while a critical job cannot reach its servers, the health
+// while a scanner made no progress for StallTimeout seconds.
+type HealthConfig struct {
+	CriticalJobs []string
+	StallTimeout int
+}
+
+// HistoryConfig sets the file every transfer is appended to, by default
+// history.jsonl next to the config. With Audit each record is chained to the
+// previous one: chain, hmac with AuditKey, or ed25519 signed with the
+// private key in AuditKeyFile.
+type HistoryConfig struct {
+	Path         string
+	Audit        string
+	AuditKey     string
+	AuditKeyFile string
+}
+
+// LoggingConfig sets the level and outputs of the log. The console shows
+// text or json, File is rotated after MaxSize MB keeping MaxBackups files for
+// MaxAge days. Syslog is local, udp://host:port or tcp://host:port.
+type LoggingConfig struct {
+	Level      string
+	Format     string
+	File       string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+	Compress   bool
+	Syslog     string
+	Journald   bool
+}
+
+// JobLogConfig overrides the log level of a job, and adds a log file with
+// only the entries of the job
+type JobLogConfig struct {
+	Level string
+	File  string
+}
+
+// SecretsConfig sets the encrypted secret store managed with ugoku secret,
+// by default secrets.json and master.key next to the config. Passwords,
+// passphrases and tokens can be given as ${ENV_VAR}, file:<path> or
+// secret:<name> instead of in clear.
+type SecretsConfig struct {
+	Store         string
+	MasterKeyFile string
+}
+
 type GeneralConfig struct {
 	TempFolder string
+	Secrets    SecretsConfig
+	Admin      AdminConfig
+	Health     HealthConfig
+	History    HistoryConfig
+	Logging    LoggingConfig
 }
 type MasterConfig struct {
 	Servers     []ServerConfig
@@ -86,27 +391,180 @@ type MasterConfig struct {
 	Uploaders   []UploaderConfig
 	Syncers     []SyncerConfig
 	Streamers   []StreamerConfig
+	Notifiers   []NotifierConfig
+	Email       EmailConfig
 	General     GeneralConfig
 }
 
-func validateConfig(cfg MasterConfig) error {
-	return nil
+func parseMode(value string) (fs.FileMode, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, expecting octal like 0644", value)
+	}
+	return fs.FileMode(mode), nil
 }
 
-func ReadConfig(path_to_config string) (MasterConfig, error) {
+// parseAttributes parses the modes, an invalid one is left 0 and reported
+// by the validator
+func parseAttributes(attributes *AttributesConfig) {
+	attributes.FilePerm, _ = parseMode(attributes.FileMode)
+	attributes.DirPerm, _ = parseMode(attributes.DirMode)
+	attributes.UmaskBit, _ = parseMode(attributes.Umask)
+}
+
+func parsePackaging(packaging *PackagingConfig) {
+	packaging.Compress = strings.ToLower(packaging.Compress)
+	packaging.Bundle = strings.ToLower(packaging.Bundle)
+	if packaging.Bundle != "" && packaging.BundleName == "" {
+		packaging.BundleName = "{{.Job}}_{{.Timestamp}}." + packaging.Bundle
+	}
+}
+
+func setHookDefaults(hooks *HooksConfig) {
+	if hooks.Timeout <= 0 {
+		hooks.Timeout = 60
+	}
+}
 
-	config := MasterConfig{}
-	yfile, err := os.ReadFile(path_to_config)
+func setRemoteCommandDefaults(remote_commands *RemoteCommandsConfig) {
+	if remote_commands.Timeout <= 0 {
+		remote_commands.Timeout = 60
+	}
+}
 
+// setPollingDefaults fills in the polling of a job, default_max is the longest
+// interval of the exponential backoff when not configured
+func setPollingDefaults(polling *PollingConfig, default_max int) {
+	if polling.SleepInterval < 1 {
+		polling.SleepInterval = 1
+	}
+	polling.Backoff = strings.ToLower(polling.Backoff)
+	switch polling.Backoff {
+	case "exponential":
+	case "none":
+	default:
+		polling.Backoff = "exponential"
+	}
+	if polling.MaxSleepInterval <= 0 {
+		polling.MaxSleepInterval = default_max
+	}
+	if polling.Backoff == "none" || polling.MaxSleepInterval < polling.SleepInterval {
+		polling.MaxSleepInterval = polling.SleepInterval
+	}
+	if polling.Jitter < 0 {
+		polling.Jitter = 0
+	}
+	if polling.Jitter > 100 {
+		polling.Jitter = 100
+	}
+}
+
+func checkTimeOfDay(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := time.Parse("15:04", value)
 	if err != nil {
-		return config, err
+		return fmt.Errorf("invalid time %q, expecting 24h time like 07:30", value)
 	}
+	return nil
+}
 
-	err2 := yaml.Unmarshal(yfile, &config)
-	if err2 != nil {
-		return config, err2
+func parseEmail(email *EmailConfig) {
+	if email.Host == "" {
+		return
+	}
+	email.Security = strings.ToLower(email.Security)
+	if email.Security == "" {
+		email.Security = "starttls"
 	}
+	if email.Port == 0 {
+		switch email.Security {
+		case "tls":
+			email.Port = 465
+		case "none":
+			email.Port = 25
+		default:
+			email.Port = 587
+		}
+	}
+}
+
+// parseExpectations names the expectations and parses their deadline, an
+// invalid one is reported by the validator
+func parseExpectations(job string, expectations []ExpectationConfig) {
+	for idx, expectation := range expectations {
+		if expectation.Name == "" {
+			expectations[idx].Name = fmt.Sprintf("%s#%d", job, idx+1)
+		}
+		if expectation.Pattern == "" {
+			expectations[idx].Pattern = "*"
+		}
+		if expectation.MinCount < 1 {
+			expectations[idx].MinCount = 1
+		}
+		expectations[idx].Within, _ = time.ParseDuration(expectation.Deadline)
+	}
+}
+
+func normalizeTransforms(transforms []TransformConfig) {
+	for idx := range transforms {
+		transforms[idx].Type = strings.ToLower(transforms[idx].Type)
+	}
+}
+
+func checkLogLevel(value string) error {
+	switch value {
+	case "", "debug", "info", "warn", "error":
+		return nil
+	}
+	return fmt.Errorf("invalid level %q, expecting debug, info, warn or error", value)
+}
 
+func parseLogging(logging *LoggingConfig) {
+	logging.Level = strings.ToLower(logging.Level)
+	logging.Format = strings.ToLower(logging.Format)
+	if logging.Format == "" {
+		logging.Format = "text"
+	}
+	if logging.File == "" {
+		logging.File = "ugoku.log"
+	}
+	if logging.MaxSize <= 0 {
+		logging.MaxSize = 10
+	}
+	if logging.MaxBackups <= 0 {
+		logging.MaxBackups = 10
+	}
+	if logging.MaxAge <= 0 {
+		logging.MaxAge = 7
+	}
+}
+
+// JobLogs returns the log config of every job by name
+func JobLogs(config MasterConfig) map[string]JobLogConfig {
+	logs := make(map[string]JobLogConfig)
+	for _, downloader := range config.Downloaders {
+		logs[downloader.Name] = downloader.Log
+	}
+	for _, uploader := range config.Uploaders {
+		logs[uploader.Name] = uploader.Log
+	}
+	for _, syncer := range config.Syncers {
+		logs[syncer.Name] = syncer.Log
+	}
+	for _, streamer := range config.Streamers {
+		logs[streamer.Name] = streamer.Log
+	}
+	return logs
+}
+
+// setDefaults fills in what the config leaves out, the values are checked by
+// the validator
+func setDefaults(config *MasterConfig) {
 	for idx, server := range config.Servers {
 		if server.Port == 0 {
 			config.Servers[idx].Port = 22
@@ -123,6 +581,19 @@ func ReadConfig(path_to_config string) (MasterConfig, error) {
 		if config.Downloaders[idx].Throughput <= 0 {
 			config.Downloaders[idx].Throughput = 10
 		}
+		parseAttributes(&config.Downloaders[idx].Attributes)
+		setPollingDefaults(&config.Downloaders[idx].PollingConfig, 16)
+		setHookDefaults(&config.Downloaders[idx].Hooks)
+		setRemoteCommandDefaults(&config.Downloaders[idx].RemoteCommands)
+		parseExpectations(downloader.Name, config.Downloaders[idx].Expectations)
+		normalizeTransforms(config.Downloaders[idx].Transforms)
+		parsePackaging(&config.Downloaders[idx].Packaging)
+		if config.Downloaders[idx].Packaging.ExtractMaxSize <= 0 {
+			config.Downloaders[idx].Packaging.ExtractMaxSize = 10240
+		}
+		if config.Downloaders[idx].Packaging.ExtractMaxFiles <= 0 {
+			config.Downloaders[idx].Packaging.ExtractMaxFiles = 10000
+		}
 		for _, server := range config.Servers {
 			if server.Name == downloader.Source {
 				config.Downloaders[idx].SourceServer = server
@@ -140,6 +611,16 @@ func ReadConfig(path_to_config string) (MasterConfig, error) {
 		if config.Uploaders[idx].Throughput <= 0 {
 			config.Uploaders[idx].Throughput = 10
 		}
+		parseAttributes(&config.Uploaders[idx].Attributes)
+		// a local folder is cheap to scan, no backoff unless configured
+		setPollingDefaults(&config.Uploaders[idx].PollingConfig, 0)
+		if config.Uploaders[idx].RescanInterval <= 0 {
+			config.Uploaders[idx].RescanInterval = 300
+		}
+		setHookDefaults(&config.Uploaders[idx].Hooks)
+		setRemoteCommandDefaults(&config.Uploaders[idx].RemoteCommands)
+		normalizeTransforms(config.Uploaders[idx].Transforms)
+		parsePackaging(&config.Uploaders[idx].Packaging)
 		for _, server := range config.Servers {
 			if server.Name == uploader.Target {
 				config.Uploaders[idx].TargetServer = server
@@ -157,9 +638,12 @@ func ReadConfig(path_to_config string) (MasterConfig, error) {
 		if config.Syncers[idx].Throughput <= 0 {
 			config.Syncers[idx].Throughput = 10
 		}
-		if config.Syncers[idx].SleepInterval < 1 {
-			config.Syncers[idx].SleepInterval = 1
-		}
+		// syncers always mirror the modified time, it is how changes are detected
+		config.Syncers[idx].Attributes.PreserveTimes = true
+		parseAttributes(&config.Syncers[idx].Attributes)
+		setHookDefaults(&config.Syncers[idx].Hooks)
+		setRemoteCommandDefaults(&config.Syncers[idx].RemoteCommands)
+		parseExpectations(syncer.Name, config.Syncers[idx].Expectations)
 
 		config.Syncers[idx].Mode = strings.ToLower(config.Syncers[idx].Mode)
 		switch config.Syncers[idx].Mode {
@@ -169,6 +653,14 @@ func ReadConfig(path_to_config string) (MasterConfig, error) {
 		default:
 			config.Syncers[idx].Mode = "server"
 		}
+		if config.Syncers[idx].Mode == "local" {
+			setPollingDefaults(&config.Syncers[idx].PollingConfig, 0)
+			if config.Syncers[idx].RescanInterval <= 0 {
+				config.Syncers[idx].RescanInterval = 300
+			}
+		} else {
+			setPollingDefaults(&config.Syncers[idx].PollingConfig, 16)
+		}
 
 		for _, server := range config.Servers {
 			if server.Name == syncer.Server {
@@ -181,8 +673,26 @@ func ReadConfig(path_to_config string) (MasterConfig, error) {
 		if config.Streamers[idx].Worker < 1 {
 			config.Streamers[idx].Worker = 1
 		}
-		if config.Streamers[idx].SleepInterval < 1 {
-			config.Streamers[idx].SleepInterval = 1
+		setPollingDefaults(&config.Streamers[idx].PollingConfig, 16)
+		if config.Streamers[idx].MaxTimeout <= 0 {
+			config.Streamers[idx].MaxTimeout = 600
+		}
+		if config.Streamers[idx].Throughput <= 0 {
+			config.Streamers[idx].Throughput = 10
+		}
+		parseAttributes(&config.Streamers[idx].Attributes)
+		setHookDefaults(&config.Streamers[idx].Hooks)
+		setRemoteCommandDefaults(&config.Streamers[idx].RemoteCommands)
+		parseExpectations(streamer.Name, config.Streamers[idx].Expectations)
+		normalizeTransforms(config.Streamers[idx].Transforms)
+
+		config.Streamers[idx].SuccessPolicy = strings.ToLower(config.Streamers[idx].SuccessPolicy)
+		if config.Streamers[idx].SuccessPolicy == "" {
+			config.Streamers[idx].SuccessPolicy = "all"
+		}
+		// unset, a majority
+		if config.Streamers[idx].SuccessPolicy == "quorum" && config.Streamers[idx].Quorum == 0 {
+			config.Streamers[idx].Quorum = len(streamTargets(streamer))/2 + 1
 		}
 
 		for _, server := range config.Servers {
@@ -195,10 +705,56 @@ func ReadConfig(path_to_config string) (MasterConfig, error) {
 		}
 	}
 
-	err = validateConfig(config)
+	for idx, notifier := range config.Notifiers {
+		if notifier.Retries < 0 {
+			config.Notifiers[idx].Retries = 0
+		} else if notifier.Retries == 0 {
+			config.Notifiers[idx].Retries = 3
+		}
+		if notifier.Timeout <= 0 {
+			config.Notifiers[idx].Timeout = 10
+		}
+		for event_idx, event := range notifier.Events {
+			config.Notifiers[idx].Events[event_idx] = strings.ToLower(event)
+		}
+	}
+
+	parseEmail(&config.Email)
+	config.General.History.Audit = strings.ToLower(config.General.History.Audit)
+	parseLogging(&config.General.Logging)
+
+	if config.General.Health.StallTimeout <= 0 {
+		config.General.Health.StallTimeout = 3600
+	}
+}
+
+// ReadConfig reads the config from a file, merged with the files in conf.d
+// next to it, or from all files of a folder. A config with problems is
+// rejected with a ValidationError listing all of them.
+func ReadConfig(path_to_config string) (MasterConfig, error) {
+
+	files, err := configFiles(path_to_config)
+	if err != nil {
+		return MasterConfig{}, err
+	}
+
+	config, config_lines, problems, err := readFiles(files)
 	if err != nil {
 		return config, err
 	}
+	config_dir := filepath.Dir(path_to_config)
+	if len(files) > 0 && files[0] != path_to_config {
+		config_dir = path_to_config
+	}
+	config.General.Secrets = SecretPaths(config.General.Secrets, config_dir)
+	problems = append(problems, resolveSecrets(&config, config_lines)...)
+
+	setDefaults(&config)
+	problems = append(problems, validateConfig(config, config_lines)...)
+	expandTargets(&config)
+	if len(problems) > 0 {
+		return config, &ValidationError{Path: path_to_config, Problems: problems}
+	}
 
 	return config, nil
 }
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// INCLUDE_DIR is the folder next to the config file whose files are merged
+// into the config
+const INCLUDE_DIR = "conf.d"
+
+func yamlFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// configFiles returns the files of a config: a file and the files in
+// conf.d next to it, or all files of a folder, in name order
+func configFiles(path_to_config string) ([]string, error) {
+	info, err := os.Stat(path_to_config)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files, err := yamlFiles(path_to_config)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: no .yaml files in the folder", path_to_config)
+		}
+		return files, nil
+	}
+	files := []string{path_to_config}
+	included, err := yamlFiles(filepath.Join(filepath.Dir(path_to_config), INCLUDE_DIR))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(files, included...), nil
+}
+
+// merge adds the jobs, servers and notifiers of part to config. General and
+// email are only taken from the one file setting them.
+func merge(config *MasterConfig, part MasterConfig) {
+	config.Servers = append(config.Servers, part.Servers...)
+	config.Downloaders = append(config.Downloaders, part.Downloaders...)
+	config.Uploaders = append(config.Uploaders, part.Uploaders...)
+	config.Syncers = append(config.Syncers, part.Syncers...)
+	config.Streamers = append(config.Streamers, part.Streamers...)
+	config.Notifiers = append(config.Notifiers, part.Notifiers...)
+}
+
+// readFiles decodes and merges the files of a config, returning where each
+// key is and the problems found so far
+func readFiles(files []string) (MasterConfig, lines, []Problem, error) {
+	config := MasterConfig{}
+	config_lines := make(lines)
+	problems := []Problem{}
+	set_by := make(map[string]string)
+	for _, file := range files {
+		yfile, err := os.ReadFile(file)
+		if err != nil {
+			return config, nil, nil, err
+		}
+		var root yaml.Node
+		err = yaml.Unmarshal(yfile, &root)
+		if err != nil {
+			return config, nil, nil, fmt.Errorf("%s: %v", file, err)
+		}
+		part := MasterConfig{}
+		err = root.Decode(&part)
+		if err != nil {
+			return config, nil, nil, fmt.Errorf("%s: %v", file, err)
+		}
+		problems = append(problems, strictProblems(file, yfile)...)
+
+		config_lines.walk(file, &root, "", map[string]int{
+			"servers":     len(config.Servers),
+			"downloaders": len(config.Downloaders),
+			"uploaders":   len(config.Uploaders),
+			"syncers":     len(config.Syncers),
+			"streamers":   len(config.Streamers),
+			"notifiers":   len(config.Notifiers),
+		})
+		for _, section := range []string{"general", "email"} {
+			where, found := config_lines[section]
+			if !found || where.File != file {
+				continue
+			}
+			if other, found := set_by[section]; found {
+				where.Message = fmt.Sprintf("%s is already set in %s, it can only be set in one file", section, other)
+				problems = append(problems, where)
+				continue
+			}
+			set_by[section] = file
+			if section == "general" {
+				config.General = part.General
+			} else {
+				config.Email = part.Email
+			}
+		}
+		merge(&config, part)
+	}
+	return config, config_lines, problems, nil
+}
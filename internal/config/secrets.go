@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/iambighead/ugoku/internal/secrets"
+)
+
+// SecretPaths fills in the default store and master key file, next to the
+// config. UGOKU_MASTER_KEY_FILE overrides the master key file.
+func SecretPaths(cfg SecretsConfig, config_dir string) SecretsConfig {
+	if cfg.Store == "" {
+		cfg.Store = filepath.Join(config_dir, "secrets.json")
+	}
+	if env_key := os.Getenv("UGOKU_MASTER_KEY_FILE"); env_key != "" {
+		cfg.MasterKeyFile = env_key
+	}
+	if cfg.MasterKeyFile == "" {
+		cfg.MasterKeyFile = filepath.Join(config_dir, "master.key")
+	}
+	return cfg
+}
+
+// resolveSecrets replaces the secret references of passwords, passphrases
+// and tokens by their value
+func resolveSecrets(config *MasterConfig, l lines) []Problem {
+	resolver := &secrets.Resolver{StorePath: config.General.Secrets.Store, MasterKeyFile: config.General.Secrets.MasterKeyFile}
+	problems := []Problem{}
+	resolve := func(key string, value *string) {
+		resolved, err := resolver.Resolve(*value)
+		if err != nil {
+			where := l.line(key)
+			where.Message = fmt.Sprintf("%s: %v", key, err)
+			problems = append(problems, where)
+			return
+		}
+		*value = resolved
+	}
+
+	for idx := range config.Servers {
+		prefix := fmt.Sprintf("servers.%d.", idx)
+		resolve(prefix+"password", &config.Servers[idx].Password)
+		resolve(prefix+"keypassphrase", &config.Servers[idx].KeyPassphrase)
+	}
+	for idx := range config.Downloaders {
+		resolve(fmt.Sprintf("downloaders.%d.pgp.passphrase", idx), &config.Downloaders[idx].Pgp.Passphrase)
+	}
+	for idx := range config.Uploaders {
+		resolve(fmt.Sprintf("uploaders.%d.pgp.passphrase", idx), &config.Uploaders[idx].Pgp.Passphrase)
+	}
+	for idx := range config.Streamers {
+		resolve(fmt.Sprintf("streamers.%d.pgp.passphrase", idx), &config.Streamers[idx].Pgp.Passphrase)
+	}
+	for idx, notifier := range config.Notifiers {
+		prefix := fmt.Sprintf("notifiers.%d.", idx)
+		resolve(prefix+"url", &config.Notifiers[idx].Url)
+		resolve(prefix+"secret", &config.Notifiers[idx].Secret)
+		for name, value := range notifier.Headers {
+			resolve(prefix+"headers."+name, &value)
+			config.Notifiers[idx].Headers[name] = value
+		}
+	}
+	resolve("email.password", &config.Email.Password)
+	resolve("general.admin.token", &config.General.Admin.Token)
+	resolve("general.history.auditkey", &config.General.History.AuditKey)
+	return problems
+}
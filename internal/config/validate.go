@@ -0,0 +1,612 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/iambighead/ugoku/internal/cron"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one problem found in the config, Line is 0 when it is not tied
+// to a line, File is empty when it is not tied to a file
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// ValidationError holds all problems found in a config
+type ValidationError struct {
+	Path     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		file := problem.File
+		if file == "" {
+			file = e.Path
+		}
+		if problem.Line > 0 {
+			messages = append(messages, fmt.Sprintf("%s:%d: %s", file, problem.Line, problem.Message))
+		} else {
+			messages = append(messages, fmt.Sprintf("%s: %s", file, problem.Message))
+		}
+	}
+	return strings.Join(messages, "\n")
+}
+
+// lines maps a key path like downloaders.0.source to where it is in the
+// config files, a problem without message
+type lines map[string]Problem
+
+// walk records the keys of a file, the items of the top level lists are
+// numbered from offsets, as the lists of all files are merged
+func (l lines) walk(file string, node *yaml.Node, prefix string, offsets map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			l.walk(file, child, prefix, offsets)
+		}
+	case yaml.MappingNode:
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			key := prefix + node.Content[idx].Value
+			l[key] = Problem{File: file, Line: node.Content[idx].Line}
+			l.walk(file, node.Content[idx+1], key+".", offsets)
+		}
+	case yaml.SequenceNode:
+		offset := 0
+		if !strings.Contains(strings.TrimSuffix(prefix, "."), ".") {
+			offset = offsets[strings.TrimSuffix(prefix, ".")]
+		}
+		for idx, child := range node.Content {
+			key := fmt.Sprintf("%s%d", prefix, offset+idx)
+			l[key] = Problem{File: file, Line: child.Line}
+			l.walk(file, child, key+".", offsets)
+		}
+	}
+}
+
+// line returns where the first key found is, the most precise first
+func (l lines) line(keys ...string) Problem {
+	for _, key := range keys {
+		if where, found := l[strings.TrimSuffix(key, ".")]; found {
+			return where
+		}
+	}
+	return Problem{}
+}
+
+// strictProblems decodes a config file again rejecting unknown keys, which
+// the normal decoding silently ignores
+func strictProblems(file string, yfile []byte) []Problem {
+	decoder := yaml.NewDecoder(strings.NewReader(string(yfile)))
+	decoder.KnownFields(true)
+	var strict MasterConfig
+	err := decoder.Decode(&strict)
+	type_err, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil
+	}
+	problems := []Problem{}
+	for _, message := range type_err.Errors {
+		var line int
+		if _, scan_err := fmt.Sscanf(message, "line %d:", &line); scan_err == nil {
+			message = strings.TrimSpace(message[strings.Index(message, ":")+1:])
+		}
+		problems = append(problems, Problem{File: file, Line: line, Message: message})
+	}
+	return problems
+}
+
+// folder roles
+const (
+	// files are read and removed once transferred
+	FOLDER_CONSUME = "consume"
+	FOLDER_READ    = "read"
+	FOLDER_WRITE   = "write"
+)
+
+// folder is a folder a job takes files from, or writes files to. Server is
+// empty for a local folder.
+type folder struct {
+	job    string
+	server string
+	path   string
+	role   string
+	where  Problem
+}
+
+// within tells if folder a is folder b or inside it
+func within(a folder, b folder) bool {
+	if a.server != b.server {
+		return false
+	}
+	clean, sep := path.Clean, "/"
+	if a.server == "" {
+		clean, sep = filepath.Clean, string(filepath.Separator)
+	}
+	a_path, b_path := clean(a.path), clean(b.path)
+	return a_path == b_path || strings.HasPrefix(a_path, strings.TrimSuffix(b_path, sep)+sep)
+}
+
+func overlaps(a folder, b folder) bool {
+	return within(a, b) || within(b, a)
+}
+
+// Checks parse the parts of a job which are parsed by the packages running
+// the jobs, as these depend on config. Main sets them before the config is
+// read, so a job that would not start is reported like any other problem.
+type Checks struct {
+	Schedule       func(ScheduleConfig) error
+	Transforms     func([]TransformConfig) error
+	RemoteCommands func(RemoteCommandsConfig) error
+}
+
+var checks Checks
+
+// SetChecks sets the checks run on every job when the config is read
+func SetChecks(c Checks) {
+	checks = c
+}
+
+type validator struct {
+	lines    lines
+	problems []Problem
+	servers  map[string]bool
+	folders  []folder
+}
+
+func (v *validator) add(where Problem, format string, args ...interface{}) {
+	where.Message = fmt.Sprintf(format, args...)
+	v.problems = append(v.problems, where)
+}
+
+func (v *validator) readable(where Problem, what string, file string) {
+	if file == "" {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		v.add(where, "%s: %v", what, err)
+		return
+	}
+	f.Close()
+}
+
+func (v *validator) server(prefix string, job string, key string, name string) {
+	where := v.lines.line(prefix+key, prefix)
+	if name == "" {
+		v.add(where, "%s: %s is required", job, key)
+	} else if !v.servers[name] {
+		v.add(where, "%s: %s %s is not defined in servers", job, key, name)
+	}
+}
+
+func (v *validator) required(prefix string, job string, key string, value string) {
+	if value == "" {
+		v.add(v.lines.line(prefix), "%s: %s is required", job, key)
+	}
+}
+
+// localFolder checks a local folder the job reads from exists
+func (v *validator) localFolder(prefix string, job string, key string, value string, enabled bool) {
+	if value == "" || !enabled {
+		return
+	}
+	info, err := os.Stat(value)
+	if err != nil {
+		v.add(v.lines.line(prefix+key, prefix), "%s: %s: %v", job, key, err)
+	} else if !info.IsDir() {
+		v.add(v.lines.line(prefix+key, prefix), "%s: %s: %s is not a folder", job, key, value)
+	}
+}
+
+func (v *validator) folder(prefix string, job string, key string, server string, value string, role string, enabled bool) {
+	if value == "" || !enabled {
+		return
+	}
+	v.folders = append(v.folders, folder{job: job, server: server, path: value, role: role, where: v.lines.line(prefix+key, prefix)})
+}
+
+// conflict tells why two overlapping folders cannot work together, if so
+func conflict(a folder, b folder) string {
+	switch {
+	case a.role == FOLDER_CONSUME && b.role == FOLDER_CONSUME:
+		return "both take files from it"
+	case a.job == b.job && (a.role == FOLDER_WRITE) != (b.role == FOLDER_WRITE):
+		return "the job would transfer its own files again"
+	case a.job == "general" && b.role != FOLDER_WRITE && within(a, b), b.job == "general" && a.role != FOLDER_WRITE && within(b, a):
+		return "temporary files would be picked up"
+	}
+	return ""
+}
+
+// pgp checks the options and key files of a job, outbound for an uploader
+// or streamer
+func (v *validator) pgp(prefix string, job string, pgp PgpConfig, outbound bool) {
+	line := func(keys ...string) Problem {
+		for idx := range keys {
+			keys[idx] = prefix + "pgp." + keys[idx]
+		}
+		return v.lines.line(append(keys, prefix+"pgp", prefix)...)
+	}
+	if outbound && (pgp.Decrypt || pgp.Verify) {
+		v.add(line("decrypt", "verify"), "%s: pgp decrypt/verify is only supported by downloaders", job)
+	}
+	if !outbound && (pgp.Encrypt || pgp.Sign) {
+		v.add(line("encrypt", "sign"), "%s: pgp encrypt/sign is only supported by uploaders and streamers", job)
+	}
+	if pgp.Sign && !pgp.Encrypt {
+		v.add(line("sign"), "%s: pgp sign requires encrypt", job)
+	}
+	if pgp.Verify && !pgp.Decrypt {
+		v.add(line("verify"), "%s: pgp verify requires decrypt", job)
+	}
+	if (pgp.Encrypt || pgp.Verify) && pgp.PublicKeyring == "" {
+		v.add(line("encrypt", "verify"), "%s: pgp publickeyring is required to encrypt or verify", job)
+	}
+	if (pgp.Sign || pgp.Decrypt) && pgp.SecretKeyring == "" {
+		v.add(line("sign", "decrypt"), "%s: pgp secretkeyring is required to sign or decrypt", job)
+	}
+	if pgp.Decrypt && pgp.QuarantinePath == "" {
+		v.add(line("decrypt"), "%s: pgp quarantinepath is required to decrypt", job)
+	}
+	v.readable(line("publickeyring"), job+": pgp publickeyring", pgp.PublicKeyring)
+	v.readable(line("secretkeyring"), job+": pgp secretkeyring", pgp.SecretKeyring)
+	v.readable(line("passphrasefile"), job+": pgp passphrasefile", pgp.PassphraseFile)
+}
+
+func (v *validator) attributes(prefix string, job string, attributes AttributesConfig) {
+	for _, mode := range []struct{ key, value string }{{"filemode", attributes.FileMode}, {"dirmode", attributes.DirMode}, {"umask", attributes.Umask}} {
+		if _, err := parseMode(mode.value); err != nil {
+			v.add(v.lines.line(prefix+"attributes."+mode.key, prefix+"attributes", prefix), "%s: %s: %v", job, mode.key, err)
+		}
+	}
+}
+
+// packaging checks the packaging of a job, inbound for a downloader
+func (v *validator) packaging(prefix string, job string, packaging PackagingConfig, pgp PgpConfig, inbound bool) {
+	line := func(key string) Problem {
+		return v.lines.line(prefix+"packaging."+key, prefix+"packaging", prefix)
+	}
+	switch packaging.Compress {
+	case "", "gzip", "zstd":
+	default:
+		v.add(line("compress"), "%s: packaging compress must be gzip or zstd: %s", job, packaging.Compress)
+	}
+	switch packaging.Bundle {
+	case "", "zip", "tar.gz":
+	default:
+		v.add(line("bundle"), "%s: packaging bundle must be zip or tar.gz: %s", job, packaging.Bundle)
+	}
+	if !inbound {
+		return
+	}
+	if packaging.Bundle != "" {
+		v.add(line("bundle"), "%s: packaging bundle is only supported by uploaders", job)
+	}
+	if pgp.Decrypt && packaging.Compress != "" {
+		v.add(line("compress"), "%s: packaging compress cannot be combined with pgp decrypt", job)
+	}
+	if packaging.Extract && packaging.Compress != "" {
+		v.add(line("compress"), "%s: packaging compress cannot be combined with extract", job)
+	}
+}
+
+func (v *validator) expectations(prefix string, job string, expectations []ExpectationConfig) {
+	for idx, expectation := range expectations {
+		expectation_prefix := fmt.Sprintf("%sexpectations.%d.", prefix, idx)
+		line := func(key string) Problem {
+			return v.lines.line(expectation_prefix+key, expectation_prefix)
+		}
+		if _, err := cron.Parse(expectation.Schedule); err != nil {
+			v.add(line("schedule"), "%s: expectation %s: %v", job, expectation.Name, err)
+		}
+		if _, err := filepath.Match(expectation.Pattern, ""); err != nil {
+			v.add(line("pattern"), "%s: expectation %s: pattern: %v", job, expectation.Name, err)
+		}
+		if expectation.Within <= 0 {
+			v.add(line("deadline"), "%s: expectation %s: invalid deadline %q, expecting a duration like 7h", job, expectation.Name, expectation.Deadline)
+		}
+	}
+}
+
+func (v *validator) jobLog(prefix string, job string, log JobLogConfig) {
+	if err := checkLogLevel(strings.ToLower(log.Level)); err != nil {
+		v.add(v.lines.line(prefix+"log.level", prefix+"log", prefix), "%s: log: %v", job, err)
+	}
+}
+
+func (v *validator) email(email EmailConfig) {
+	if email.Host == "" {
+		if len(email.Jobs) > 0 || len(email.DigestTo) > 0 {
+			v.add(v.lines.line("email.host", "email"), "email: host is required")
+		}
+		return
+	}
+	switch email.Security {
+	case "starttls", "tls", "none":
+	default:
+		v.add(v.lines.line("email.security", "email"), "email: security must be starttls, tls or none: %s", email.Security)
+	}
+	if email.From == "" {
+		v.add(v.lines.line("email.from", "email"), "email: from is required")
+	}
+	if err := checkTimeOfDay(email.Digest); err != nil {
+		v.add(v.lines.line("email.digest", "email"), "email: digest: %v", err)
+	}
+	for idx, job := range email.Jobs {
+		job_prefix := fmt.Sprintf("email.jobs.%d.", idx)
+		if err := checkTimeOfDay(job.Deadline); err != nil {
+			v.add(v.lines.line(job_prefix+"deadline", job_prefix), "email: %s: deadline: %v", job.Job, err)
+		}
+		for pattern_idx, pattern := range job.OnArrival {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				v.add(v.lines.line(fmt.Sprintf("%sonarrival.%d", job_prefix, pattern_idx), job_prefix), "email: %s: onarrival pattern %q: %v", job.Job, pattern, err)
+			}
+		}
+	}
+}
+
+// general checks the history audit and the logging
+func (v *validator) general(general GeneralConfig) {
+	history := general.History
+	where := v.lines.line("general.history.audit", "general.history")
+	switch history.Audit {
+	case "", "chain":
+	case "hmac":
+		if history.AuditKey == "" {
+			v.add(where, "history: auditkey is required with hmac audit")
+		}
+	case "ed25519":
+		if history.AuditKeyFile == "" {
+			v.add(where, "history: auditkeyfile is required with ed25519 audit")
+		}
+	default:
+		v.add(where, "history: unknown audit %s, expecting chain, hmac or ed25519", history.Audit)
+	}
+	v.readable(v.lines.line("general.history.auditkeyfile"), "history: auditkeyfile", history.AuditKeyFile)
+
+	if err := checkLogLevel(general.Logging.Level); err != nil {
+		v.add(v.lines.line("general.logging.level", "general.logging"), "logging: %v", err)
+	}
+	switch general.Logging.Format {
+	case "text", "json":
+	default:
+		v.add(v.lines.line("general.logging.format", "general.logging"), "logging: format must be text or json: %s", general.Logging.Format)
+	}
+}
+
+// parts runs the checks of the schedule, transforms and remote commands of
+// a job, their errors start with the key at fault
+func (v *validator) parts(prefix string, job string, schedule ScheduleConfig, transforms []TransformConfig, remote RemoteCommandsConfig) {
+	if checks.Schedule != nil {
+		if err := checks.Schedule(schedule); err != nil {
+			key, _, _ := strings.Cut(err.Error(), ":")
+			v.add(v.lines.line(prefix+key, prefix), "%s: %v", job, err)
+		}
+	}
+	if checks.Transforms != nil {
+		for idx, transform := range transforms {
+			if err := checks.Transforms([]TransformConfig{transform}); err != nil {
+				v.add(v.lines.line(fmt.Sprintf("%stransforms.%d", prefix, idx), prefix), "%s: transforms: %v", job, err)
+			}
+		}
+	}
+	if checks.RemoteCommands != nil {
+		if err := checks.RemoteCommands(remote); err != nil {
+			key, _, _ := strings.Cut(err.Error(), ":")
+			v.add(v.lines.line(prefix+"remotecommands."+key, prefix+"remotecommands", prefix), "%s: remotecommands: %v", job, err)
+		}
+	}
+}
+
+func (v *validator) names(kind string, prefix string, names []string, seen map[string]string) {
+	for idx, name := range names {
+		key := fmt.Sprintf("%s.%d", prefix, idx)
+		where := v.lines.line(key+".name", key)
+		if name == "" {
+			v.add(where, "%s[%d]: name is required", kind, idx)
+			continue
+		}
+		if other, found := seen[name]; found {
+			v.add(where, "%s: duplicate name, already used by a %s", name, other)
+			continue
+		}
+		seen[name] = kind
+	}
+}
+
+// validateConfig checks the values of every setting: names, references to
+// servers, key files, paths, and jobs feeding on each other's folders.
+// Folders of disabled jobs are neither checked on disk nor for overlaps.
+func validateConfig(cfg MasterConfig, l lines) []Problem {
+	v := &validator{lines: l, servers: make(map[string]bool)}
+
+	server_names := []string{}
+	for idx, server := range cfg.Servers {
+		server_names = append(server_names, server.Name)
+		prefix := fmt.Sprintf("servers.%d.", idx)
+		v.required(prefix, server.Name, "ip", server.Ip)
+		v.required(prefix, server.Name, "user", server.User)
+		v.readable(v.lines.line(prefix+"keyfile", prefix), server.Name+": keyfile", server.KeyFile)
+		v.readable(v.lines.line(prefix+"certfile", prefix), server.Name+": certfile", server.CertFile)
+	}
+	v.names("server", "servers", server_names, make(map[string]string))
+	for _, name := range server_names {
+		v.servers[name] = true
+	}
+
+	job_names := make(map[string]string)
+	names := []string{}
+	for _, downloader := range cfg.Downloaders {
+		names = append(names, downloader.Name)
+	}
+	v.names("downloader", "downloaders", names, job_names)
+	names = []string{}
+	for _, uploader := range cfg.Uploaders {
+		names = append(names, uploader.Name)
+	}
+	v.names("uploader", "uploaders", names, job_names)
+	names = []string{}
+	for _, syncer := range cfg.Syncers {
+		names = append(names, syncer.Name)
+	}
+	v.names("syncer", "syncers", names, job_names)
+	names = []string{}
+	for _, streamer := range cfg.Streamers {
+		names = append(names, streamer.Name)
+	}
+	v.names("streamer", "streamers", names, job_names)
+	names = []string{}
+	for _, notifier := range cfg.Notifiers {
+		names = append(names, notifier.Name)
+	}
+	v.names("notifier", "notifiers", names, make(map[string]string))
+
+	for idx, downloader := range cfg.Downloaders {
+		prefix := fmt.Sprintf("downloaders.%d.", idx)
+		v.server(prefix, downloader.Name, "source", downloader.Source)
+		v.required(prefix, downloader.Name, "sourcepath", downloader.SourcePath)
+		v.required(prefix, downloader.Name, "targetpath", downloader.TargetPath)
+		v.attributes(prefix, downloader.Name, downloader.Attributes)
+		v.packaging(prefix, downloader.Name, downloader.Packaging, downloader.Pgp, true)
+		v.pgp(prefix, downloader.Name, downloader.Pgp, false)
+		v.expectations(prefix, downloader.Name, downloader.Expectations)
+		v.jobLog(prefix, downloader.Name, downloader.Log)
+		v.parts(prefix, downloader.Name, downloader.ScheduleConfig, downloader.Transforms, downloader.RemoteCommands)
+		v.folder(prefix, downloader.Name, "sourcepath", downloader.Source, downloader.SourcePath, FOLDER_CONSUME, downloader.Enabled)
+		v.folder(prefix, downloader.Name, "targetpath", "", downloader.TargetPath, FOLDER_WRITE, downloader.Enabled)
+	}
+	for idx, uploader := range cfg.Uploaders {
+		prefix := fmt.Sprintf("uploaders.%d.", idx)
+		v.server(prefix, uploader.Name, "target", uploader.Target)
+		v.required(prefix, uploader.Name, "sourcepath", uploader.SourcePath)
+		v.required(prefix, uploader.Name, "targetpath", uploader.TargetPath)
+		v.localFolder(prefix, uploader.Name, "sourcepath", uploader.SourcePath, uploader.Enabled)
+		v.attributes(prefix, uploader.Name, uploader.Attributes)
+		v.packaging(prefix, uploader.Name, uploader.Packaging, uploader.Pgp, false)
+		v.pgp(prefix, uploader.Name, uploader.Pgp, true)
+		v.jobLog(prefix, uploader.Name, uploader.Log)
+		v.parts(prefix, uploader.Name, uploader.ScheduleConfig, uploader.Transforms, uploader.RemoteCommands)
+		v.folder(prefix, uploader.Name, "sourcepath", "", uploader.SourcePath, FOLDER_CONSUME, uploader.Enabled)
+		v.folder(prefix, uploader.Name, "targetpath", uploader.Target, uploader.TargetPath, FOLDER_WRITE, uploader.Enabled)
+	}
+	for idx, syncer := range cfg.Syncers {
+		prefix := fmt.Sprintf("syncers.%d.", idx)
+		v.server(prefix, syncer.Name, "server", syncer.Server)
+		v.required(prefix, syncer.Name, "serverpath", syncer.ServerPath)
+		v.required(prefix, syncer.Name, "localpath", syncer.LocalPath)
+		v.parts(prefix, syncer.Name, syncer.ScheduleConfig, nil, syncer.RemoteCommands)
+		v.attributes(prefix, syncer.Name, syncer.Attributes)
+		v.expectations(prefix, syncer.Name, syncer.Expectations)
+		v.jobLog(prefix, syncer.Name, syncer.Log)
+		local := strings.ToLower(syncer.Mode) == "local"
+		if local {
+			v.localFolder(prefix, syncer.Name, "localpath", syncer.LocalPath, syncer.Enabled)
+		}
+		server_role, local_role := FOLDER_READ, FOLDER_WRITE
+		if local {
+			server_role, local_role = FOLDER_WRITE, FOLDER_READ
+		}
+		v.folder(prefix, syncer.Name, "serverpath", syncer.Server, syncer.ServerPath, server_role, syncer.Enabled)
+		v.folder(prefix, syncer.Name, "localpath", "", syncer.LocalPath, local_role, syncer.Enabled)
+	}
+	for idx, streamer := range cfg.Streamers {
+		prefix := fmt.Sprintf("streamers.%d.", idx)
+		v.server(prefix, streamer.Name, "source", streamer.Source)
+		v.required(prefix, streamer.Name, "sourcepath", streamer.SourcePath)
+		v.attributes(prefix, streamer.Name, streamer.Attributes)
+		v.pgp(prefix, streamer.Name, streamer.Pgp, true)
+		v.expectations(prefix, streamer.Name, streamer.Expectations)
+		v.jobLog(prefix, streamer.Name, streamer.Log)
+		switch streamer.SuccessPolicy {
+		case "all", "any", "quorum":
+		default:
+			v.add(v.lines.line(prefix+"successpolicy", prefix), "%s: successpolicy must be all, any or quorum: %s", streamer.Name, streamer.SuccessPolicy)
+		}
+		target_count := len(streamTargets(streamer))
+		if streamer.Quorum != 0 && streamer.SuccessPolicy != "quorum" {
+			v.add(v.lines.line(prefix+"quorum", prefix), "%s: quorum is only used with successpolicy quorum", streamer.Name)
+		} else if streamer.Quorum < 0 || (target_count > 0 && streamer.Quorum > target_count) {
+			v.add(v.lines.line(prefix+"quorum", prefix), "%s: quorum must be between 1 and the %d target(s): %d", streamer.Name, target_count, streamer.Quorum)
+		}
+		v.parts(prefix, streamer.Name, streamer.ScheduleConfig, streamer.Transforms, streamer.RemoteCommands)
+		v.folder(prefix, streamer.Name, "sourcepath", streamer.Source, streamer.SourcePath, FOLDER_CONSUME, streamer.Enabled)
+		targets := streamer.Targets
+		if len(targets) == 0 {
+			if streamer.Target == "" && streamer.TargetPath == "" {
+				v.add(v.lines.line(prefix), "%s: target or targets is required", streamer.Name)
+			}
+			targets = []StreamTargetConfig{{Target: streamer.Target, TargetPath: streamer.TargetPath}}
+		} else if streamer.Target != "" || streamer.TargetPath != "" {
+			v.add(v.lines.line(prefix+"target", prefix+"targetpath", prefix), "%s: set target and targetpath, or targets, not both", streamer.Name)
+		}
+		for target_idx, target := range targets {
+			target_prefix := prefix
+			if len(streamer.Targets) > 0 {
+				target_prefix = fmt.Sprintf("%stargets.%d.", prefix, target_idx)
+			}
+			v.server(target_prefix, streamer.Name, "target", target.Target)
+			v.required(target_prefix, streamer.Name, "targetpath", target.TargetPath)
+			v.folder(target_prefix, streamer.Name, "targetpath", target.Target, target.TargetPath, FOLDER_WRITE, streamer.Enabled)
+		}
+	}
+
+	v.email(cfg.Email)
+	for idx, job := range cfg.Email.Jobs {
+		if _, found := job_names[job.Job]; job.Job != "" && !found {
+			v.add(v.lines.line(fmt.Sprintf("email.jobs.%d.job", idx)), "email: unknown job %s", job.Job)
+		}
+	}
+	for idx, notifier := range cfg.Notifiers {
+		if notifier.Url == "" {
+			v.add(v.lines.line(fmt.Sprintf("notifiers.%d.url", idx), fmt.Sprintf("notifiers.%d", idx)), "notifier %s: url is required", notifier.Name)
+		}
+		for job_idx, job := range notifier.Jobs {
+			if _, found := job_names[job]; !found {
+				v.add(v.lines.line(fmt.Sprintf("notifiers.%d.jobs.%d", idx, job_idx)), "notifier %s: unknown job %s", notifier.Name, job)
+			}
+		}
+	}
+
+	if cfg.General.TempFolder != "" {
+		if info, err := os.Stat(cfg.General.TempFolder); err != nil || !info.IsDir() {
+			v.add(v.lines.line("general.tempfolder"), "general: tempfolder %s is not a folder", cfg.General.TempFolder)
+		}
+		v.folder("general.", "general", "tempfolder", "", cfg.General.TempFolder, FOLDER_WRITE, true)
+	}
+	v.readable(v.lines.line("general.admin.certfile"), "admin: certfile", cfg.General.Admin.CertFile)
+	v.readable(v.lines.line("general.admin.keyfile"), "admin: keyfile", cfg.General.Admin.KeyFile)
+	v.general(cfg.General)
+	for idx, job := range cfg.General.Health.CriticalJobs {
+		if _, found := job_names[job]; !found {
+			v.add(v.lines.line(fmt.Sprintf("general.health.criticaljobs.%d", idx), "general.health.criticaljobs"), "health: unknown critical job %s", job)
+		}
+	}
+
+	for a := 0; a < len(v.folders); a++ {
+		for b := a + 1; b < len(v.folders); b++ {
+			first, second := v.folders[a], v.folders[b]
+			if !overlaps(first, second) {
+				continue
+			}
+			reason := conflict(first, second)
+			if reason == "" {
+				continue
+			}
+			where := "local folder"
+			if first.server != "" {
+				where = "folder on " + first.server
+			}
+			v.add(second.where, "%s: %s %s overlaps %s of %s, %s", second.job, where, second.path, first.path, first.job, reason)
+		}
+	}
+	return v.problems
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// base is the start of every test config, TMP is replaced with a folder of
+// the test
+const base = `general:
+  tempfolder: TMP/temp
+servers:
+  - name: s1
+    ip: 127.0.0.1
+    user: u
+    password: p
+  - name: s2
+    ip: 127.0.0.2
+    user: u
+    password: p
+`
+
+// expected is a problem the config must report, message is part of it and
+// file is relative to the test folder, the main config when empty
+type expected struct {
+	file    string
+	line    int
+	message string
+}
+
+// readProblems writes the config, and the files of conf.d, and returns the
+// problems found reading it
+func readProblems(t *testing.T, main string, included map[string]string) (string, []Problem) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "temp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, content string) {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(strings.ReplaceAll(content, "TMP", dir)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ugoku.yaml", main)
+	for name, content := range included {
+		write(filepath.Join(INCLUDE_DIR, name), content)
+	}
+	_, err := ReadConfig(filepath.Join(dir, "ugoku.yaml"))
+	if err == nil {
+		return dir, nil
+	}
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("not a validation error: %v", err)
+	}
+	return dir, validation.Problems
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		included map[string]string
+		expected []expected
+	}{
+		{"valid", base + `downloaders:
+  - name: d1
+    source: s1
+    sourcepath: /in
+    targetpath: TMP/out
+streamers:
+  - name: st1
+    source: s1
+    sourcepath: /stream
+    target: s2
+    targetpath: /out
+`, nil, nil},
+
+		{"unknown key", base + `downloaders:
+  - name: d1
+    source: s1
+    sourcepth: /in
+    targetpath: TMP/out
+`, nil, []expected{
+			{"", 15, "field sourcepth not found"},
+			{"", 13, "d1: sourcepath is required"},
+		}},
+
+		{"duplicate name and temp folder overlap", base + `downloaders:
+  - name: d1
+    source: s1
+    sourcepath: /in
+    targetpath: TMP/out
+uploaders:
+  - name: d1
+    target: s1
+    sourcepath: TMP/temp
+    targetpath: /up
+    enabled: true
+`, nil, []expected{
+			{"", 18, "d1: duplicate name, already used by a downloader"},
+			{"", 2, "general: local folder"},
+		}},
+
+		{"undefined server", base + `downloaders:
+  - name: d1
+    source: nosuch
+    sourcepath: /in
+    targetpath: TMP/out
+`, nil, []expected{
+			{"", 14, "d1: source nosuch is not defined in servers"},
+		}},
+
+		{"overlapping folders", base + `downloaders:
+  - name: d1
+    source: s1
+    sourcepath: /in
+    targetpath: TMP/out1
+    enabled: true
+  - name: d2
+    source: s1
+    sourcepath: /in/sub
+    targetpath: TMP/out2
+    enabled: true
+  - name: d3
+    source: s2
+    sourcepath: /in
+    targetpath: TMP/out3
+    enabled: true
+  - name: d4
+    source: s1
+    sourcepath: /in
+    targetpath: TMP/out4
+`, nil, []expected{
+			{"", 20, "d2: folder on s1 /in/sub overlaps /in of d1, both take files from it"},
+		}},
+
+		{"every invalid setting with its line", base + `downloaders:
+  - name: d1
+    source: s1
+    sourcepath: /in1
+    targetpath: TMP/out1
+    attributes:
+      filemode: "999"
+  - name: d2
+    source: s1
+    sourcepath: /in2
+    targetpath: TMP/out2
+    packaging:
+      compress: rar
+    expectations:
+      - schedule: "0 7 * * *"
+        deadline: 7x
+notifiers:
+  - name: n1
+general_typo: true
+`, nil, []expected{
+			{"", 30, "field general_typo not found"},
+			{"", 18, `d1: filemode: invalid mode "999"`},
+			{"", 24, "d2: packaging compress must be gzip or zstd: rar"},
+			{"", 27, `d2: expectation d2#1: invalid deadline "7x"`},
+			{"", 29, "notifier n1: url is required"},
+		}},
+
+		{"target and targets", base + `streamers:
+  - name: st1
+    source: s1
+    sourcepath: /stream
+    target: nosuch
+    targets:
+      - target: s2
+        targetpath: /out
+`, nil, []expected{
+			{"", 16, "st1: set target and targetpath, or targets, not both"},
+		}},
+
+		{"single target", base + `streamers:
+  - name: st1
+    source: s1
+    sourcepath: /stream
+    target: nosuch
+    targetpath: /out
+    successpolicy: quorum
+    quorum: 2
+`, nil, []expected{
+			{"", 19, "st1: quorum must be between 1 and the 1 target(s): 2"},
+			{"", 16, "st1: target nosuch is not defined in servers"},
+		}},
+
+		{"lines of included files", base + `downloaders:
+  - name: d1
+    source: s1
+    sourcepath: /in
+    targetpath: TMP/out
+`, map[string]string{"jobs.yaml": `downloaders:
+  - name: d2
+    source: s1
+    sourcepath: /other
+    targetpath: TMP/out2
+    attributes:
+      umask: "8"
+  - name: d1
+    source: nosuch
+    sourcepath: /third
+    targetpath: TMP/out3
+`}, []expected{
+			{"conf.d/jobs.yaml", 8, "d1: duplicate name, already used by a downloader"},
+			{"conf.d/jobs.yaml", 7, `d2: umask: invalid mode "8"`},
+			{"conf.d/jobs.yaml", 9, "d1: source nosuch is not defined in servers"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, problems := readProblems(t, test.config, test.included)
+			report := &ValidationError{Path: filepath.Join(dir, "ugoku.yaml"), Problems: problems}
+			if len(problems) != len(test.expected) {
+				t.Fatalf("got %d problems, expecting %d:\n%s", len(problems), len(test.expected), report.Error())
+			}
+			for idx, want := range test.expected {
+				got := problems[idx]
+				file := filepath.Join(dir, "ugoku.yaml")
+				if want.file != "" {
+					file = filepath.Join(dir, want.file)
+				}
+				if got.File != file || got.Line != want.line || !strings.Contains(got.Message, want.message) {
+					t.Fatalf("problem %d is %s:%d: %s, expecting %s:%d: %s\n%s", idx, got.File, got.Line, got.Message, file, want.line, want.message, report.Error())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five field cron expression:
+// minute hour day-of-month month day-of-week
+type Schedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	any_dom bool
+	any_dow bool
+}
+
+type field struct {
+	min   int
+	max   int
+	names []string
+}
+
+var fields = []field{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse reads a standard cron expression, with lists, ranges, steps, month
+// and day names, and the @daily style macros
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if macro, ok := macros[expr]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("cron %q: expecting 5 fields, got %d", expr, len(parts))
+	}
+
+	var bits [5]uint64
+	for idx, part := range parts {
+		value, err := parseField(part, fields[idx])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		bits[idx] = value
+	}
+	// sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		any_dom: parts[2] == "*" || parts[2] == "?",
+		any_dow: parts[4] == "*" || parts[4] == "?",
+	}, nil
+}
+
+func parseValue(value string, f field) (int, error) {
+	for idx, name := range f.names {
+		if value == name {
+			return idx + f.min, nil
+		}
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < f.min || number > f.max {
+		return 0, fmt.Errorf("invalid value %q, expecting %d-%d", value, f.min, f.max)
+	}
+	return number, nil
+}
+
+func parseField(part string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(part, ",") {
+		step := 1
+		if slash := strings.Index(item, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[slash+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			item = item[:slash]
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case item == "*" || item == "?":
+		case strings.Contains(item, "-"):
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if low, err = parseValue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			if high, err = parseValue(bounds[1], f); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q", item)
+			}
+		default:
+			value, err := parseValue(item, f)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			if step == 1 {
+				high = value
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func has(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+	// as in cron, a restricted day of month and day of week match either
+	if !s.any_dom && !s.any_dow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Matches tells if the minute of t is part of the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	return has(s.month, int(t.Month())) && s.dayMatches(t) && has(s.hour, t.Hour()) && has(s.minute, t.Minute())
+}
+
+// Next returns the first time of the schedule strictly after t, in the
+// location of t. It returns the zero time if there is none within 5 years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,108 @@
+package dryrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// actions recorded in a plan
+const (
+	ACTION_TRANSFER = "transfer"
+	ACTION_DELETE   = "delete"
+)
+
+type Entry struct {
+	Job    string `json:"job"`
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Source string `json:"source"`
+	Target string `json:"target,omitempty"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var enabled bool
+var as_json bool
+var output_path string
+
+var plan_lock sync.Mutex
+var plan []Entry
+
+// Enable switches every job into plan mode: scanners and decision logic
+// run as normal, but transfers and deletes are only recorded.
+func Enable(json_output bool, output string) {
+	enabled = true
+	as_json = json_output
+	output_path = output
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+func Record(entry Entry) {
+	plan_lock.Lock()
+	defer plan_lock.Unlock()
+	plan = append(plan, entry)
+}
+
+func writeText(w io.Writer, entries []Entry) {
+	fmt.Fprintf(w, "dry run plan: %d action(s)\n", len(entries))
+	for _, entry := range entries {
+		switch entry.Action {
+		case ACTION_TRANSFER:
+			fmt.Fprintf(w, "  [%s:%s] %s %s -> %s (%d bytes)", entry.Kind, entry.Job, entry.Action, entry.Source, entry.Target, entry.Size)
+		default:
+			fmt.Fprintf(w, "  [%s:%s] %s %s", entry.Kind, entry.Job, entry.Action, entry.Source)
+		}
+		if entry.Reason != "" {
+			fmt.Fprintf(w, " (%s)", entry.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Print writes the recorded plan to stdout, or to the output file if one
+// was given, as text or JSON.
+func Print() error {
+	if !enabled {
+		return nil
+	}
+
+	plan_lock.Lock()
+	entries := make([]Entry, len(plan))
+	copy(entries, plan)
+	plan_lock.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Job != entries[j].Job {
+			return entries[i].Job < entries[j].Job
+		}
+		return entries[i].Source < entries[j].Source
+	})
+
+	var w io.Writer = os.Stdout
+	if output_path != "" {
+		f, err := os.Create(output_path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if as_json {
+		if entries == nil {
+			entries = []Entry{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	writeText(w, entries)
+	return nil
+}
@@ -0,0 +1,286 @@
+package gate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/cron"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/sla"
+)
+
+// how often a closed gate is checked again
+const poll_interval = 10 * time.Second
+
+type window struct {
+	days  *cron.Schedule
+	from  int
+	to    int
+	start time.Time
+	end   time.Time
+}
+
+// Gate decides when a job in service mode may connect and scan: only inside
+// its active windows, outside its blackouts and, with a schedule, only for
+// one scan pass each time the schedule fires.
+type Gate struct {
+	job       string
+	schedules []*cron.Schedule
+	windows   []window
+	blackouts []window
+	location  *time.Location
+	logger    logger.Logger
+
+	lock    sync.Mutex
+	running int
+	stop    <-chan struct{}
+}
+
+func minutes(clock string) int {
+	t, _ := time.Parse("15:04", clock)
+	return t.Hour()*60 + t.Minute()
+}
+
+func parseWindow(cfg config.WindowConfig, location *time.Location) (window, error) {
+	var w window
+	var err error
+	if cfg.Start != "" || cfg.End != "" {
+		if w.start, err = time.ParseInLocation("2006-01-02 15:04", cfg.Start, location); err != nil {
+			return w, fmt.Errorf("invalid start %q, expecting 2006-01-02 15:04", cfg.Start)
+		}
+		if w.end, err = time.ParseInLocation("2006-01-02 15:04", cfg.End, location); err != nil {
+			return w, fmt.Errorf("invalid end %q, expecting 2006-01-02 15:04", cfg.End)
+		}
+		return w, nil
+	}
+	days := cfg.Days
+	if days == "" {
+		days = "*"
+	}
+	if w.days, err = cron.Parse("* * * * " + days); err != nil {
+		return w, fmt.Errorf("invalid days %q: %v", cfg.Days, err)
+	}
+	for _, clock := range []string{cfg.From, cfg.To} {
+		if _, err = time.Parse("15:04", clock); err != nil {
+			return w, fmt.Errorf("invalid time %q, expecting 24h time like 07:30", clock)
+		}
+	}
+	w.from = minutes(cfg.From)
+	w.to = minutes(cfg.To)
+	return w, nil
+}
+
+// New returns the gate of a job, or nil when it has no schedule, active
+// window or blackout. All methods are safe to call on nil, a nil gate is
+// always open.
+func New(cfg config.ScheduleConfig, job string) (*Gate, error) {
+	if len(cfg.Schedule) == 0 && len(cfg.ActiveWindows) == 0 && len(cfg.Blackouts) == 0 {
+		return nil, nil
+	}
+	g := &Gate{job: job, location: time.Local, logger: logger.NewJobLogger(fmt.Sprintf("gate[%s]", job), job, -1)}
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+		g.location = location
+	}
+	for _, expr := range cfg.Schedule {
+		schedule, err := cron.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %v", err)
+		}
+		g.schedules = append(g.schedules, schedule)
+	}
+	for _, window_cfg := range cfg.ActiveWindows {
+		w, err := parseWindow(window_cfg, g.location)
+		if err != nil {
+			return nil, fmt.Errorf("activewindows: %v", err)
+		}
+		g.windows = append(g.windows, w)
+	}
+	for _, window_cfg := range cfg.Blackouts {
+		w, err := parseWindow(window_cfg, g.location)
+		if err != nil {
+			return nil, fmt.Errorf("blackouts: %v", err)
+		}
+		g.blackouts = append(g.blackouts, w)
+	}
+	return g, nil
+}
+
+func (w window) contains(t time.Time) bool {
+	if w.days == nil {
+		return !t.Before(w.start) && t.Before(w.end)
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return w.days.Matches(t) && m >= w.from && m < w.to
+	}
+	// overnight, the window belongs to the day it starts
+	return (w.days.Matches(t) && m >= w.from) || (w.days.Matches(t.AddDate(0, 0, -1)) && m < w.to)
+}
+
+// StopOn makes the waits of the gate return once stop is closed, so a job
+// waiting for its window or schedule can be stopped
+func (g *Gate) StopOn(stop <-chan struct{}) {
+	if g == nil {
+		return
+	}
+	g.stop = stop
+}
+
+// sleep waits for d, false when the job is stopping meanwhile
+func (g *Gate) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-g.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Allowed tells if t is inside an active window, when any, and outside all
+// blackouts
+func (g *Gate) Allowed(t time.Time) bool {
+	if g == nil {
+		return true
+	}
+	t = t.In(g.location)
+	for _, w := range g.blackouts {
+		if w.contains(t) {
+			return false
+		}
+	}
+	if len(g.windows) == 0 {
+		return true
+	}
+	for _, w := range g.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scheduled tells if the job scans only when its schedule fires
+func (g *Gate) Scheduled() bool {
+	return g != nil && len(g.schedules) > 0
+}
+
+// Open tells if workers may hold a connection now
+func (g *Gate) Open() bool {
+	if g == nil {
+		return true
+	}
+	if !g.Allowed(time.Now()) {
+		return false
+	}
+	if !g.Scheduled() {
+		return true
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.running > 0
+}
+
+// WaitOpen blocks a worker until it may connect, false when the job is
+// stopping instead
+func (g *Gate) WaitOpen() bool {
+	for !g.Open() {
+		if !g.sleep(1 * time.Second) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Gate) next(now time.Time) time.Time {
+	var next time.Time
+	for _, schedule := range g.schedules {
+		fire := schedule.Next(now)
+		if !fire.IsZero() && (next.IsZero() || fire.Before(next)) {
+			next = fire
+		}
+	}
+	return next
+}
+
+// sleepUntil waits for t, checking the expectations of the job meanwhile as
+// its scanner is not running. False when the job is stopping.
+func (g *Gate) sleepUntil(t time.Time) bool {
+	for {
+		sla.Check(g.job)
+		wait := time.Until(t)
+		if wait <= 0 {
+			return true
+		}
+		if wait > poll_interval {
+			wait = poll_interval
+		}
+		if !g.sleep(wait) {
+			return false
+		}
+	}
+}
+
+// WaitTurn blocks a scanner until it may connect and scan: the next allowed
+// time the schedule fires, or else until inside an active window. False
+// when the job is stopping instead.
+func (g *Gate) WaitTurn() bool {
+	if g == nil {
+		return true
+	}
+	if g.Scheduled() {
+		for {
+			next := g.next(time.Now().In(g.location))
+			if next.IsZero() {
+				g.logger.Error("schedule never fires again")
+				<-g.stop
+				return false
+			}
+			g.logger.Info(fmt.Sprintf("next scheduled run at %s", next.Format("2006-01-02 15:04 MST")))
+			if !g.sleepUntil(next) {
+				return false
+			}
+			if g.Allowed(next) {
+				return true
+			}
+			g.logger.Info("scheduled run skipped, outside active windows or in a blackout")
+		}
+	}
+	if !g.Allowed(time.Now()) {
+		g.logger.Info("outside active windows or in a blackout, waiting")
+		for !g.Allowed(time.Now()) {
+			if !g.sleepUntil(time.Now().Add(poll_interval)) {
+				return false
+			}
+		}
+		g.logger.Info("inside active window, resuming")
+	}
+	return true
+}
+
+// Begin and End mark a scheduled scan pass, the workers may connect while
+// it runs
+func (g *Gate) Begin() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.running++
+}
+
+func (g *Gate) End() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.running--
+}
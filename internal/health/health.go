@@ -0,0 +1,122 @@
+package health
+
+import (
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/jobs"
+)
+
+// job health
+const (
+	CONNECTED    = "connected"
+	CONNECTING   = "connecting"
+	RECONNECTING = "reconnecting"
+	WAITING      = "waiting"
+	PAUSED       = "paused"
+	STOPPED      = "stopped"
+	SCANNER_DEAD = "scanner-dead"
+	MISSING      = "missing"
+)
+
+type JobHealth struct {
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind,omitempty"`
+	Health   string            `json:"health"`
+	Critical bool              `json:"critical,omitempty"`
+	Servers  map[string]string `json:"servers,omitempty"`
+}
+
+type Report struct {
+	Status string      `json:"status"`
+	Jobs   []JobHealth `json:"jobs"`
+}
+
+var critical = make(map[string]bool)
+var stall_timeout = time.Hour
+
+func Setup(cfg config.HealthConfig) {
+	critical = make(map[string]bool)
+	stall_timeout = time.Hour
+	for _, job := range cfg.CriticalJobs {
+		critical[job] = true
+	}
+	if cfg.StallTimeout > 0 {
+		stall_timeout = time.Duration(cfg.StallTimeout) * time.Second
+	}
+}
+
+func jobHealth(status jobs.Status) JobHealth {
+	h := JobHealth{Name: status.Name, Kind: status.Kind, Critical: critical[status.Name], Servers: status.Servers}
+	unreachable := false
+	for _, state := range status.Servers {
+		if state != jobs.CONNECTED {
+			unreachable = true
+		}
+	}
+	busy := status.Scanner == jobs.SCANNING || status.Scanner == jobs.CONNECTING
+	switch {
+	case status.State != jobs.RUNNING:
+		h.Health = STOPPED
+	case busy && time.Since(status.ScannerSeen) > stall_timeout:
+		h.Health = SCANNER_DEAD
+	case unreachable:
+		h.Health = RECONNECTING
+	case status.Scanner == jobs.WAITING:
+		h.Health = WAITING
+	case len(status.Servers) == 0:
+		h.Health = CONNECTING
+	case status.Paused:
+		h.Health = PAUSED
+	default:
+		h.Health = CONNECTED
+	}
+	return h
+}
+
+func report() Report {
+	r := Report{Status: "ok", Jobs: []JobHealth{}}
+	registered := make(map[string]bool)
+	for _, job := range jobs.List() {
+		r.Jobs = append(r.Jobs, jobHealth(job.Status()))
+		registered[job.Name] = true
+	}
+	// a critical job not started yet, or not started at all
+	for job := range critical {
+		if !registered[job] {
+			r.Jobs = append(r.Jobs, JobHealth{Name: job, Health: MISSING, Critical: true})
+		}
+	}
+	return r
+}
+
+// Live reports the health of all jobs, failing when a scanner made no
+// progress for the stall timeout
+func Live() (Report, bool) {
+	r := report()
+	for _, job := range r.Jobs {
+		if job.Health == SCANNER_DEAD {
+			r.Status = "fail"
+		}
+	}
+	return r, r.Status == "ok"
+}
+
+// Ready fails besides while a critical job cannot reach its servers
+func Ready() (Report, bool) {
+	r, live := Live()
+	if !live {
+		return r, false
+	}
+	for _, job := range r.Jobs {
+		if !job.Critical {
+			continue
+		}
+		switch job.Health {
+		case CONNECTED, WAITING, PAUSED:
+		default:
+			r.Status = "fail"
+		}
+	}
+	return r, r.Status == "ok"
+}
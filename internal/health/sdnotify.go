@@ -0,0 +1,70 @@
+package health
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/logger"
+)
+
+var health_logger logger.Logger
+
+func init() {
+	health_logger = logger.NewLogger("health")
+}
+
+// sdNotify sends a state to systemd, when started by systemd as a notify
+// service
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Notify tells systemd the service is ready and, with WatchdogSec set in the
+// unit, pings the watchdog for as long as the service is healthy
+func Notify() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		health_logger.Error(fmt.Sprintf("failed to notify systemd: %v", err))
+		return
+	}
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	health_logger.Info(fmt.Sprintf("pinging systemd watchdog every %s", interval))
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, live := Live(); !live {
+				health_logger.Error("unhealthy, not pinging systemd watchdog")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				health_logger.Error(fmt.Sprintf("failed to ping systemd watchdog: %v", err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,245 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"github.com/iambighead/ugoku/internal/config"
+)
+
+// audit modes
+const (
+	AUDIT_CHAIN   = "chain"
+	AUDIT_HMAC    = "hmac"
+	AUDIT_ED25519 = "ed25519"
+)
+
+// auditor chains each record to the previous one. A record is written as
+// its JSON with the chain, and signature if any, appended as last fields, so
+// the chain is checked against the exact bytes written:
+//
+//	chain = sha256 or hmac-sha256 of (previous chain + "\n" + record)
+//	sig   = ed25519 signature of chain
+//
+// Records removed from the end of the file leave a valid chain, truncation
+// is only detected against the last chain value kept outside the file.
+type auditor struct {
+	mode    string
+	key     []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	last    string
+}
+
+type sealed struct {
+	Chain string `json:"chain"`
+	Sig   string `json:"sig"`
+}
+
+// loadKey reads an ed25519 key from a PEM file, a private key can both sign
+// and verify, a public key only verify
+func loadKey(path string, a *auditor) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM data", path)
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("%s: not an ed25519 key", path)
+		}
+		a.private = private
+		a.public = private.Public().(ed25519.PublicKey)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s: not an ed25519 key", path)
+		}
+		a.public = public
+	default:
+		return fmt.Errorf("%s: unexpected %s, expecting an ed25519 PRIVATE KEY or PUBLIC KEY", path, block.Type)
+	}
+	return nil
+}
+
+func newAuditor(cfg config.HistoryConfig) (*auditor, error) {
+	a := &auditor{mode: cfg.Audit}
+	switch cfg.Audit {
+	case AUDIT_CHAIN:
+	case AUDIT_HMAC:
+		if cfg.AuditKey == "" {
+			return nil, errors.New("auditkey is required with hmac audit")
+		}
+		a.key = []byte(cfg.AuditKey)
+	case AUDIT_ED25519:
+		if err := loadKey(cfg.AuditKeyFile, a); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown audit %q", cfg.Audit)
+	}
+	return a, nil
+}
+
+func (a *auditor) chain(prev string, record []byte) string {
+	var h hash.Hash
+	if a.mode == AUDIT_HMAC {
+		h = hmac.New(sha256.New, a.key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(prev + "\n"))
+	h.Write(record)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func suffix(chain string, sig string) string {
+	if sig == "" {
+		return fmt.Sprintf(`,"chain":"%s"}`, chain)
+	}
+	return fmt.Sprintf(`,"chain":"%s","sig":"%s"}`, chain, sig)
+}
+
+// seal returns the line of a record chained to the last one, and its chain
+// to continue with once written
+func (a *auditor) seal(record []byte) ([]byte, string) {
+	chain := a.chain(a.last, record)
+	sig := ""
+	if a.mode == AUDIT_ED25519 {
+		sig = base64.StdEncoding.EncodeToString(ed25519.Sign(a.private, []byte(chain)))
+	}
+	return append(record[:len(record)-1], suffix(chain, sig)...), chain
+}
+
+// check verifies a line chained to prev and returns its chain
+func (a *auditor) check(prev string, line []byte) (string, error) {
+	var s sealed
+	if err := json.Unmarshal(line, &s); err != nil {
+		return "", err
+	}
+	if s.Chain == "" {
+		return "", errors.New("record is not chained")
+	}
+	end := suffix(s.Chain, s.Sig)
+	if !bytes.HasSuffix(line, []byte(end)) {
+		return "", errors.New("chain is not the last field of the record")
+	}
+	record := append(append([]byte{}, line[:len(line)-len(end)]...), '}')
+	if a.chain(prev, record) != s.Chain {
+		return "", errors.New("chain does not match, the record or one before it was modified, removed or inserted")
+	}
+	if a.mode == AUDIT_ED25519 {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil || !ed25519.Verify(a.public, []byte(s.Chain), sig) {
+			return "", errors.New("invalid signature")
+		}
+	}
+	return s.Chain, nil
+}
+
+// resume continues the chain of an existing history file
+func (a *auditor) resume(history_path string) error {
+	f, err := os.Open(history_path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if last == nil {
+		return nil
+	}
+	var s sealed
+	if err := json.Unmarshal(last, &s); err != nil {
+		return fmt.Errorf("last record: %v", err)
+	}
+	if s.Chain == "" {
+		return errors.New("the history has records without audit chain, use a new file for the audit log")
+	}
+	a.last = s.Chain
+	return nil
+}
+
+// BrokenError tells the first record of the history failing verification
+type BrokenError struct {
+	Line   int
+	Record string
+	Err    error
+}
+
+func (e *BrokenError) Error() string {
+	return fmt.Sprintf("line %d: %v: %s", e.Line, e.Err, e.Record)
+}
+
+// Verify checks the chain of all records of the history file and returns
+// the number of records verified. A history cut short verifies, compare the
+// chain of its last record with one kept elsewhere to detect that.
+func Verify(history_path string, cfg config.HistoryConfig) (int, error) {
+	if cfg.Audit == "" {
+		return 0, errors.New("audit is not configured")
+	}
+	a, err := newAuditor(cfg)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(history_path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	prev := ""
+	verified := 0
+	line_number := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line_number++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		prev, err = a.check(prev, scanner.Bytes())
+		if err != nil {
+			return verified, &BrokenError{Line: line_number, Record: scanner.Text(), Err: err}
+		}
+		verified++
+	}
+	return verified, scanner.Err()
+}
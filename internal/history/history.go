@@ -0,0 +1,165 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/logger"
+)
+
+// directions
+const (
+	DOWNLOAD = "download"
+	UPLOAD   = "upload"
+	STREAM   = "stream"
+)
+
+// results
+const (
+	SUCCESS = "success"
+	FAILED  = "failed"
+)
+
+// Entry is one transfer in the history file, one JSON object per line
+type Entry struct {
+	Job          string    `json:"job"`
+	Kind         string    `json:"kind"`
+	Direction    string    `json:"direction"`
+	SourceServer string    `json:"source_server,omitempty"`
+	SourcePath   string    `json:"source_path"`
+	TargetServer string    `json:"target_server,omitempty"`
+	TargetPath   string    `json:"target_path"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"sha256,omitempty"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Result       string    `json:"result"`
+	Error        string    `json:"error,omitempty"`
+}
+
+var history_lock sync.Mutex
+var history_file *os.File
+var history_path string
+var history_audit *auditor
+var history_logger logger.Logger
+
+func init() {
+	history_logger = logger.NewLogger("history")
+}
+
+// Open opens the history file for appending, transfers are not recorded
+// until it is opened. In audit mode the chain continues from the last
+// record, only one process may write to the file.
+func Open(cfg config.HistoryConfig) error {
+	var audit *auditor
+	if cfg.Audit != "" {
+		var err error
+		if audit, err = newAuditor(cfg); err != nil {
+			return err
+		}
+		if cfg.Audit == AUDIT_ED25519 && audit.private == nil {
+			return fmt.Errorf("%s: a private key is needed to sign", cfg.AuditKeyFile)
+		}
+		if err = audit.resume(cfg.Path); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	history_lock.Lock()
+	defer history_lock.Unlock()
+	history_file = f
+	history_path = cfg.Path
+	history_audit = audit
+	return nil
+}
+
+// Path returns the path of the opened history file, empty when transfers
+// are not recorded
+func Path() string {
+	history_lock.Lock()
+	defer history_lock.Unlock()
+	return history_path
+}
+
+// Recorded returns the entries of the opened history file matching the
+// filter, reading it while no transfer is being recorded
+func Recorded(filter Filter) ([]Entry, error) {
+	history_lock.Lock()
+	defer history_lock.Unlock()
+	if history_file == nil {
+		return nil, fmt.Errorf("history is not recorded")
+	}
+	return Query(history_path, filter)
+}
+
+// Record appends a transfer to the history file, the result and end time
+// are set from err
+func Record(entry Entry, err error) {
+	entry.End = time.Now()
+	entry.Result = SUCCESS
+	if err != nil {
+		entry.Result = FAILED
+		entry.Error = err.Error()
+	}
+	line, marshal_err := json.Marshal(entry)
+	if marshal_err != nil {
+		return
+	}
+
+	history_lock.Lock()
+	defer history_lock.Unlock()
+	if history_file == nil {
+		return
+	}
+	chain := ""
+	if history_audit != nil {
+		line, chain = history_audit.seal(line)
+	}
+	_, write_err := history_file.Write(append(line, '\n'))
+	if write_err == nil {
+		write_err = history_file.Sync()
+	}
+	if write_err != nil {
+		history_logger.Error(fmt.Sprintf("failed to record %s: %v", entry.SourcePath, write_err))
+		return
+	}
+	if history_audit != nil {
+		history_audit.last = chain
+	}
+}
+
+// Hasher computes the sha256 of a file while it is transferred. All methods
+// are safe to call on nil.
+type Hasher struct {
+	hash hash.Hash
+}
+
+func NewHasher() *Hasher {
+	return &Hasher{hash: sha256.New()}
+}
+
+// Wrap returns a reader hashing what is read from r
+func (h *Hasher) Wrap(r io.Reader) io.Reader {
+	if h == nil {
+		return r
+	}
+	return io.TeeReader(r, h.hash)
+}
+
+func (h *Hasher) Sum() string {
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
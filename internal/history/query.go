@@ -0,0 +1,132 @@
+package history
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Filter selects entries of the history, empty fields match everything
+type Filter struct {
+	Job     string
+	Pattern string
+	From    time.Time
+	To      time.Time
+	Result  string
+}
+
+func (f Filter) matches(entry Entry) bool {
+	if f.Job != "" && entry.Job != f.Job {
+		return false
+	}
+	if f.Result != "" && entry.Result != f.Result {
+		return false
+	}
+	if !f.From.IsZero() && entry.Start.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !entry.Start.Before(f.To) {
+		return false
+	}
+	if f.Pattern != "" {
+		source_match, _ := path.Match(f.Pattern, path.Base(entry.SourcePath))
+		target_match, _ := path.Match(f.Pattern, path.Base(entry.TargetPath))
+		if !source_match && !target_match {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTime parses a date or a date and time in local time, with to the
+// date is taken as the end of the day
+func ParseTime(value string, to bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if to {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expecting 2006-01-02, 2006-01-02 15:04 or RFC3339", value)
+}
+
+// Query reads the entries of the history file matching the filter
+func Query(history_path string, filter Filter) ([]Entry, error) {
+	f, err := os.Open(history_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", history_path, line_number, err)
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+var csv_header = []string{"job", "kind", "direction", "source_server", "source_path", "target_server", "target_path", "size", "sha256", "start", "end", "result", "error"}
+
+func WriteCsv(w io.Writer, entries []Entry) error {
+	writer := csv.NewWriter(w)
+	writer.Write(csv_header)
+	for _, e := range entries {
+		writer.Write([]string{e.Job, e.Kind, e.Direction, e.SourceServer, e.SourcePath, e.TargetServer, e.TargetPath,
+			strconv.FormatInt(e.Size, 10), e.Hash, e.Start.Format(time.RFC3339), e.End.Format(time.RFC3339), e.Result, e.Error})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func WriteJson(w io.Writer, entries []Entry) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+func WriteText(w io.Writer, entries []Entry) {
+	for _, e := range entries {
+		source := e.SourcePath
+		if e.SourceServer != "" {
+			source = e.SourceServer + ":" + source
+		}
+		target := e.TargetPath
+		if e.TargetServer != "" {
+			target = e.TargetServer + ":" + target
+		}
+		fmt.Fprintf(w, "%s [%s:%s] %s %s -> %s (%d bytes, %s)", e.Start.Format("2006-01-02 15:04:05"), e.Kind, e.Job, e.Result, source, target, e.Size,
+			e.End.Sub(e.Start).Round(time.Millisecond))
+		if e.Error != "" {
+			fmt.Fprintf(w, ": %s", e.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d transfer(s)\n", len(entries))
+}
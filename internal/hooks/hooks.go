@@ -0,0 +1,235 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/notify"
+	"github.com/iambighead/ugoku/internal/sla"
+)
+
+// hook points
+const (
+	PRE_SCAN     = "pre-scan"
+	PRE_TRANSFER = "pre-transfer"
+	POST_SUCCESS = "post-transfer-success"
+	POST_FAILURE = "post-transfer-failure"
+	POST_BATCH   = "post-batch"
+)
+
+// Event describes what a hook is called for. It is written as JSON to the
+// stdin of the command and also passed in UGOKU_* environment variables.
+type Event struct {
+	Hook    string `json:"hook"`
+	Job     string `json:"job"`
+	Kind    string `json:"kind"`
+	Source  string `json:"source,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	ModTime string `json:"modtime,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Files   int    `json:"files,omitempty"`
+	Failed  int    `json:"failed,omitempty"`
+	Elapsed int64  `json:"elapsed_ms,omitempty"`
+}
+
+type Hooks struct {
+	config.HooksConfig
+	job    string
+	kind   string
+	logger logger.Logger
+}
+
+// New returns the hooks of a job. Besides running the configured commands,
+// the transfer and batch results are sent to the notifiers. All methods are
+// safe to call on nil.
+func New(cfg config.HooksConfig, job string, kind string) *Hooks {
+	return &Hooks{
+		HooksConfig: cfg,
+		job:         job,
+		kind:        kind,
+		logger:      logger.NewJobLogger(fmt.Sprintf("hooks[%s]", job), job, -1),
+	}
+}
+
+func (h *Hooks) command(hook string) []string {
+	switch hook {
+	case PRE_SCAN:
+		return h.PreScan
+	case PRE_TRANSFER:
+		return h.PreTransfer
+	case POST_SUCCESS:
+		return h.PostSuccess
+	case POST_FAILURE:
+		return h.PostFailure
+	case POST_BATCH:
+		return h.PostBatch
+	}
+	return nil
+}
+
+func environment(event Event) []string {
+	env := os.Environ()
+	env = append(env,
+		"UGOKU_HOOK="+event.Hook,
+		"UGOKU_JOB="+event.Job,
+		"UGOKU_KIND="+event.Kind,
+		"UGOKU_SOURCE="+event.Source,
+		"UGOKU_TARGET="+event.Target,
+		"UGOKU_SIZE="+strconv.FormatInt(event.Size, 10),
+		"UGOKU_MODTIME="+event.ModTime,
+		"UGOKU_ERROR="+event.Error,
+		"UGOKU_FILES="+strconv.Itoa(event.Files),
+		"UGOKU_FAILED="+strconv.Itoa(event.Failed),
+	)
+	return env
+}
+
+// Run executes the command configured for the hook point of the event, if
+// any. A non-zero exit status or a timeout is returned as error. Hooks are
+// not run in dry run mode.
+func (h *Hooks) Run(event Event) error {
+	if h == nil || dryrun.Enabled() {
+		return nil
+	}
+	command := h.command(event.Hook)
+	if len(command) == 0 {
+		return nil
+	}
+	event.Job = h.job
+	event.Kind = h.kind
+
+	input, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.Timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = environment(event)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// do not wait forever for children still holding the output open
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if out := strings.TrimSpace(output.String()); out != "" {
+		h.logger.Info(fmt.Sprintf("%s hook output: %s", event.Hook, out))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s hook timed out after %d seconds", event.Hook, h.Timeout)
+	} else if err != nil {
+		err = fmt.Errorf("%s hook %s: %v", event.Hook, command[0], err)
+	}
+	if err != nil {
+		h.logger.Error(err.Error())
+	}
+	return err
+}
+
+// BeforeScan returns false if the scan pass should be skipped
+func (h *Hooks) BeforeScan() bool {
+	return h.Run(Event{Hook: PRE_SCAN}) == nil
+}
+
+// BeforeTransfer returns false if the file should be skipped
+func (h *Hooks) BeforeTransfer(source string, target string, stat os.FileInfo) bool {
+	return h.Run(fileEvent(PRE_TRANSFER, source, target, stat, nil)) == nil
+}
+
+// AfterTransfer runs the success or failure hook depending on err
+func (h *Hooks) AfterTransfer(source string, target string, stat os.FileInfo, err error) {
+	if h == nil {
+		return
+	}
+	hook := POST_SUCCESS
+	notification := notify.Event{Event: notify.FILE_TRANSFERRED, Job: h.job, Kind: h.kind, Source: source, Target: target}
+	if err != nil {
+		hook = POST_FAILURE
+		notification.Event = notify.FILE_FAILED
+		notification.Error = err.Error()
+	}
+	if stat != nil {
+		notification.Size = stat.Size()
+	}
+	if err == nil {
+		sla.Transferred(h.job, source, notification.Size)
+	}
+	notify.Send(notification)
+	h.Run(fileEvent(hook, source, target, stat, err))
+}
+
+// Quarantined runs the post-failure hook for a file moved to quarantine. The
+// quarantine is notified by the job, the file does not count as transferred.
+func (h *Hooks) Quarantined(source string, target string, stat os.FileInfo, err error) {
+	if h == nil {
+		return
+	}
+	h.Run(fileEvent(POST_FAILURE, source, target, stat, err))
+}
+
+func fileEvent(hook string, source string, target string, stat os.FileInfo, err error) Event {
+	event := Event{Hook: hook, Source: source, Target: target}
+	if stat != nil {
+		event.Size = stat.Size()
+		event.ModTime = stat.ModTime().UTC().Format(time.RFC3339)
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// results reported by workers on the done channel
+const (
+	RESULT_FAILED      = 0
+	RESULT_TRANSFERRED = 1
+	// not transferred on purpose, e.g. unchanged or skipped by a hook
+	RESULT_SKIPPED = 2
+)
+
+// Batch counts the results of one scan pass for the post-batch hook
+type Batch struct {
+	started time.Time
+	files   int
+	failed  int
+}
+
+func (b *Batch) Reset() {
+	*b = Batch{started: time.Now()}
+}
+
+func (b *Batch) Done(result int) {
+	switch result {
+	case RESULT_SKIPPED:
+	case RESULT_FAILED:
+		b.files++
+		b.failed++
+	default:
+		b.files++
+	}
+}
+
+// AfterBatch runs the post-batch hook, only when the pass handled any file
+func (h *Hooks) AfterBatch(b *Batch) {
+	if h == nil || b.files == 0 {
+		return
+	}
+	elapsed := time.Since(b.started).Milliseconds()
+	notify.Send(notify.Event{Event: notify.BATCH_SUMMARY, Job: h.job, Kind: h.kind, Files: b.files, Failed: b.failed, Elapsed: elapsed})
+	h.Run(Event{Hook: POST_BATCH, Files: b.files, Failed: b.failed, Elapsed: elapsed})
+}
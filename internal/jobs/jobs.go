@@ -0,0 +1,424 @@
+package jobs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/logger"
+)
+
+// job states
+const (
+	RUNNING  = "running"
+	STOPPING = "stopping"
+	STOPPED  = "stopped"
+)
+
+// STOP_MARGIN is how long a drained job may take to stop once its in-flight
+// transfers are cut
+const STOP_MARGIN = 30 * time.Second
+
+// worker and scanner states
+const (
+	CONNECTING = "connecting"
+	IDLE       = "idle"
+	BUSY       = "busy"
+	WAITING    = "waiting"
+	SCANNING   = "scanning"
+	SLEEPING   = "sleeping"
+	PAUSED     = "paused"
+	CONNECTED  = "connected"
+)
+
+// Transfer is a file being transferred by a worker, Done counts the bytes
+// read from the source so far
+type Transfer struct {
+	Job     string    `json:"job"`
+	Worker  int       `json:"worker"`
+	Source  string    `json:"source"`
+	Target  string    `json:"target"`
+	Size    int64     `json:"size"`
+	Done    int64     `json:"done"`
+	Started time.Time `json:"started"`
+	done    atomic.Int64
+}
+
+type progressReader struct {
+	reader   io.Reader
+	transfer *Transfer
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.transfer.done.Add(int64(n))
+	return n, err
+}
+
+type worker struct {
+	state    string
+	transfer *Transfer
+}
+
+// Job is a job running in service mode, controlled through the admin api.
+// All methods are safe to call on nil, as one time runs register no job.
+type Job struct {
+	Name string
+	Kind string
+
+	start    func()
+	on_stop  func()
+	lock     sync.Mutex
+	state    string
+	paused   bool
+	scanner  string
+	seen     time.Time
+	servers  map[string]string
+	workers  map[int]*worker
+	stopping chan struct{}
+	stopped  chan struct{}
+	trigger  chan struct{}
+	running  sync.WaitGroup
+}
+
+var registry_lock sync.Mutex
+var registry = make(map[string]*Job)
+var jobs_logger logger.Logger
+
+func init() {
+	jobs_logger = logger.NewLogger("jobs")
+}
+
+// Register adds a job, replacing a stopped one of the same name. start
+// starts the job again after it is stopped.
+func Register(name string, kind string, start func()) *Job {
+	j := &Job{
+		Name:     name,
+		Kind:     kind,
+		start:    start,
+		state:    RUNNING,
+		servers:  make(map[string]string),
+		workers:  make(map[int]*worker),
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		trigger:  make(chan struct{}, 1),
+	}
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	registry[name] = j
+	return j
+}
+
+// Remove removes a job no longer configured, unless it was registered again
+func Remove(j *Job) {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	if registry[j.Name] == j {
+		delete(registry, j.Name)
+	}
+}
+
+// Get returns the job of the given name, or nil
+func Get(name string) *Job {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	return registry[name]
+}
+
+// List returns all jobs sorted by name
+func List() []*Job {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	var list []*Job
+	for _, j := range registry {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list
+}
+
+// OnStop sets how the running workers and scanner of the job are stopped
+func (j *Job) OnStop(f func()) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.on_stop = f
+}
+
+// Add and Done track the goroutines of the job, it is stopped once all of
+// them returned
+func (j *Job) Add() {
+	if j == nil {
+		return
+	}
+	j.running.Add(1)
+}
+
+func (j *Job) Done() {
+	if j == nil {
+		return
+	}
+	j.running.Done()
+}
+
+// Stopping tells the goroutines of the job to return instead of starting
+// their worker or scanner again
+func (j *Job) Stopping() bool {
+	if j == nil {
+		return false
+	}
+	select {
+	case <-j.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *Job) State() string {
+	if j == nil {
+		return RUNNING
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.state
+}
+
+// Stop stops the job in the background, in-flight transfers are cut. With
+// restart it is started again once stopped.
+func (j *Job) Stop(restart bool) {
+	j.lock.Lock()
+	if j.state != RUNNING {
+		j.lock.Unlock()
+		return
+	}
+	j.state = STOPPING
+	close(j.stopping)
+	on_stop := j.on_stop
+	j.lock.Unlock()
+
+	jobs_logger.Info(j.Name + ": stopping")
+	if on_stop != nil {
+		on_stop()
+	}
+	go func() {
+		j.running.Wait()
+		j.lock.Lock()
+		if j.state == STOPPED {
+			// killed meanwhile, it may already run again
+			j.lock.Unlock()
+			jobs_logger.Info(j.Name + ": goroutines of the killed job returned")
+			return
+		}
+		j.state = STOPPED
+		j.workers = make(map[int]*worker)
+		j.servers = make(map[string]string)
+		j.scanner = ""
+		close(j.stopped)
+		j.lock.Unlock()
+		jobs_logger.Info(j.Name + ": stopped")
+		if restart {
+			j.Start()
+		}
+	}()
+}
+
+// Kill marks a job stuck stopping as stopped, so it can be started again.
+// Its goroutines still blocked return once they are unblocked, they are no
+// longer waited for.
+func (j *Job) Kill() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.state != STOPPING {
+		return false
+	}
+	j.state = STOPPED
+	j.workers = make(map[int]*worker)
+	j.servers = make(map[string]string)
+	j.scanner = ""
+	close(j.stopped)
+	jobs_logger.Warn(j.Name + ": killed while stopping")
+	return true
+}
+
+// StopChan is closed once the job is asked to stop, for the goroutines
+// of the job blocked waiting on something else
+func (j *Job) StopChan() <-chan struct{} {
+	if j == nil {
+		return nil
+	}
+	return j.stopping
+}
+
+// WaitStopped waits until the job is stopped, at most for timeout, and
+// tells if it stopped
+func (j *Job) WaitStopped(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-j.stopped:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (j *Job) busy() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, w := range j.workers {
+		if w.state == BUSY {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain pauses the job and lets its workers finish the files already
+// queued, for at most timeout, then stops it. It tells if the job stopped
+// within timeout plus STOP_MARGIN.
+func (j *Job) Drain(timeout time.Duration) bool {
+	if j.State() == RUNNING {
+		jobs_logger.Info(fmt.Sprintf("%s: draining, at most %s", j.Name, timeout))
+		j.Pause()
+		deadline := time.Now().Add(timeout)
+		// idle twice in a row, a worker may be between two queued files
+		idle := 0
+		for idle < 2 && time.Now().Before(deadline) {
+			if j.busy() {
+				idle = 0
+			} else {
+				idle++
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	j.Stop(false)
+	return j.WaitStopped(timeout + STOP_MARGIN)
+}
+
+// Start starts a stopped job again
+func (j *Job) Start() bool {
+	j.lock.Lock()
+	stopped := j.state == STOPPED
+	j.lock.Unlock()
+	if !stopped {
+		return false
+	}
+	jobs_logger.Info(j.Name + ": starting")
+	j.start()
+	return true
+}
+
+func (j *Job) Pause() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.paused = true
+}
+
+func (j *Job) Resume() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.paused = false
+}
+
+func (j *Job) Paused() bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.paused
+}
+
+// Trigger wakes up the scanner of the job for an immediate scan
+func (j *Job) Trigger() {
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Sleep waits for d, or until the job is stopped
+func (j *Job) Sleep(d time.Duration) {
+	if j == nil {
+		time.Sleep(d)
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-j.stopping:
+	}
+}
+
+// ScanSleep waits for d between two scans, or until a scan is triggered or
+// the job is stopped
+func (j *Job) ScanSleep(d time.Duration) {
+	if j == nil {
+		time.Sleep(d)
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-j.trigger:
+	case <-j.stopping:
+	}
+}
+
+// ScannerState sets the state of the scanner, it is also called while
+// scanning to report progress
+func (j *Job) ScannerState(state string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.scanner = state
+	j.seen = time.Now()
+}
+
+// Connection records the last connection attempt to a server
+func (j *Job) Connection(server string, err error) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err != nil {
+		j.servers[server] = err.Error()
+	} else {
+		j.servers[server] = CONNECTED
+	}
+}
+
+// WorkerState sets the state of a worker, ending its transfer if any
+func (j *Job) WorkerState(id int, state string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.workers[id] = &worker{state: state}
+}
+
+// Transfer marks a worker busy with a transfer, the returned reader counts
+// the progress while reading the source
+func (j *Job) Transfer(id int, source string, target string, size int64, r io.Reader) io.Reader {
+	if j == nil {
+		return r
+	}
+	transfer := &Transfer{Job: j.Name, Worker: id, Source: source, Target: target, Size: size, Started: time.Now()}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.workers[id] = &worker{state: BUSY, transfer: transfer}
+	return &progressReader{reader: r, transfer: transfer}
+}
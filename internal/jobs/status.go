@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"sort"
+	"time"
+)
+
+type WorkerStatus struct {
+	Id       int       `json:"id"`
+	State    string    `json:"state"`
+	Transfer *Transfer `json:"transfer,omitempty"`
+}
+
+type Status struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	State   string `json:"state"`
+	Paused  bool   `json:"paused"`
+	Scanner string `json:"scanner,omitempty"`
+	// when the scanner last reported its state
+	ScannerSeen time.Time `json:"scanner_seen"`
+	// the last connection attempt to each server, connected or the error
+	Servers map[string]string `json:"servers,omitempty"`
+	Workers []WorkerStatus    `json:"workers"`
+}
+
+func (t *Transfer) snapshot() *Transfer {
+	if t == nil {
+		return nil
+	}
+	copied := &Transfer{Job: t.Job, Worker: t.Worker, Source: t.Source, Target: t.Target, Size: t.Size, Started: t.Started}
+	copied.Done = t.done.Load()
+	return copied
+}
+
+// Status returns a snapshot of the job and its workers
+func (j *Job) Status() Status {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	status := Status{Name: j.Name, Kind: j.Kind, State: j.state, Paused: j.paused, Scanner: j.scanner, ScannerSeen: j.seen,
+		Servers: make(map[string]string), Workers: []WorkerStatus{}}
+	for server, state := range j.servers {
+		status.Servers[server] = state
+	}
+	for id, w := range j.workers {
+		status.Workers = append(status.Workers, WorkerStatus{Id: id, State: w.state, Transfer: w.transfer.snapshot()})
+	}
+	sort.Slice(status.Workers, func(a, b int) bool { return status.Workers[a].Id < status.Workers[b].Id })
+	return status
+}
+
+// Transfers returns the in-flight transfers of all jobs
+func Transfers() []*Transfer {
+	transfers := []*Transfer{}
+	for _, j := range List() {
+		for _, w := range j.Status().Workers {
+			if w.Transfer != nil {
+				transfers = append(transfers, w.Transfer)
+			}
+		}
+	}
+	return transfers
+}
@@ -0,0 +1,249 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Fields are structured fields added to log entries, like server, path,
+// bytes, duration_ms or error
+type Fields map[string]interface{}
+
+// Logger logs as name, for a job and one of its workers when created with
+// NewJobLogger
+type Logger struct {
+	name   string
+	job    string
+	worker int
+	fields Fields
+}
+
+type sink struct {
+	logger zerolog.Logger
+	// console output keeps the name in front of the message
+	console bool
+	file    *lumberjack.Logger
+}
+
+var lock sync.RWMutex
+var level zerolog.Level
+var sinks []sink
+var job_levels = make(map[string]zerolog.Level)
+var job_files = make(map[string]sink)
+
+// the console log goes to stdout, unless stdout is the output of a command
+var console_out io.Writer = os.Stdout
+var console_json bool
+
+func parseLevel(value string) (zerolog.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "", "info":
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
+	case "error":
+		return zerolog.ErrorLevel, nil
+	}
+	return zerolog.InfoLevel, fmt.Errorf("invalid level %q, expecting debug, info, warn or error", value)
+}
+
+func fileSink(cfg config.LoggingConfig, path string) sink {
+	writer := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+	}
+	return sink{logger: zerolog.New(writer).With().Timestamp().Logger(), file: writer}
+}
+
+func closeFiles(old []sink) {
+	for _, s := range old {
+		if s.file != nil {
+			s.file.Close()
+		}
+	}
+}
+
+func consoleSink(json bool) sink {
+	if json {
+		return sink{logger: zerolog.New(console_out).With().Timestamp().Logger()}
+	}
+	return sink{logger: zerolog.New(zerolog.ConsoleWriter{Out: console_out}).With().Timestamp().Logger(), console: true}
+}
+
+// ConsoleToStderr writes the console log to stderr, for commands printing
+// their data to stdout
+func ConsoleToStderr() {
+	lock.Lock()
+	defer lock.Unlock()
+	console_out = os.Stderr
+	// the console sink comes first
+	if len(sinks) > 0 {
+		sinks[0] = consoleSink(console_json)
+	}
+}
+
+// Init starts logging to the console and to log_filename, at the level of
+// the environment variable, until Setup applies the config
+func Init(log_filename string, log_level_env_name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	level, _ = parseLevel(os.Getenv(log_level_env_name))
+	sinks = []sink{consoleSink(false)}
+	if log_filename != "" {
+		sinks = append(sinks, fileSink(config.LoggingConfig{MaxSize: 10, MaxBackups: 10, MaxAge: 7}, log_filename))
+	}
+}
+
+// Setup applies the logging config. The level of the environment variable,
+// when set, overrides the configured one.
+func Setup(cfg config.LoggingConfig, jobs map[string]config.JobLogConfig, log_level_env_name string) error {
+	new_level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	if env_level := os.Getenv(log_level_env_name); env_level != "" {
+		if new_level, err = parseLevel(env_level); err != nil {
+			return fmt.Errorf("%s: %v", log_level_env_name, err)
+		}
+	}
+	json_console := strings.ToLower(cfg.Format) == "json"
+	new_sinks := []sink{consoleSink(json_console)}
+	if cfg.File != "" {
+		new_sinks = append(new_sinks, fileSink(cfg, cfg.File))
+	}
+	if cfg.Syslog != "" {
+		writer, err := syslogWriter(cfg.Syslog)
+		if err != nil {
+			return fmt.Errorf("syslog: %v", err)
+		}
+		new_sinks = append(new_sinks, sink{logger: zerolog.New(writer)})
+	}
+	if cfg.Journald {
+		writer, err := journaldWriter()
+		if err != nil {
+			return fmt.Errorf("journald: %v", err)
+		}
+		new_sinks = append(new_sinks, sink{logger: zerolog.New(writer)})
+	}
+
+	new_job_levels := make(map[string]zerolog.Level)
+	new_job_files := make(map[string]sink)
+	for job, job_cfg := range jobs {
+		if job_cfg.Level != "" {
+			if new_job_levels[job], err = parseLevel(job_cfg.Level); err != nil {
+				return fmt.Errorf("%s: log: %v", job, err)
+			}
+		}
+		if job_cfg.File != "" {
+			new_job_files[job] = fileSink(cfg, job_cfg.File)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	closeFiles(sinks)
+	for _, s := range job_files {
+		closeFiles([]sink{s})
+	}
+	level = new_level
+	console_json = json_console
+	sinks = new_sinks
+	job_levels = new_job_levels
+	job_files = new_job_files
+	return nil
+}
+
+func NewLogger(name string) Logger {
+	return Logger{name: name, worker: -1}
+}
+
+// NewJobLogger returns a logger of a job, logging at the level of the job
+// and to its log file if any. worker is -1 for the scanner and others.
+func NewJobLogger(name string, job string, worker int) Logger {
+	return Logger{name: name, job: job, worker: worker}
+}
+
+// With returns a copy of the logger adding fields to every entry
+func (mylogger Logger) With(fields Fields) Logger {
+	merged := make(Fields, len(mylogger.fields)+len(fields))
+	for key, value := range mylogger.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	mylogger.fields = merged
+	return mylogger
+}
+
+func (mylogger Logger) write(s sink, lvl zerolog.Level, msg string) {
+	event := s.logger.WithLevel(lvl)
+	if s.console {
+		msg = fmt.Sprintf("%s: %s", mylogger.name, msg)
+	} else {
+		event = event.Str("logger", mylogger.name)
+	}
+	if mylogger.job != "" {
+		event = event.Str("job", mylogger.job)
+	}
+	if mylogger.worker >= 0 {
+		event = event.Int("worker", mylogger.worker)
+	}
+	// sorted, so the console shows the fields in a stable order
+	keys := make([]string, 0, len(mylogger.fields))
+	for key := range mylogger.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		event = event.Interface(key, mylogger.fields[key])
+	}
+	event.Msg(msg)
+}
+
+func (mylogger Logger) log(lvl zerolog.Level, msg string) {
+	lock.RLock()
+	defer lock.RUnlock()
+	threshold := level
+	if job_level, found := job_levels[mylogger.job]; found && mylogger.job != "" {
+		threshold = job_level
+	}
+	if lvl < threshold {
+		return
+	}
+	for _, s := range sinks {
+		mylogger.write(s, lvl, msg)
+	}
+	if s, found := job_files[mylogger.job]; found && mylogger.job != "" {
+		mylogger.write(s, lvl, msg)
+	}
+}
+
+func (mylogger Logger) Debug(msg string) {
+	mylogger.log(zerolog.DebugLevel, msg)
+}
+
+func (mylogger Logger) Info(msg string) {
+	mylogger.log(zerolog.InfoLevel, msg)
+}
+
+func (mylogger Logger) Warn(msg string) {
+	mylogger.log(zerolog.WarnLevel, msg)
+}
+
+func (mylogger Logger) Error(msg string) {
+	mylogger.log(zerolog.ErrorLevel, msg)
+}
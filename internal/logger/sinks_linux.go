@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const journald_socket = "/run/systemd/journal/socket"
+
+// syslogWriter sends to the local syslog with "local", or to a remote one
+// with udp://host:port or tcp://host:port
+func syslogWriter(address string) (zerolog.LevelWriter, error) {
+	network := ""
+	if address != "local" {
+		parts := strings.SplitN(address, "://", 2)
+		if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") {
+			return nil, fmt.Errorf("invalid address %q, expecting local, udp://host:port or tcp://host:port", address)
+		}
+		network, address = parts[0], parts[1]
+	} else {
+		address = ""
+	}
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, "ugoku")
+	if err != nil {
+		return nil, err
+	}
+	return zerolog.SyslogLevelWriter(writer), nil
+}
+
+// journald writes entries with the native journal protocol, so the fields
+// of an entry can be queried with journalctl, like journalctl JOB=backup
+type journald struct {
+	conn *net.UnixConn
+}
+
+func journaldWriter() (zerolog.LevelWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journald_socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journald{conn: conn}, nil
+}
+
+func journaldPriority(lvl zerolog.Level) int {
+	switch lvl {
+	case zerolog.DebugLevel:
+		return 7
+	case zerolog.WarnLevel:
+		return 4
+	case zerolog.ErrorLevel:
+		return 3
+	}
+	return 6
+}
+
+func journaldField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	// values with newlines are written with their length
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func (j *journald) Write(p []byte) (int, error) {
+	return j.WriteLevel(zerolog.InfoLevel, p)
+}
+
+func (j *journald) WriteLevel(lvl zerolog.Level, p []byte) (int, error) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(p, &entry); err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	journaldField(&buf, "MESSAGE", fmt.Sprint(entry[zerolog.MessageFieldName]))
+	journaldField(&buf, "PRIORITY", fmt.Sprint(journaldPriority(lvl)))
+	journaldField(&buf, "SYSLOG_IDENTIFIER", "ugoku")
+	keys := make([]string, 0, len(entry))
+	for key := range entry {
+		if key != zerolog.MessageFieldName && key != zerolog.LevelFieldName {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		journaldField(&buf, strings.ToUpper(key), fmt.Sprint(entry[key]))
+	}
+	if _, err := j.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package logger
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog"
+)
+
+func syslogWriter(address string) (zerolog.LevelWriter, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func journaldWriter() (zerolog.LevelWriter, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/jobs"
+)
+
+// failure reasons
+const (
+	REASON_TRANSFER       = "transfer"
+	REASON_TIMEOUT        = "timeout"
+	REASON_REMOTE_COMMAND = "remote-command"
+	REASON_QUARANTINED    = "quarantined"
+)
+
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+type value struct {
+	labels string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	values  map[string]*value
+}
+
+var lock sync.Mutex
+var families []*family
+
+func newFamily(name string, kind string, help string, labels []string, buckets []float64) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, values: make(map[string]*value)}
+	families = append(families, f)
+	return f
+}
+
+var transfer_buckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+var scan_buckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+var (
+	files_transferred = newFamily("ugoku_files_transferred_total", counter, "Files transferred.", []string{"job", "kind", "server"}, nil)
+	bytes_transferred = newFamily("ugoku_bytes_transferred_total", counter, "Bytes of the files transferred.", []string{"job", "kind", "server"}, nil)
+	failures          = newFamily("ugoku_transfer_failures_total", counter, "Failed transfers by reason.", []string{"job", "kind", "server", "reason"}, nil)
+	transfer_duration = newFamily("ugoku_transfer_duration_seconds", histogram, "Duration of successful transfers.", []string{"job", "kind", "server"}, transfer_buckets)
+	last_success      = newFamily("ugoku_last_success_timestamp_seconds", gauge, "Time of the last successful transfer.", []string{"job", "kind", "server"}, nil)
+	scan_duration     = newFamily("ugoku_scan_duration_seconds", histogram, "Duration of scan passes, including waiting for the files found to be handled.", []string{"job", "server"}, scan_buckets)
+	files_pending     = newFamily("ugoku_files_pending", gauge, "Files found by the current scan pass and not handled yet.", []string{"job"}, nil)
+	active_workers    = newFamily("ugoku_active_workers", gauge, "Workers busy with a transfer.", []string{"job", "kind"}, nil)
+	reconnects        = newFamily("ugoku_reconnects_total", counter, "Connections made again after a worker or scanner was connected before.", []string{"job", "kind", "server"}, nil)
+	connect_failures  = newFamily("ugoku_connect_failures_total", counter, "Failed connection attempts.", []string{"job", "kind", "server"}, nil)
+)
+
+var connected = make(map[string]bool)
+
+func escape(label string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label)
+}
+
+// get returns the value of the label values, the lock must be held
+func (f *family) get(label_values ...string) *value {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(label_values[i])))
+	}
+	key := strings.Join(pairs, ",")
+	v, found := f.values[key]
+	if !found {
+		v = &value{labels: key, counts: make([]uint64, len(f.buckets))}
+		f.values[key] = v
+	}
+	return v
+}
+
+func (f *family) add(delta float64, label_values ...string) {
+	lock.Lock()
+	defer lock.Unlock()
+	f.get(label_values...).value += delta
+}
+
+func (f *family) set(v float64, label_values ...string) {
+	lock.Lock()
+	defer lock.Unlock()
+	f.get(label_values...).value = v
+}
+
+func (f *family) observe(v float64, label_values ...string) {
+	lock.Lock()
+	defer lock.Unlock()
+	h := f.get(label_values...)
+	for i, bound := range f.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Reason tells the failure reason of a transfer error
+func Reason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return REASON_TIMEOUT
+	}
+	return REASON_TRANSFER
+}
+
+// Result records the outcome of the transfer of one file started at started,
+// failed for reason when err is not nil
+func Result(job string, kind string, server string, size int64, started time.Time, reason string, err error) {
+	if err != nil {
+		failures.add(1, job, kind, server, reason)
+		return
+	}
+	files_transferred.add(1, job, kind, server)
+	bytes_transferred.add(float64(size), job, kind, server)
+	transfer_duration.observe(time.Since(started).Seconds(), job, kind, server)
+	last_success.set(float64(time.Now().Unix()), job, kind, server)
+}
+
+// ScanDuration records a scan pass started at started
+func ScanDuration(job string, server string, started time.Time) {
+	scan_duration.observe(time.Since(started).Seconds(), job, server)
+}
+
+func Pending(job string, files int) {
+	files_pending.set(float64(files), job)
+}
+
+// Connected records a connection attempt of a worker, or of the scanner with
+// worker -1
+func Connected(job string, kind string, server string, worker int, err error) {
+	if err != nil {
+		connect_failures.add(1, job, kind, server)
+		return
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d", job, kind, server, worker)
+	lock.Lock()
+	again := connected[key]
+	connected[key] = true
+	lock.Unlock()
+	if again {
+		reconnects.add(1, job, kind, server)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func withLabel(labels string, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+// Write writes all metrics in the prometheus text format
+func Write(w io.Writer) {
+	// the busy workers are taken from the jobs running in service mode
+	busy := make(map[[2]string]int)
+	for _, job := range jobs.List() {
+		status := job.Status()
+		key := [2]string{status.Name, status.Kind}
+		busy[key] += 0
+		for _, worker := range status.Workers {
+			if worker.State == jobs.BUSY {
+				busy[key]++
+			}
+		}
+	}
+	for key, count := range busy {
+		active_workers.set(float64(count), key[0], key[1])
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, f := range families {
+		if len(f.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := f.values[key]
+			if f.kind != histogram {
+				fmt.Fprintf(w, "%s{%s} %s\n", f.name, v.labels, formatFloat(v.value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", f.name, withLabel(v.labels, fmt.Sprintf(`le="%s"`, formatFloat(bound))), v.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", f.name, withLabel(v.labels, `le="+Inf"`), v.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", f.name, v.labels, formatFloat(v.sum))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", f.name, v.labels, v.count)
+		}
+	}
+}
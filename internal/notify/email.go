@@ -0,0 +1,346 @@
+package notify
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/logger"
+)
+
+// how often deadlines and the digest time are checked
+const email_check_interval = 30 * time.Second
+
+const smtp_timeout = 60 * time.Second
+
+// DIGEST_STATE_SUFFIX names the file next to the history holding the day
+// the digest was last sent
+const DIGEST_STATE_SUFFIX = ".digest"
+
+type jobStats struct {
+	transferred int
+	failed      int
+	bytes       int64
+}
+
+type emailer struct {
+	config.EmailConfig
+	jobs    map[string]config.EmailJobConfig
+	queue   chan Event
+	pending sync.WaitGroup
+	logger  logger.Logger
+
+	started          time.Time
+	last_arrival     map[string]time.Time
+	deadline_alerted map[string]string
+	digest_lock      sync.Mutex
+}
+
+var mailer *emailer
+
+func setupEmail(cfg config.EmailConfig) {
+	if cfg.Host == "" {
+		return
+	}
+	mailer = &emailer{
+		EmailConfig:      cfg,
+		jobs:             make(map[string]config.EmailJobConfig),
+		queue:            make(chan Event, queue_size),
+		logger:           logger.NewLogger("email"),
+		started:          time.Now(),
+		last_arrival:     make(map[string]time.Time),
+		deadline_alerted: make(map[string]string),
+	}
+	for _, job := range cfg.Jobs {
+		mailer.jobs[job.Job] = job
+	}
+	go mailer.run()
+}
+
+func (e *emailer) enqueue(event Event) {
+	e.pending.Add(1)
+	select {
+	case e.queue <- event:
+	default:
+		e.pending.Done()
+		e.logger.Error(fmt.Sprintf("queue full, dropped %s event of %s", event.Event, event.Job))
+	}
+}
+
+func (e *emailer) run() {
+	ticker := time.NewTicker(email_check_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-e.queue:
+			e.handle(event)
+			e.pending.Done()
+		case now := <-ticker.C:
+			e.checkDeadlines(now)
+			e.checkDigest(now)
+		}
+	}
+}
+
+func fileName(file string) string {
+	return path.Base(strings.ReplaceAll(file, "\\", "/"))
+}
+
+func (e *emailer) handle(event Event) {
+	job, subscribed := e.jobs[event.Job]
+	switch event.Event {
+	case FILE_TRANSFERRED:
+		e.last_arrival[event.Job] = time.Now()
+		if subscribed && matchAny(job.OnArrival, fileName(event.Source)) {
+			e.send(job.To, fmt.Sprintf("[ugoku] %s: %s received", event.Job, fileName(event.Source)),
+				fmt.Sprintf("File %s was transferred to %s (%d bytes) at %s.\n", event.Source, event.Target, event.Size, event.Time))
+		}
+	case FILE_FAILED, FILE_QUARANTINED, CONNECTION_LOST, SLA_BREACH, SLA_LATE_ARRIVAL:
+		if subscribed && job.OnFailure {
+			e.send(job.To, fmt.Sprintf("[ugoku] %s: %s", event.Job, event.Event), describe(event))
+		}
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func describe(event Event) string {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Event:  %s\nJob:    %s\nTime:   %s\n", event.Event, event.Job, event.Time)
+	if event.Server != "" {
+		fmt.Fprintf(&body, "Server: %s\n", event.Server)
+	}
+	if event.Expectation != "" {
+		fmt.Fprintf(&body, "Expect: %s\n", event.Expectation)
+	}
+	if event.Source != "" {
+		fmt.Fprintf(&body, "Source: %s\n", event.Source)
+	}
+	if event.Target != "" {
+		fmt.Fprintf(&body, "Target: %s\n", event.Target)
+	}
+	if event.Error != "" {
+		fmt.Fprintf(&body, "Error:  %s\n", event.Error)
+	}
+	return body.String()
+}
+
+// todayAt returns the given 15:04 time on the day of now
+func todayAt(now time.Time, clock string) time.Time {
+	t, _ := time.Parse("15:04", clock)
+	return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+}
+
+// checkDeadlines alerts once a day for each job with no file transferred
+// since midnight by its deadline. Deadlines which passed before start are
+// not checked, the arrivals before the start are unknown.
+func (e *emailer) checkDeadlines(now time.Time) {
+	today := now.Format("2006-01-02")
+	for name, job := range e.jobs {
+		if job.Deadline == "" || e.deadline_alerted[name] == today {
+			continue
+		}
+		deadline := todayAt(now, job.Deadline)
+		if now.Before(deadline) || deadline.Before(e.started) {
+			continue
+		}
+		midnight := todayAt(now, "00:00")
+		if e.last_arrival[name].After(midnight) {
+			continue
+		}
+		e.deadline_alerted[name] = today
+		e.send(job.To, fmt.Sprintf("[ugoku] %s: no file received by %s", name, job.Deadline),
+			fmt.Sprintf("No file was transferred by job %s today before the %s deadline.\n", name, job.Deadline))
+	}
+}
+
+// Digest sends the digest when it is due and was not sent yet, for one time
+// runs which are not running at the digest time
+func Digest() {
+	if mailer != nil && !dryrun.Enabled() {
+		mailer.checkDigest(time.Now())
+	}
+}
+
+// checkDigest sends once a day the digest of the transfers recorded in the
+// history since the previous digest time. The day it was sent is kept next
+// to the history, so a restart or a one time run after the digest time
+// sends it when no other run did.
+func (e *emailer) checkDigest(now time.Time) {
+	history_path := history.Path()
+	if e.Digest == "" || history_path == "" {
+		return
+	}
+	e.digest_lock.Lock()
+	defer e.digest_lock.Unlock()
+	today := now.Format("2006-01-02")
+	digest_time := todayAt(now, e.Digest)
+	if now.Before(digest_time) {
+		return
+	}
+	state_path := history_path + DIGEST_STATE_SUFFIX
+	sent, err := os.ReadFile(state_path)
+	if err != nil && !os.IsNotExist(err) {
+		e.logger.Error(fmt.Sprintf("failed to read %s: %v", state_path, err))
+		return
+	}
+	if strings.TrimSpace(string(sent)) == today {
+		return
+	}
+	// marked first, a digest failing to send is not sent over and over
+	if err = os.WriteFile(state_path, []byte(today+"\n"), 0640); err != nil {
+		e.logger.Error(fmt.Sprintf("failed to write %s: %v", state_path, err))
+		return
+	}
+	from := digest_time.AddDate(0, 0, -1)
+	entries, err := history.Recorded(history.Filter{From: from, To: digest_time})
+	if err != nil {
+		e.logger.Error(fmt.Sprintf("failed to read the history for the digest: %v", err))
+		return
+	}
+	stats := make(map[string]*jobStats)
+	for _, entry := range entries {
+		job_stats, ok := stats[entry.Job]
+		if !ok {
+			job_stats = new(jobStats)
+			stats[entry.Job] = job_stats
+		}
+		if entry.Result == history.SUCCESS {
+			job_stats.transferred++
+			job_stats.bytes += entry.Size
+		} else {
+			job_stats.failed++
+		}
+	}
+
+	subject := fmt.Sprintf("[ugoku] transfer summary %s", today)
+	if len(e.DigestTo) > 0 {
+		var jobs []string
+		for name := range stats {
+			jobs = append(jobs, name)
+		}
+		sort.Strings(jobs)
+		e.send(e.DigestTo, subject, digestBody(stats, jobs, from, digest_time))
+	}
+	for name, job := range e.jobs {
+		if job.Digest {
+			e.send(job.To, fmt.Sprintf("[ugoku] %s: transfer summary %s", name, today), digestBody(stats, []string{name}, from, digest_time))
+		}
+	}
+}
+
+func digestBody(stats map[string]*jobStats, jobs []string, from time.Time, to time.Time) string {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Transfers from %s to %s\n\n", from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"))
+	if len(jobs) == 0 {
+		body.WriteString("No transfers.\n")
+	}
+	for _, name := range jobs {
+		job_stats, ok := stats[name]
+		if !ok {
+			job_stats = new(jobStats)
+		}
+		fmt.Fprintf(&body, "%-30s %6d transferred %6d failed %14d bytes\n", name, job_stats.transferred, job_stats.failed, job_stats.bytes)
+	}
+	return body.String()
+}
+
+func (e *emailer) send(to []string, subject string, body string) {
+	if len(to) == 0 {
+		return
+	}
+	err := e.sendMail(to, subject, body)
+	if err != nil {
+		e.logger.Error(fmt.Sprintf("failed to send email %q: %s", subject, err.Error()))
+		return
+	}
+	e.logger.Info(fmt.Sprintf("sent email %q to %s", subject, strings.Join(to, ", ")))
+}
+
+// headerValue replaces CR and LF in a header value, so a remote file name
+// in the subject cannot add headers or start the body
+func headerValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, value)
+}
+
+func (e *emailer) sendMail(to []string, subject string, body string) error {
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	tls_config := &tls.Config{ServerName: e.Host}
+
+	var conn net.Conn
+	var err error
+	if e.Security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtp_timeout}, "tcp", addr, tls_config)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, smtp_timeout)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtp_timeout))
+
+	client, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if e.Security == "starttls" {
+		if err = client.StartTLS(tls_config); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(e.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	// non-ASCII subjects are encoded as RFC 2047 words
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		headerValue(e.From), headerValue(strings.Join(to, ", ")), mime.QEncoding.Encode("utf-8", headerValue(subject)), time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err = w.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/history"
+)
+
+// smtpSink is a local SMTP server keeping the messages it receives
+type smtpSink struct {
+	listener net.Listener
+	lock     sync.Mutex
+	messages []string
+}
+
+func newSmtpSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 sink")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 sink")
+		case command == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.lock.Lock()
+			s.messages = append(s.messages, data.String())
+			s.lock.Unlock()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpSink) received() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+func newTestEmailer(sink *smtpSink, digest string) *emailer {
+	host, port, _ := net.SplitHostPort(sink.listener.Addr().String())
+	port_number, _ := strconv.Atoi(port)
+	return &emailer{
+		EmailConfig: config.EmailConfig{
+			Host:     host,
+			Port:     port_number,
+			Security: "none",
+			From:     "ugoku@example.com",
+			Digest:   digest,
+			DigestTo: []string{"ops@example.com"},
+		},
+		jobs:             make(map[string]config.EmailJobConfig),
+		started:          time.Now(),
+		last_arrival:     make(map[string]time.Time),
+		deadline_alerted: make(map[string]string),
+	}
+}
+
+func headers(message string) []string {
+	head, _, _ := strings.Cut(message, "\r\n\r\n")
+	return strings.Split(head, "\r\n")
+}
+
+func TestSubjectCannotAddHeaders(t *testing.T) {
+	sink := newSmtpSink(t)
+	e := newTestEmailer(sink, "")
+	err := e.sendMail([]string{"ops@example.com"}, "[ugoku] job1: x.csv\r\nBcc: evil@example.com\r\n\r\nforged", "body\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := sink.received()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, expecting 1", len(messages))
+	}
+	for _, line := range headers(messages[0]) {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Fatalf("injected header: %q", line)
+		}
+	}
+	if !strings.HasSuffix(messages[0], "\r\n\r\nbody\r\n") {
+		t.Fatalf("body changed: %q", messages[0])
+	}
+}
+
+func TestNonAsciiSubjectIsEncoded(t *testing.T) {
+	sink := newSmtpSink(t)
+	e := newTestEmailer(sink, "")
+	if err := e.sendMail([]string{"ops@example.com"}, "[ugoku] job1: résumé.pdf received", "body\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range headers(sink.received()[0]) {
+		if strings.HasPrefix(line, "Subject:") && !strings.Contains(line, "=?utf-8?q?") {
+			t.Fatalf("subject not encoded: %q", line)
+		}
+	}
+}
+
+func TestDigestFromHistory(t *testing.T) {
+	dir := t.TempDir()
+	history_path := filepath.Join(dir, "history.jsonl")
+	if err := history.Open(config.HistoryConfig{Path: history_path}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	digest_time := todayAt(now, "00:00")
+	yesterday := digest_time.Add(-12 * time.Hour)
+	history.Record(history.Entry{Job: "download1", SourcePath: "/in/a.csv", Size: 100, Start: yesterday}, nil)
+	history.Record(history.Entry{Job: "download1", SourcePath: "/in/b.csv", Size: 50, Start: yesterday}, nil)
+	history.Record(history.Entry{Job: "upload1", SourcePath: "/out/c.csv", Start: yesterday}, errors.New("refused"))
+	// after the digest time, part of the next digest
+	history.Record(history.Entry{Job: "upload1", SourcePath: "/out/d.csv", Size: 7, Start: now}, nil)
+
+	sink := newSmtpSink(t)
+	e := newTestEmailer(sink, "00:00")
+	e.checkDigest(now)
+	messages := sink.received()
+	if len(messages) != 1 {
+		t.Fatalf("got %d digests, expecting 1", len(messages))
+	}
+	_, body, _ := strings.Cut(messages[0], "\r\n\r\n")
+	for _, expected := range []string{
+		"download1                           2 transferred      0 failed            150 bytes",
+		"upload1                             0 transferred      1 failed              0 bytes",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("digest misses %q:\n%s", expected, body)
+		}
+	}
+
+	// sent once a day, also by another run as after a restart
+	e.checkDigest(now)
+	newTestEmailer(sink, "00:00").checkDigest(now)
+	if len(sink.received()) != 1 {
+		t.Fatalf("digest sent %d times", len(sink.received()))
+	}
+	sent, err := os.ReadFile(history_path + DIGEST_STATE_SUFFIX)
+	if err != nil || strings.TrimSpace(string(sent)) != now.Format("2006-01-02") {
+		t.Fatalf("digest state %q, %v", sent, err)
+	}
+}
@@ -0,0 +1,270 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/logger"
+	siginthandler "github.com/iambighead/ugoku/internal/sigintHandler"
+	"github.com/iambighead/ugoku/internal/sleepytime"
+)
+
+// events which can be subscribed to
+const (
+	FILE_TRANSFERRED    = "file.transferred"
+	FILE_FAILED         = "file.failed"
+	FILE_QUARANTINED    = "file.quarantined"
+	CONNECTION_LOST     = "connection.lost"
+	CONNECTION_RESTORED = "connection.restored"
+	BATCH_SUMMARY       = "batch.summary"
+	SLA_BREACH          = "sla.breach"
+	SLA_LATE_ARRIVAL    = "sla.late-arrival"
+)
+
+var known_events = []string{FILE_TRANSFERRED, FILE_FAILED, FILE_QUARANTINED, CONNECTION_LOST, CONNECTION_RESTORED, BATCH_SUMMARY, SLA_BREACH, SLA_LATE_ARRIVAL}
+
+// events waiting per notifier, further events are dropped
+const queue_size = 1000
+
+// retry_unit is the unit of the backoff between delivery attempts
+var retry_unit = time.Second
+
+type Event struct {
+	Event       string `json:"event"`
+	Time        string `json:"time"`
+	Job         string `json:"job"`
+	Kind        string `json:"kind,omitempty"`
+	Server      string `json:"server,omitempty"`
+	Expectation string `json:"expectation,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Files       int    `json:"files,omitempty"`
+	Failed      int    `json:"failed,omitempty"`
+	Elapsed     int64  `json:"elapsed_ms,omitempty"`
+}
+
+type notifier struct {
+	config.NotifierConfig
+	body    *template.Template
+	events  map[string]bool
+	jobs    map[string]bool
+	queue   chan Event
+	pending sync.WaitGroup
+	client  *http.Client
+	logger  logger.Logger
+}
+
+var notifiers []*notifier
+var notify_logger logger.Logger
+
+var connection_lock sync.Mutex
+var connection_lost = make(map[string]bool)
+
+func init() {
+	notify_logger = logger.NewLogger("notify")
+}
+
+var template_funcs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		out, err := json.Marshal(value)
+		return string(out), err
+	},
+}
+
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Setup starts a sender for each configured notifier, and the emailer when an
+// smtp server is configured
+func Setup(cfgs []config.NotifierConfig, email config.EmailConfig) error {
+	setupEmail(email)
+	for _, cfg := range cfgs {
+		n := &notifier{
+			NotifierConfig: cfg,
+			events:         toSet(cfg.Events),
+			jobs:           toSet(cfg.Jobs),
+			queue:          make(chan Event, queue_size),
+			client:         &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+			logger:         logger.NewLogger(fmt.Sprintf("notifier[%s]", cfg.Name)),
+		}
+		for event := range n.events {
+			if !isKnown(event) {
+				return fmt.Errorf("notifier %s: unknown event %s", cfg.Name, event)
+			}
+		}
+		if cfg.Body != "" {
+			body, err := template.New(cfg.Name).Funcs(template_funcs).Option("missingkey=error").Parse(cfg.Body)
+			if err != nil {
+				return fmt.Errorf("notifier %s: body: %v", cfg.Name, err)
+			}
+			n.body = body
+		}
+		notifiers = append(notifiers, n)
+		go n.run()
+	}
+	if len(notifiers) > 0 || mailer != nil {
+		siginthandler.Handle("notify", func() {
+			Flush(5 * time.Second)
+		})
+	}
+	return nil
+}
+
+func isKnown(event string) bool {
+	for _, known := range known_events {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Send queues the event for every notifier subscribed to it. It never blocks,
+// events are dropped when a notifier is too far behind.
+func Send(event Event) {
+	if (len(notifiers) == 0 && mailer == nil) || dryrun.Enabled() {
+		return
+	}
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	if mailer != nil {
+		mailer.enqueue(event)
+	}
+	for _, n := range notifiers {
+		if n.events != nil && !n.events[event.Event] {
+			continue
+		}
+		if n.jobs != nil && !n.jobs[event.Job] {
+			continue
+		}
+		n.pending.Add(1)
+		select {
+		case n.queue <- event:
+		default:
+			n.pending.Done()
+			n.logger.Error(fmt.Sprintf("queue full, dropped %s event of %s", event.Event, event.Job))
+		}
+	}
+}
+
+// ConnectionState reports a connection attempt of a job to a server. Only
+// changes are sent, so the workers and scanner of one job report it once.
+func ConnectionState(job string, kind string, server string, err error) {
+	key := job + "\x00" + server
+	connection_lock.Lock()
+	was_lost := connection_lost[key]
+	connection_lost[key] = err != nil
+	connection_lock.Unlock()
+
+	if err != nil && !was_lost {
+		Send(Event{Event: CONNECTION_LOST, Job: job, Kind: kind, Server: server, Error: err.Error()})
+	} else if err == nil && was_lost {
+		Send(Event{Event: CONNECTION_RESTORED, Job: job, Kind: kind, Server: server})
+	}
+}
+
+// Flush waits up to max_wait for the queued events to be delivered
+func Flush(max_wait time.Duration) {
+	flushed := make(chan struct{})
+	go func() {
+		for _, n := range notifiers {
+			n.pending.Wait()
+		}
+		if mailer != nil {
+			mailer.pending.Wait()
+		}
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(max_wait):
+		notify_logger.Error("timed out delivering notifications")
+	}
+}
+
+func (n *notifier) run() {
+	for event := range n.queue {
+		var sleepy sleepytime.Sleepytime
+		sleepy.Reset(1, 60)
+		for attempt := 0; ; attempt++ {
+			err := n.deliver(event)
+			if err == nil {
+				break
+			}
+			if attempt >= n.Retries {
+				n.logger.Error(fmt.Sprintf("failed to deliver %s event of %s, giving up: %s", event.Event, event.Job, err.Error()))
+				break
+			}
+			wait := sleepy.GetNextSleep()
+			n.logger.Error(fmt.Sprintf("failed to deliver %s event of %s, retry in %d seconds: %s", event.Event, event.Job, wait, err.Error()))
+			time.Sleep(time.Duration(wait) * retry_unit)
+		}
+		n.pending.Done()
+	}
+}
+
+func (n *notifier) render(event Event) ([]byte, error) {
+	if n.body == nil {
+		return json.Marshal(event)
+	}
+	var body bytes.Buffer
+	err := n.body.Execute(&body, event)
+	return body.Bytes(), err
+}
+
+// Sign returns the hex HMAC-SHA256 of body, as sent in X-Ugoku-Signature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *notifier) deliver(event Event) error {
+	body, err := n.render(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, n.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Ugoku-Event", event.Event)
+	for key, value := range n.Headers {
+		request.Header.Set(key, value)
+	}
+	if n.Secret != "" {
+		request.Header.Set("X-Ugoku-Signature", Sign(n.Secret, body))
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", n.Url, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+)
+
+type received struct {
+	body      string
+	event     string
+	signature string
+	at        time.Time
+}
+
+// webhook is a test endpoint answering with the given statuses in turn, then 200
+type webhook struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []received
+}
+
+func newWebhook(t *testing.T, statuses ...int) (*webhook, *httptest.Server) {
+	hook := &webhook{statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hook.lock.Lock()
+		defer hook.lock.Unlock()
+		hook.requests = append(hook.requests, received{string(body), r.Header.Get("X-Ugoku-Event"), r.Header.Get("X-Ugoku-Signature"), time.Now()})
+		if len(hook.statuses) > 0 {
+			w.WriteHeader(hook.statuses[0])
+			hook.statuses = hook.statuses[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+	return hook, server
+}
+
+func (hook *webhook) received() []received {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	return append([]received{}, hook.requests...)
+}
+
+// setupNotifier sets up cfg as the only notifier
+func setupNotifier(t *testing.T, cfg config.NotifierConfig) {
+	notifiers = nil
+	t.Cleanup(func() { notifiers = nil })
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5
+	}
+	if err := Setup([]config.NotifierConfig{cfg}, config.EmailConfig{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignatureHeader(t *testing.T) {
+	hook, server := newWebhook(t)
+	setupNotifier(t, config.NotifierConfig{Name: "signed", Url: server.URL, Secret: "s3cret"})
+	Send(Event{Event: FILE_TRANSFERRED, Job: "job1", Source: "/in/a.csv", Size: 10})
+	Flush(5 * time.Second)
+
+	requests := hook.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, expecting 1", len(requests))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(requests[0].body))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if requests[0].signature != expected || Sign("s3cret", []byte(requests[0].body)) != expected {
+		t.Fatalf("signature %q, expecting %q", requests[0].signature, expected)
+	}
+	if requests[0].event != FILE_TRANSFERRED {
+		t.Fatalf("event header %q", requests[0].event)
+	}
+}
+
+func TestNoSignatureWithoutSecret(t *testing.T) {
+	hook, server := newWebhook(t)
+	setupNotifier(t, config.NotifierConfig{Name: "unsigned", Url: server.URL})
+	Send(Event{Event: FILE_TRANSFERRED, Job: "job1"})
+	Flush(5 * time.Second)
+	if requests := hook.received(); len(requests) != 1 || requests[0].signature != "" {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	retry_unit = 10 * time.Millisecond
+	t.Cleanup(func() { retry_unit = time.Second })
+	hook, server := newWebhook(t, http.StatusInternalServerError, http.StatusBadGateway)
+	setupNotifier(t, config.NotifierConfig{Name: "retried", Url: server.URL, Retries: 3})
+	Send(Event{Event: FILE_FAILED, Job: "job1", Error: "refused"})
+	Flush(5 * time.Second)
+
+	requests := hook.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d attempts, expecting 3", len(requests))
+	}
+	first_wait := requests[1].at.Sub(requests[0].at)
+	second_wait := requests[2].at.Sub(requests[1].at)
+	if first_wait < 2*retry_unit || second_wait < 4*retry_unit {
+		t.Fatalf("no backoff between attempts: %v, %v", first_wait, second_wait)
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	retry_unit = time.Millisecond
+	t.Cleanup(func() { retry_unit = time.Second })
+	hook, server := newWebhook(t, 500, 500, 500, 500)
+	setupNotifier(t, config.NotifierConfig{Name: "failing", Url: server.URL, Retries: 1})
+	Send(Event{Event: FILE_FAILED, Job: "job1"})
+	Flush(5 * time.Second)
+	if len(hook.received()) != 2 {
+		t.Fatalf("got %d attempts, expecting 2", len(hook.received()))
+	}
+}
+
+func TestFilterByJobAndEvent(t *testing.T) {
+	hook, server := newWebhook(t)
+	setupNotifier(t, config.NotifierConfig{Name: "filtered", Url: server.URL,
+		Events: []string{FILE_FAILED, SLA_BREACH}, Jobs: []string{"job1"}})
+	Send(Event{Event: FILE_FAILED, Job: "job1"})
+	Send(Event{Event: FILE_TRANSFERRED, Job: "job1"})
+	Send(Event{Event: FILE_FAILED, Job: "job2"})
+	Send(Event{Event: SLA_BREACH, Job: "job1"})
+	Flush(5 * time.Second)
+
+	requests := hook.received()
+	if len(requests) != 2 || requests[0].event != FILE_FAILED || requests[1].event != SLA_BREACH {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+}
+
+func TestUnknownEventRejected(t *testing.T) {
+	notifiers = nil
+	t.Cleanup(func() { notifiers = nil })
+	err := Setup([]config.NotifierConfig{{Name: "typo", Url: "http://127.0.0.1", Events: []string{"file.transfered"}}}, config.EmailConfig{})
+	if err == nil {
+		t.Fatal("unknown event accepted")
+	}
+}
+
+func TestTemplatedBody(t *testing.T) {
+	hook, server := newWebhook(t)
+	setupNotifier(t, config.NotifierConfig{Name: "chat", Url: server.URL, Secret: "s3cret",
+		Body: `{"text": {{json (printf "%s: %s failed: %s" .Job .Source .Error)}}}`})
+	Send(Event{Event: FILE_FAILED, Job: "job1", Source: "/in/\"a\".csv", Error: "refused"})
+	Flush(5 * time.Second)
+
+	requests := hook.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, expecting 1", len(requests))
+	}
+	expected := `{"text": "job1: /in/\"a\".csv failed: refused"}`
+	if requests[0].body != expected {
+		t.Fatalf("body %s, expecting %s", requests[0].body, expected)
+	}
+	// the signature covers the rendered body
+	if requests[0].signature != Sign("s3cret", []byte(expected)) {
+		t.Fatalf("signature does not match the body")
+	}
+}
+
+func TestBadTemplateRejected(t *testing.T) {
+	notifiers = nil
+	t.Cleanup(func() { notifiers = nil })
+	err := Setup([]config.NotifierConfig{{Name: "broken", Url: "http://127.0.0.1", Body: "{{.Job"}}, config.EmailConfig{})
+	if err == nil {
+		t.Fatal("broken template accepted")
+	}
+}
@@ -0,0 +1,26 @@
+package packaging
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompressReader(source io.Reader, kind string) (io.Reader, func(), error) {
+	switch kind {
+	case ".tar.gz", ".tgz", ".gz":
+		gr, err := gzip.NewReader(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, func() { gr.Close() }, nil
+	case ".tar.zst", ".zst":
+		zr, err := zstd.NewReader(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return source, func() {}, nil
+}
@@ -0,0 +1,377 @@
+package packaging
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// CompressExtension is appended to the name of a file compressed with kind
+func CompressExtension(kind string) string {
+	switch kind {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+type bundleNameData struct {
+	Job       string
+	Timestamp string
+	Date      string
+	Count     int
+}
+
+// BundleName renders the bundle name template, e.g. "{{.Job}}_{{.Timestamp}}.zip"
+func BundleName(name_template string, job string, count int, now time.Time) (string, error) {
+	tmpl, err := template.New("bundle").Parse(name_template)
+	if err != nil {
+		return "", err
+	}
+	var name bytes.Buffer
+	err = tmpl.Execute(&name, bundleNameData{
+		Job:       job,
+		Timestamp: now.Format("20060102150405"),
+		Date:      now.Format("20060102"),
+		Count:     count,
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(name.String()), nil
+}
+
+func memberName(base_folder string, file string) string {
+	relative, err := filepath.Rel(base_folder, file)
+	if err != nil {
+		relative = filepath.Base(file)
+	}
+	return filepath.ToSlash(relative)
+}
+
+// CreateBundle packs files into one zip or tar.gz archive at bundle_path,
+// with member names relative to base_folder
+func CreateBundle(kind string, bundle_path string, base_folder string, files []string) error {
+	out, err := os.Create(bundle_path)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "zip":
+		err = writeZip(out, base_folder, files)
+	case "tar.gz":
+		err = writeTarGz(out, base_folder, files)
+	default:
+		err = fmt.Errorf("unknown bundle type %q", kind)
+	}
+
+	close_err := out.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(bundle_path)
+	}
+	return err
+}
+
+func writeZip(out io.Writer, base_folder string, files []string) error {
+	zw := zip.NewWriter(out)
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(stat)
+		if err != nil {
+			return err
+		}
+		header.Name = memberName(base_folder, file)
+		header.Method = zip.Deflate
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err = copyFile(writer, file); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(out io.Writer, base_folder string, files []string) error {
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(stat, "")
+		if err != nil {
+			return err
+		}
+		header.Name = memberName(base_folder, file)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err = copyFile(tw, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func copyFile(writer io.Writer, file string) error {
+	source, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	_, err = io.Copy(writer, source)
+	return err
+}
+
+// --------------------------------
+
+// IsArchive tells if Extract knows how to unpack the file
+func IsArchive(name string) bool {
+	return archiveKind(name) != ""
+}
+
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar.zst", ".zip", ".tar", ".gz", ".zst"} {
+		if strings.HasSuffix(lower, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// safePath joins an archive member name to the target folder, refusing
+// absolute names and names escaping the folder with ".."
+func safePath(target_folder string, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", fmt.Errorf("absolute path in archive: %s", name)
+	}
+	joined := filepath.Join(target_folder, name)
+	relative, err := filepath.Rel(target_folder, joined)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes target folder: %s", name)
+	}
+	return joined, nil
+}
+
+// Limits bound what Extract writes, so a small archive cannot fill the disk
+type Limits struct {
+	MaxBytes int64
+	MaxFiles int
+}
+
+// ErrLimit is returned when an archive unpacks beyond its Limits
+var ErrLimit = errors.New("archive exceeds the extract limits")
+
+// limiter counts the entries and bytes extracted so far
+type limiter struct {
+	Limits
+	bytes int64
+	files int
+}
+
+func (l *limiter) entry() error {
+	l.files++
+	if l.MaxFiles > 0 && l.files > l.MaxFiles {
+		return fmt.Errorf("%w: more than %d entries", ErrLimit, l.MaxFiles)
+	}
+	return nil
+}
+
+// reader counts the bytes read from source, sizes in the archive headers
+// are not trusted
+func (l *limiter) reader(source io.Reader) io.Reader {
+	return &limitedReader{source: source, limit: l}
+}
+
+type limitedReader struct {
+	source io.Reader
+	limit  *limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+	r.limit.bytes += int64(n)
+	if r.limit.MaxBytes > 0 && r.limit.bytes > r.limit.MaxBytes {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrLimit, r.limit.MaxBytes)
+	}
+	return n, err
+}
+
+// Extract unpacks archive_path into target_folder and returns the files
+// written. Folders are created with dir_mode. Entries other than regular
+// files and folders, e.g. symlinks, are skipped. Existing files are not
+// overwritten. On any error, e.g. an archive exceeding limits (ErrLimit),
+// the files already written are removed.
+func Extract(archive_path string, target_folder string, dir_mode fs.FileMode, limits Limits) ([]string, error) {
+	limit := &limiter{Limits: limits}
+	extracted, err := extract(archive_path, target_folder, dir_mode, limit)
+	if err != nil {
+		for _, file := range extracted {
+			os.Remove(file)
+		}
+		return nil, err
+	}
+	return extracted, nil
+}
+
+func extract(archive_path string, target_folder string, dir_mode fs.FileMode, limit *limiter) ([]string, error) {
+	kind := archiveKind(archive_path)
+	switch kind {
+	case ".zip":
+		return extractZip(archive_path, target_folder, dir_mode, limit)
+	case ".tar", ".tar.gz", ".tgz", ".tar.zst":
+		source, err := os.Open(archive_path)
+		if err != nil {
+			return nil, err
+		}
+		defer source.Close()
+		reader, close_reader, err := decompressReader(source, kind)
+		if err != nil {
+			return nil, err
+		}
+		defer close_reader()
+		return extractTar(reader, target_folder, dir_mode, limit)
+	case ".gz", ".zst":
+		source, err := os.Open(archive_path)
+		if err != nil {
+			return nil, err
+		}
+		defer source.Close()
+		reader, close_reader, err := decompressReader(source, kind)
+		if err != nil {
+			return nil, err
+		}
+		defer close_reader()
+		name := filepath.Base(archive_path)
+		output_file, err := safePath(target_folder, name[:len(name)-len(kind)])
+		if err != nil {
+			return nil, err
+		}
+		if err = writeFile(output_file, limit.reader(reader), 0666, dir_mode); err != nil {
+			return nil, err
+		}
+		return []string{output_file}, nil
+	}
+	return nil, fmt.Errorf("not an archive: %s", archive_path)
+}
+
+func extractZip(archive_path string, target_folder string, dir_mode fs.FileMode, limit *limiter) ([]string, error) {
+	zr, err := zip.OpenReader(archive_path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var extracted []string
+	for _, member := range zr.File {
+		if err = limit.entry(); err != nil {
+			return extracted, err
+		}
+		output_file, err := safePath(target_folder, member.Name)
+		if err != nil {
+			return extracted, err
+		}
+		mode := member.Mode()
+		if mode.IsDir() {
+			if err = os.MkdirAll(output_file, fs.ModeDir|dir_mode); err != nil {
+				return extracted, err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		reader, err := member.Open()
+		if err != nil {
+			return extracted, err
+		}
+		err = writeFile(output_file, limit.reader(reader), mode.Perm(), dir_mode)
+		reader.Close()
+		if err != nil {
+			return extracted, err
+		}
+		extracted = append(extracted, output_file)
+	}
+	return extracted, nil
+}
+
+func extractTar(source io.Reader, target_folder string, dir_mode fs.FileMode, limit *limiter) ([]string, error) {
+	tr := tar.NewReader(source)
+	var extracted []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return extracted, nil
+		}
+		if err != nil {
+			return extracted, err
+		}
+		if err = limit.entry(); err != nil {
+			return extracted, err
+		}
+		output_file, err := safePath(target_folder, header.Name)
+		if err != nil {
+			return extracted, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(output_file, fs.ModeDir|dir_mode); err != nil {
+				return extracted, err
+			}
+		case tar.TypeReg:
+			if err = writeFile(output_file, limit.reader(tr), fs.FileMode(header.Mode).Perm(), dir_mode); err != nil {
+				return extracted, err
+			}
+			extracted = append(extracted, output_file)
+		}
+	}
+}
+
+func writeFile(output_file string, reader io.Reader, mode fs.FileMode, dir_mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(output_file), fs.ModeDir|dir_mode); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(output_file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists, not overwritten", output_file)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, reader)
+	close_err := out.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(output_file)
+	}
+	return err
+}
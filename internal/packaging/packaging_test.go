@@ -0,0 +1,223 @@
+package packaging
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// member is an entry of a test archive, a symlink when link is set
+type member struct {
+	name string
+	body string
+	link string
+}
+
+func zipArchive(t *testing.T, path string, members []member) {
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, m := range members {
+		header := &zip.FileHeader{Name: m.name, Method: zip.Deflate}
+		body := m.body
+		if m.link != "" {
+			header.SetMode(fs.ModeSymlink | 0777)
+			body = m.link
+		}
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(body))
+	}
+	zw.Close()
+	if err := os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tarGzArchive(t *testing.T, path string, members []member) {
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for _, m := range members {
+		header := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.body)), Typeflag: tar.TypeReg}
+		if m.link != "" {
+			header = &tar.Header{Name: m.name, Mode: 0777, Linkname: m.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(m.body))
+	}
+	tw.Close()
+	gw.Close()
+	if err := os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gzFile(t *testing.T, path string, body string) {
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	gw.Write([]byte(body))
+	gw.Close()
+	if err := os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// files returns the files under folder, relative to it
+func files(t *testing.T, folder string) []string {
+	found := []string{}
+	filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			relative, _ := filepath.Rel(folder, path)
+			found = append(found, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	sort.Strings(found)
+	return found
+}
+
+// newTarget returns an empty target folder inside a folder nothing else is
+// written to, so an entry escaping the target is found
+func newTarget(t *testing.T) (string, string) {
+	root := t.TempDir()
+	target := filepath.Join(root, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root, target
+}
+
+func TestExtractRejectsUnsafeNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		members []member
+	}{
+		{"zip parent", ".zip", []member{{name: "../evil.txt", body: "x"}}},
+		{"zip nested parent", ".zip", []member{{name: "a/../../evil.txt", body: "x"}}},
+		{"zip absolute", ".zip", []member{{name: "/evil.txt", body: "x"}}},
+		{"zip after good files", ".zip", []member{{name: "good.txt", body: "x"}, {name: "sub/good.txt", body: "x"}, {name: "../evil.txt", body: "x"}}},
+		{"tar parent", ".tar.gz", []member{{name: "../evil.txt", body: "x"}}},
+		{"tar absolute", ".tar.gz", []member{{name: "/evil.txt", body: "x"}}},
+		{"tar after good files", ".tar.gz", []member{{name: "good.txt", body: "x"}, {name: "../../evil.txt", body: "x"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, target := newTarget(t)
+			archive := filepath.Join(root, "archive"+test.kind)
+			if test.kind == ".zip" {
+				zipArchive(t, archive, test.members)
+			} else {
+				tarGzArchive(t, archive, test.members)
+			}
+			extracted, err := Extract(archive, target, 0755, Limits{})
+			if err == nil {
+				t.Fatalf("unsafe archive extracted: %v", extracted)
+			}
+			if len(extracted) != 0 || len(files(t, target)) != 0 {
+				t.Fatalf("files left in the target: %v", files(t, target))
+			}
+			if found := files(t, root); len(found) != 1 || found[0] != "archive"+test.kind {
+				t.Fatalf("files written outside the target: %v", found)
+			}
+		})
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	bomb := strings.Repeat("\x00", 5<<20)
+	tests := []struct {
+		name   string
+		write  func(t *testing.T, path string)
+		kind   string
+		limits Limits
+	}{
+		{"zip bomb", func(t *testing.T, path string) { zipArchive(t, path, []member{{name: "zero", body: bomb}}) }, ".zip", Limits{MaxBytes: 1 << 20}},
+		{"zip bomb spread over entries", func(t *testing.T, path string) {
+			zipArchive(t, path, []member{{name: "a", body: bomb[:800<<10]}, {name: "b", body: bomb[:800<<10]}})
+		}, ".zip", Limits{MaxBytes: 1 << 20}},
+		{"tar.gz bomb", func(t *testing.T, path string) { tarGzArchive(t, path, []member{{name: "zero", body: bomb}}) }, ".tar.gz", Limits{MaxBytes: 1 << 20}},
+		{"gz bomb", func(t *testing.T, path string) { gzFile(t, path, bomb) }, ".gz", Limits{MaxBytes: 1 << 20}},
+		{"zip entries", func(t *testing.T, path string) {
+			zipArchive(t, path, []member{{name: "a", body: "x"}, {name: "b", body: "x"}, {name: "c", body: "x"}})
+		}, ".zip", Limits{MaxFiles: 2}},
+		{"tar entries", func(t *testing.T, path string) {
+			tarGzArchive(t, path, []member{{name: "a", body: "x"}, {name: "b", body: "x"}, {name: "c", body: "x"}})
+		}, ".tar.gz", Limits{MaxFiles: 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, target := newTarget(t)
+			archive := filepath.Join(root, "archive"+test.kind)
+			test.write(t, archive)
+			_, err := Extract(archive, target, 0755, test.limits)
+			if !errors.Is(err, ErrLimit) {
+				t.Fatalf("got %v, expecting ErrLimit", err)
+			}
+			if found := files(t, target); len(found) != 0 {
+				t.Fatalf("files left in the target: %v", found)
+			}
+
+			// within larger limits the same archive is extracted
+			extracted, err := Extract(archive, target, 0755, Limits{MaxBytes: 10 << 20, MaxFiles: 10})
+			if err != nil || len(extracted) == 0 {
+				t.Fatalf("%d files extracted: %v", len(extracted), err)
+			}
+		})
+	}
+}
+
+func TestExtractSkipsSymlinks(t *testing.T) {
+	for _, kind := range []string{".zip", ".tar.gz"} {
+		t.Run(kind, func(t *testing.T) {
+			root, target := newTarget(t)
+			archive := filepath.Join(root, "archive"+kind)
+			members := []member{{name: "passwd", link: "/etc/passwd"}, {name: "data.csv", body: "a,b\n"}}
+			if kind == ".zip" {
+				zipArchive(t, archive, members)
+			} else {
+				tarGzArchive(t, archive, members)
+			}
+			extracted, err := Extract(archive, target, 0755, Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(extracted) != 1 || filepath.Base(extracted[0]) != "data.csv" {
+				t.Fatalf("extracted %v", extracted)
+			}
+			if _, err := os.Lstat(filepath.Join(target, "passwd")); err == nil {
+				t.Fatal("symlink extracted")
+			}
+		})
+	}
+}
+
+func TestExtractDoesNotOverwrite(t *testing.T) {
+	root, target := newTarget(t)
+	delivered := filepath.Join(target, "report.csv")
+	os.WriteFile(delivered, []byte("delivered"), 0644)
+	archive := filepath.Join(root, "archive.zip")
+	zipArchive(t, archive, []member{{name: "other.csv", body: "x"}, {name: "report.csv", body: "replaced"}})
+
+	if _, err := Extract(archive, target, 0755, Limits{}); err == nil {
+		t.Fatal("existing file overwritten")
+	}
+	if data, _ := os.ReadFile(delivered); string(data) != "delivered" {
+		t.Fatalf("existing file changed: %q", data)
+	}
+	if found := files(t, target); len(found) != 1 || found[0] != "report.csv" {
+		t.Fatalf("files left in the target: %v", found)
+	}
+}
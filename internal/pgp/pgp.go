@@ -0,0 +1,284 @@
+package pgp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/iambighead/ugoku/internal/config"
+)
+
+// Keys holds the keys a job needs, loaded once when the job starts
+type Keys struct {
+	config.PgpConfig
+	public_keys openpgp.EntityList
+	secret_keys openpgp.EntityList
+	recipients  openpgp.EntityList
+	signer      *openpgp.Entity
+}
+
+func readKeyring(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+func readPassphrase(cfg config.PgpConfig) ([]byte, error) {
+	if cfg.Passphrase != "" {
+		return []byte(cfg.Passphrase), nil
+	}
+	if cfg.PassphraseEnv != "" {
+		value, ok := os.LookupEnv(cfg.PassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("passphrase env %s is not set", cfg.PassphraseEnv)
+		}
+		return []byte(value), nil
+	}
+	if cfg.PassphraseFile != "" {
+		data, err := os.ReadFile(cfg.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+func unlock(entities openpgp.EntityList, passphrase []byte) error {
+	for _, entity := range entities {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			if passphrase == nil {
+				return errors.New("secret key is protected, passphraseenv or passphrasefile is required")
+			}
+			if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+				return err
+			}
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchRecipient(entity *openpgp.Entity, recipient string) bool {
+	recipient = strings.ToLower(recipient)
+	for name := range entity.Identities {
+		if strings.Contains(strings.ToLower(name), recipient) {
+			return true
+		}
+	}
+	recipient = strings.ReplaceAll(strings.TrimPrefix(recipient, "0x"), " ", "")
+	fingerprint := strings.ToLower(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]))
+	return len(recipient) >= 8 && strings.HasSuffix(fingerprint, recipient)
+}
+
+// Load reads the keyrings of a job. With no pgp option enabled it returns nil.
+func Load(cfg config.PgpConfig) (*Keys, error) {
+	if !cfg.Encrypt && !cfg.Sign && !cfg.Decrypt && !cfg.Verify {
+		return nil, nil
+	}
+	keys := &Keys{PgpConfig: cfg}
+
+	var err error
+	if cfg.PublicKeyring != "" {
+		if keys.public_keys, err = readKeyring(cfg.PublicKeyring); err != nil {
+			return nil, fmt.Errorf("public keyring %s: %v", cfg.PublicKeyring, err)
+		}
+	}
+	if cfg.SecretKeyring != "" {
+		if keys.secret_keys, err = readKeyring(cfg.SecretKeyring); err != nil {
+			return nil, fmt.Errorf("secret keyring %s: %v", cfg.SecretKeyring, err)
+		}
+		passphrase, err := readPassphrase(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err = unlock(keys.secret_keys, passphrase); err != nil {
+			return nil, fmt.Errorf("secret keyring %s: %v", cfg.SecretKeyring, err)
+		}
+	}
+
+	if cfg.Encrypt {
+		if len(cfg.Recipients) == 0 {
+			keys.recipients = keys.public_keys
+		}
+		for _, recipient := range cfg.Recipients {
+			found := false
+			for _, entity := range keys.public_keys {
+				if matchRecipient(entity, recipient) {
+					keys.recipients = append(keys.recipients, entity)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("recipient %s not found in %s", recipient, cfg.PublicKeyring)
+			}
+		}
+		if len(keys.recipients) == 0 {
+			return nil, fmt.Errorf("no recipient key in %s", cfg.PublicKeyring)
+		}
+	}
+
+	if cfg.Sign {
+		for _, entity := range keys.secret_keys {
+			if entity.PrivateKey != nil {
+				keys.signer = entity
+				break
+			}
+		}
+		if keys.signer == nil {
+			return nil, fmt.Errorf("no signing key in %s", cfg.SecretKeyring)
+		}
+	}
+	return keys, nil
+}
+
+// --------------------------------
+
+// Extension is appended to the name of an encrypted file
+func (keys *Keys) Extension() string {
+	if keys == nil || !keys.Encrypt {
+		return ""
+	}
+	if keys.Armor {
+		return ".asc"
+	}
+	return ".pgp"
+}
+
+// StripExtension removes the usual encrypted file extensions from a name
+func StripExtension(name string) string {
+	lower := strings.ToLower(name)
+	for _, suffix := range []string{".pgp", ".gpg", ".asc"} {
+		if strings.HasSuffix(lower, suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return name
+}
+
+// EncryptReader returns the encrypted, and optionally signed, stream of source.
+// Closing the returned reader stops the encryption.
+func (keys *Keys) EncryptReader(source io.Reader, name string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(keys.encrypt(pw, source, name))
+	}()
+	return pr
+}
+
+func (keys *Keys) encrypt(out io.Writer, source io.Reader, name string) error {
+	var armored io.WriteCloser
+	if keys.Armor {
+		var err error
+		armored, err = armor.Encode(out, "PGP MESSAGE", nil)
+		if err != nil {
+			return err
+		}
+		out = armored
+	}
+
+	var signer *openpgp.Entity
+	if keys.Sign {
+		signer = keys.signer
+	}
+	plaintext, err := openpgp.Encrypt(out, keys.recipients, signer, &openpgp.FileHints{IsBinary: true, FileName: filepath.Base(name)}, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(plaintext, source); err != nil {
+		return err
+	}
+	if err = plaintext.Close(); err != nil {
+		return err
+	}
+	if armored != nil {
+		return armored.Close()
+	}
+	return nil
+}
+
+// DecryptFile decrypts input into output. With Verify set, the message must
+// carry a valid signature from a key in the public keyring. On error the
+// output file is removed.
+func (keys *Keys) DecryptFile(input string, output string) error {
+	err := keys.decryptFile(input, output)
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
+
+func (keys *Keys) decryptFile(input string, output string) error {
+	source, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var reader io.Reader = source
+	header := make([]byte, 64)
+	n, _ := io.ReadFull(source, header)
+	if _, err = source.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if bytes.Contains(header[:n], []byte("-----BEGIN PGP")) {
+		block, err := armor.Decode(source)
+		if err != nil {
+			return err
+		}
+		reader = block.Body
+	}
+
+	keyring := append(openpgp.EntityList{}, keys.secret_keys...)
+	keyring = append(keyring, keys.public_keys...)
+	md, err := openpgp.ReadMessage(reader, keyring, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, md.UnverifiedBody)
+	close_err := out.Close()
+	if err != nil {
+		return err
+	}
+	if close_err != nil {
+		return close_err
+	}
+
+	// the signature can only be checked once the whole body was read
+	if md.IsSigned {
+		if md.SignedBy == nil {
+			if keys.Verify {
+				return pgperrors.ErrUnknownIssuer
+			}
+		} else if md.SignatureError != nil {
+			return md.SignatureError
+		}
+	} else if keys.Verify {
+		return errors.New("message is not signed")
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// prefixes of secret references, besides ${ENV_VAR}
+const (
+	FILE_PREFIX   = "file:"
+	SECRET_PREFIX = "secret:"
+)
+
+// Store holds secrets encrypted with AES-256-GCM, under a key derived from a
+// master key file, in a JSON file of name to base64 nonce and ciphertext
+type Store struct {
+	path    string
+	aead    cipher.AEAD
+	secrets map[string]string
+}
+
+type storeFile struct {
+	Secrets map[string]string `json:"secrets"`
+}
+
+// ReadMasterKey reads the master key file, with create a random key is
+// written if there is none yet
+func ReadMasterKey(key_path string, create bool) ([]byte, error) {
+	key, err := os.ReadFile(key_path)
+	if os.IsNotExist(err) && create {
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(key_path, key, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("%s: master key is shorter than 32 bytes", key_path)
+	}
+	return key, nil
+}
+
+// Open opens the store at store_path, which may not exist yet
+func Open(store_path string, master_key []byte) (*Store, error) {
+	mac := hmac.New(sha256.New, master_key)
+	mac.Write([]byte("ugoku secret store"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{path: store_path, aead: aead, secrets: make(map[string]string)}
+
+	data, err := os.ReadFile(store_path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var content storeFile
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("%s: %v", store_path, err)
+	}
+	if content.Secrets != nil {
+		store.secrets = content.Secrets
+	}
+	return store, nil
+}
+
+// Get decrypts a secret, the name is authenticated with it so a secret
+// cannot be passed off as another
+func (s *Store) Get(name string) (string, error) {
+	sealed, found := s.secrets[name]
+	if !found {
+		return "", fmt.Errorf("secret %s is not in %s", name, s.path)
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", fmt.Errorf("secret %s is corrupted", name)
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %s cannot be decrypted, wrong master key or modified store", name)
+	}
+	return string(plain), nil
+}
+
+// Set encrypts a secret and saves the store
+func (s *Store) Set(name string, value string) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	s.secrets[name] = base64.StdEncoding.EncodeToString(sealed)
+	return s.save()
+}
+
+// Delete removes a secret and saves the store
+func (s *Store) Delete(name string) error {
+	if _, found := s.secrets[name]; !found {
+		return fmt.Errorf("secret %s is not in %s", name, s.path)
+	}
+	delete(s.secrets, name)
+	return s.save()
+}
+
+// Names lists the secrets of the store in order
+func (s *Store) Names() []string {
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// save writes the store to a temp file renamed over the store, so it is
+// never left half written
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(storeFile{Secrets: s.secrets}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".secrets-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+var env_reference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Resolver resolves secret references in config values, the store is only
+// opened when a value refers to it
+type Resolver struct {
+	StorePath     string
+	MasterKeyFile string
+	store         *Store
+	store_err     error
+}
+
+// Resolve returns the value a reference points to: file:<path> is the
+// content of the file, secret:<name> a secret of the store, and every
+// ${ENV_VAR} is replaced by the environment variable. Other values are
+// returned as they are.
+func (r *Resolver) Resolve(value string) (string, error) {
+	if strings.HasPrefix(value, FILE_PREFIX) {
+		data, err := os.ReadFile(strings.TrimPrefix(value, FILE_PREFIX))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if strings.HasPrefix(value, SECRET_PREFIX) {
+		store, err := r.open()
+		if err != nil {
+			return "", err
+		}
+		return store.Get(strings.TrimPrefix(value, SECRET_PREFIX))
+	}
+	var missing []string
+	resolved := env_reference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := env_reference.FindStringSubmatch(reference)[1]
+		env_value, found := os.LookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return env_value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
+
+func (r *Resolver) open() (*Store, error) {
+	if r.store == nil && r.store_err == nil {
+		if r.MasterKeyFile == "" {
+			r.store_err = errors.New("no master key file to open the secret store")
+			return nil, r.store_err
+		}
+		key, err := ReadMasterKey(r.MasterKeyFile, false)
+		if err == nil {
+			r.store, err = Open(r.StorePath, key)
+		}
+		r.store_err = err
+	}
+	return r.store, r.store_err
+}
@@ -4,21 +4,72 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type callback func()
 
-func Handle(label string, cb callback) {
-	sigs := make(chan os.Signal, 1)
+type handler struct {
+	id    int
+	label string
+	cb    callback
+}
+
+var handlers_lock sync.Mutex
+var handlers []handler
+var last_id int
+var sigs chan os.Signal
+
+// Handle registers a callback to run on SIGINT/SIGTERM. All registered
+// callbacks run concurrently and the process exits once all of them returned,
+// so one job stopping quickly does not cut short the cleanup of another.
+// The returned func unregisters the callback, for a job which stopped.
+func Handle(label string, cb callback) func() {
+	handlers_lock.Lock()
+	defer handlers_lock.Unlock()
+
+	last_id++
+	id := last_id
+	handlers = append(handlers, handler{id: id, label: label, cb: cb})
+	unregister := func() {
+		handlers_lock.Lock()
+		defer handlers_lock.Unlock()
+		for i, h := range handlers {
+			if h.id == id {
+				handlers = append(handlers[:i], handlers[i+1:]...)
+				return
+			}
+		}
+	}
+	if sigs != nil {
+		return unregister
+	}
+
+	sigs = make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		sig := <-sigs
-		fmt.Printf("%s: signal received: %s\n", label, sig)
-		cb()
+
+		handlers_lock.Lock()
+		to_call := make([]handler, len(handlers))
+		copy(to_call, handlers)
+		handlers_lock.Unlock()
+
+		var wg sync.WaitGroup
+		for _, h := range to_call {
+			fmt.Printf("%s: signal received: %s\n", h.label, sig)
+			wg.Add(1)
+			go func(h handler) {
+				defer wg.Done()
+				h.cb()
+			}(h)
+		}
+		wg.Wait()
 		time.Sleep(1 * time.Second)
 		os.Exit(0)
 	}()
+	return unregister
 }
@@ -0,0 +1,178 @@
+package sla
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/cron"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/notify"
+)
+
+type expectation struct {
+	config.ExpectationConfig
+	schedule *cron.Schedule
+
+	// current period, zero until the schedule fires
+	period_start time.Time
+	deadline     time.Time
+	next_start   time.Time
+	count        int
+	satisfied    bool
+	breached     bool
+}
+
+type tracker struct {
+	job          string
+	kind         string
+	cfgs         []config.ExpectationConfig
+	expectations []*expectation
+	logger       logger.Logger
+}
+
+var lock sync.Mutex
+var trackers = make(map[string]*tracker)
+
+// Register sets up the expectations of a job. A job started again with the
+// same expectations keeps their state. Otherwise each starts from the latest
+// fire of its schedule whose deadline has not passed yet, counting the files
+// recorded in the history since.
+func Register(job string, kind string, cfgs []config.ExpectationConfig) error {
+	lock.Lock()
+	defer lock.Unlock()
+	if len(cfgs) == 0 {
+		delete(trackers, job)
+		return nil
+	}
+	if old, ok := trackers[job]; ok && reflect.DeepEqual(old.cfgs, cfgs) {
+		old.kind = kind
+		return nil
+	}
+	t := &tracker{job: job, kind: kind, cfgs: cfgs, logger: logger.NewJobLogger(fmt.Sprintf("sla[%s]", job), job, -1)}
+	now := time.Now()
+	for _, cfg := range cfgs {
+		schedule, err := cron.Parse(cfg.Schedule)
+		if err != nil {
+			return err
+		}
+		e := &expectation{ExpectationConfig: cfg, schedule: schedule, next_start: schedule.Next(now)}
+		e.resume(job, now)
+		t.expectations = append(t.expectations, e)
+	}
+	trackers[job] = t
+	return nil
+}
+
+// resume starts the period of the latest fire before now whose deadline has
+// not passed, with the files of the job recorded in the history since
+func (e *expectation) resume(job string, now time.Time) {
+	var latest time.Time
+	for fire := e.schedule.Next(now.Add(-e.Within)); !fire.IsZero() && !fire.After(now); fire = e.schedule.Next(fire) {
+		latest = fire
+	}
+	if latest.IsZero() {
+		return
+	}
+	e.period_start = latest
+	e.deadline = latest.Add(e.Within)
+	e.next_start = e.schedule.Next(latest)
+	entries, err := history.Recorded(history.Filter{Job: job, From: latest, Result: history.SUCCESS})
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if e.matches(fileName(entry.SourcePath), entry.Size) {
+			e.count++
+		}
+	}
+	e.satisfied = e.count >= e.MinCount
+}
+
+func (e *expectation) matches(name string, size int64) bool {
+	if size < e.MinSize {
+		return false
+	}
+	matched, _ := filepath.Match(e.Pattern, name)
+	return matched
+}
+
+// Unregister drops the expectations of a job no longer running
+func Unregister(job string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(trackers, job)
+}
+
+func fileName(file string) string {
+	return path.Base(strings.ReplaceAll(file, "\\", "/"))
+}
+
+func (e *expectation) describe() string {
+	return fmt.Sprintf("%d file(s) matching %s of at least %d bytes by %s, %d received", e.MinCount, e.Pattern, e.MinSize, e.deadline.Format("2006-01-02 15:04"), e.count)
+}
+
+// Transferred counts a successfully transferred file of a job towards its
+// expectations
+func Transferred(job string, source string, size int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	t, ok := trackers[job]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	t.check(now)
+	name := fileName(source)
+	for _, e := range t.expectations {
+		if e.period_start.IsZero() || e.satisfied || !e.matches(name, size) {
+			continue
+		}
+		e.count++
+		if e.count < e.MinCount {
+			continue
+		}
+		e.satisfied = true
+		if e.breached {
+			t.logger.Info(fmt.Sprintf("late arrival for %s: %s", e.Name, e.describe()))
+			notify.Send(notify.Event{Event: notify.SLA_LATE_ARRIVAL, Job: t.job, Kind: t.kind, Expectation: e.Name, Source: source, Size: size,
+				Error: fmt.Sprintf("%s late", now.Sub(e.deadline).Round(time.Second))})
+		}
+	}
+}
+
+// Check evaluates the expectations of a job, it is called by the scanners
+func Check(job string) {
+	lock.Lock()
+	defer lock.Unlock()
+	t, ok := trackers[job]
+	if !ok {
+		return
+	}
+	t.check(time.Now())
+}
+
+func (t *tracker) check(now time.Time) {
+	for _, e := range t.expectations {
+		if !e.next_start.IsZero() && !now.Before(e.next_start) {
+			e.period_start = e.next_start
+			e.deadline = e.period_start.Add(e.Within)
+			e.next_start = e.schedule.Next(e.period_start)
+			e.count = 0
+			e.satisfied = false
+			e.breached = false
+		}
+		if e.period_start.IsZero() || e.satisfied || e.breached || now.Before(e.deadline) {
+			continue
+		}
+		e.breached = true
+		t.logger.Error(fmt.Sprintf("sla breach for %s: %s", e.Name, e.describe()))
+		notify.Send(notify.Event{Event: notify.SLA_BREACH, Job: t.job, Kind: t.kind, Expectation: e.Name, Error: e.describe()})
+	}
+}
@@ -1,5 +1,10 @@
 package sleepytime
 
+import (
+	"math/rand"
+	"time"
+)
+
 type Sleepytime struct {
 	next_sleep int
 	max_sleep  int
@@ -20,3 +25,14 @@ func (sleeper *Sleepytime) GetNextSleep() int {
 	}
 	return sleeper.next_sleep
 }
+
+// Jitter returns seconds randomly spread by up to percent either way, so
+// jobs started together do not keep polling in lockstep
+func Jitter(seconds int, percent int) time.Duration {
+	sleep := time.Duration(seconds) * time.Second
+	if percent <= 0 {
+		return sleep
+	}
+	spread := float64(sleep) * float64(percent) / 100
+	return sleep + time.Duration((rand.Float64()*2-1)*spread)
+}
@@ -0,0 +1,87 @@
+package transform
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// cp1252 maps 0x80-0x9f, where windows-1252 differs from latin-1
+var cp1252 = [32]rune{
+	0x20ac, 0xfffd, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0xfffd, 0x017d, 0xfffd,
+	0xfffd, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0xfffd, 0x017e, 0x0178,
+}
+
+func normalizeCharset(name string) string {
+	name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+	switch name {
+	case "latin1", "latin-1", "iso-8859-1", "iso8859-1":
+		return "latin1"
+	case "windows-1252", "cp1252":
+		return "cp1252"
+	case "utf8", "utf-8":
+		return "utf8"
+	}
+	return name
+}
+
+func decodeByte(charset string, b byte) rune {
+	if charset == "cp1252" && b >= 0x80 && b < 0xa0 {
+		return cp1252[b-0x80]
+	}
+	return rune(b)
+}
+
+func encodeRune(charset string, r rune) byte {
+	if r < 0x80 || (r < 0x100 && (charset == "latin1" || r >= 0xa0)) {
+		return byte(r)
+	}
+	if charset == "cp1252" {
+		for idx, mapped := range cp1252 {
+			if mapped == r && r != 0xfffd {
+				return byte(0x80 + idx)
+			}
+		}
+	}
+	return '?'
+}
+
+// newCharsetReader converts between UTF-8 and the single byte latin-1 and
+// windows-1252 charsets. Characters with no equivalent become '?'.
+func newCharsetReader(source io.Reader, from string, to string) (io.Reader, error) {
+	from = normalizeCharset(from)
+	to = normalizeCharset(to)
+	single_byte := func(charset string) bool { return charset == "latin1" || charset == "cp1252" }
+	if !(from == "utf8" && single_byte(to)) && !(single_byte(from) && to == "utf8") {
+		return nil, fmt.Errorf("unsupported charset conversion %s to %s", from, to)
+	}
+
+	var out []byte
+	var partial []byte
+	return &converter{source: source, convert: func(input []byte, eof bool) []byte {
+		out = out[:0]
+		if from != "utf8" {
+			for _, b := range input {
+				out = utf8.AppendRune(out, decodeByte(from, b))
+			}
+			return out
+		}
+
+		// a multi byte character may be split across reads
+		data := append(partial, input...)
+		partial = nil
+		for len(data) > 0 {
+			if !eof && !utf8.FullRune(data) {
+				partial = append([]byte(nil), data...)
+				break
+			}
+			r, size := utf8.DecodeRune(data)
+			out = append(out, encodeRune(to, r))
+			data = data[size:]
+		}
+		return out
+	}}, nil
+}
@@ -0,0 +1,71 @@
+package transform
+
+import "io"
+
+// converter feeds chunks of the source through convert and serves the
+// converted bytes, which may be more or fewer than were read
+type converter struct {
+	source  io.Reader
+	convert func(input []byte, eof bool) []byte
+	buf     [32 * 1024]byte
+	pending []byte
+	err     error
+}
+
+func (reader *converter) Read(p []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		n, err := reader.source.Read(reader.buf[:])
+		reader.pending = reader.convert(reader.buf[:n], err == io.EOF)
+		reader.err = err
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+// newLfReader converts CRLF line endings to LF
+func newLfReader(source io.Reader) io.Reader {
+	pending_cr := false
+	var out []byte
+	return &converter{source: source, convert: func(input []byte, eof bool) []byte {
+		out = out[:0]
+		for _, b := range input {
+			if pending_cr {
+				pending_cr = false
+				if b != '\n' {
+					out = append(out, '\r')
+				}
+			}
+			if b == '\r' {
+				// hold back until we know if a LF follows
+				pending_cr = true
+				continue
+			}
+			out = append(out, b)
+		}
+		if eof && pending_cr {
+			out = append(out, '\r')
+		}
+		return out
+	}}
+}
+
+// newCrlfReader converts lone LF line endings to CRLF, existing CRLF are kept
+func newCrlfReader(source io.Reader) io.Reader {
+	prev_cr := false
+	var out []byte
+	return &converter{source: source, convert: func(input []byte, eof bool) []byte {
+		out = out[:0]
+		for _, b := range input {
+			if b == '\n' && !prev_cr {
+				out = append(out, '\r')
+			}
+			prev_cr = b == '\r'
+			out = append(out, b)
+		}
+		return out
+	}}
+}
@@ -0,0 +1,196 @@
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// stage is one step of the pipeline, reading the output of the previous
+// one. Close waits for the stage to finish and reports its error.
+type stage struct {
+	io.Reader
+	close func() error
+}
+
+// Pipeline is the transformed view of a source reader
+type Pipeline struct {
+	io.Reader
+	stages []stage
+}
+
+// Close waits for every stage, e.g. an external command to exit, and returns
+// their errors. A copy from the pipeline is only complete if Close returns
+// nil. Stages are closed from the last one, so an early Close unblocks the
+// stages feeding it.
+func (pipeline *Pipeline) Close() error {
+	var errs []error
+	for idx := len(pipeline.stages) - 1; idx >= 0; idx-- {
+		if pipeline.stages[idx].close != nil {
+			errs = append(errs, pipeline.stages[idx].close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the transform settings of a job
+func Validate(specs []config.TransformConfig) error {
+	for _, spec := range specs {
+		switch spec.Type {
+		case "gzip", "gunzip", "zstd", "unzstd", "crlf", "lf":
+		case "charset":
+			if _, err := newCharsetReader(nil, spec.From, spec.To); err != nil {
+				return err
+			}
+		case "command":
+			if len(spec.Command) == 0 {
+				return errors.New("transform command: command is empty")
+			}
+		default:
+			return fmt.Errorf("unknown transform type %q", spec.Type)
+		}
+	}
+	return nil
+}
+
+// Wrap chains the transforms in order on top of source. With no transforms
+// the source is returned as is. Cancelling ctx kills external commands.
+func Wrap(ctx context.Context, source io.Reader, specs []config.TransformConfig) (*Pipeline, error) {
+	pipeline := &Pipeline{Reader: source}
+	for _, spec := range specs {
+		next, err := newStage(ctx, pipeline.Reader, spec)
+		if err != nil {
+			pipeline.Close()
+			return nil, err
+		}
+		pipeline.stages = append(pipeline.stages, next)
+		pipeline.Reader = next.Reader
+	}
+	return pipeline, nil
+}
+
+func newStage(ctx context.Context, source io.Reader, spec config.TransformConfig) (stage, error) {
+	switch spec.Type {
+	case "gzip":
+		return gzipStage(source), nil
+	case "gunzip":
+		return gunzipStage(source), nil
+	case "zstd":
+		return zstdStage(source), nil
+	case "unzstd":
+		return unzstdStage(source)
+	case "crlf":
+		return stage{Reader: newCrlfReader(source)}, nil
+	case "lf":
+		return stage{Reader: newLfReader(source)}, nil
+	case "charset":
+		reader, err := newCharsetReader(source, spec.From, spec.To)
+		return stage{Reader: reader}, err
+	case "command":
+		return commandStage(ctx, source, spec.Command)
+	}
+	return stage{}, fmt.Errorf("unknown transform type %q", spec.Type)
+}
+
+// --------------------------------
+
+func gzipStage(source io.Reader) stage {
+	pr, pw := io.Pipe()
+	go func() {
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, source)
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return stage{Reader: pr, close: func() error { return pr.Close() }}
+}
+
+// gunzipStage opens the gzip stream on first read, so a slow source does not
+// block Wrap while the header is read
+type gunzipReader struct {
+	source io.Reader
+	gr     *gzip.Reader
+}
+
+func (reader *gunzipReader) Read(p []byte) (int, error) {
+	if reader.gr == nil {
+		gr, err := gzip.NewReader(reader.source)
+		if err != nil {
+			return 0, err
+		}
+		reader.gr = gr
+	}
+	return reader.gr.Read(p)
+}
+
+func gunzipStage(source io.Reader) stage {
+	reader := &gunzipReader{source: source}
+	return stage{Reader: reader, close: func() error {
+		if reader.gr != nil {
+			return reader.gr.Close()
+		}
+		return nil
+	}}
+}
+
+func zstdStage(source io.Reader) stage {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw)
+		if err == nil {
+			_, err = io.Copy(zw, source)
+			if err == nil {
+				err = zw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return stage{Reader: pr, close: func() error { return pr.Close() }}
+}
+
+func unzstdStage(source io.Reader) (stage, error) {
+	zr, err := zstd.NewReader(source)
+	if err != nil {
+		return stage{}, err
+	}
+	return stage{Reader: zr, close: func() error {
+		zr.Close()
+		return nil
+	}}, nil
+}
+
+// --------------------------------
+
+func commandStage(ctx context.Context, source io.Reader, command []string) (stage, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = source
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return stage{}, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return stage{}, fmt.Errorf("transform command %s: %v", command[0], err)
+	}
+	return stage{Reader: stdout, close: func() error {
+		// a command still writing gets EPIPE instead of blocking Wait forever
+		stdout.Close()
+		err := cmd.Wait()
+		if err != nil {
+			return fmt.Errorf("transform command %s: %v: %s", command[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}}, nil
+}
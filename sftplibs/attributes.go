@@ -0,0 +1,169 @@
+package sftplibs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/pkg/sftp"
+)
+
+const default_local_dir_mode = 0764
+
+// FileAttrs is the part of a source file's metadata which can be carried
+// over to the file created on the other side
+type FileAttrs struct {
+	Mode     fs.FileMode
+	Mtime    time.Time
+	Atime    time.Time
+	Uid      int
+	Gid      int
+	HasOwner bool
+}
+
+// RemoteAttrs reads the attributes of a file stat'ed over sftp
+func RemoteAttrs(stat fs.FileInfo) FileAttrs {
+	attrs := FileAttrs{Mode: stat.Mode().Perm(), Mtime: stat.ModTime(), Atime: stat.ModTime()}
+	if sftp_stat, ok := stat.Sys().(*sftp.FileStat); ok {
+		attrs.Atime = time.Unix(int64(sftp_stat.Atime), 0)
+		attrs.Uid = int(sftp_stat.UID)
+		attrs.Gid = int(sftp_stat.GID)
+		attrs.HasOwner = true
+	}
+	return attrs
+}
+
+// LocalAttrs reads the attributes of a local file
+func LocalAttrs(stat fs.FileInfo) FileAttrs {
+	attrs := FileAttrs{Mode: stat.Mode().Perm(), Mtime: stat.ModTime(), Atime: stat.ModTime()}
+	fillLocalAttrs(stat, &attrs)
+	return attrs
+}
+
+func mapId(id int, id_map map[int]int) int {
+	if mapped, ok := id_map[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+// fileMode returns the mode to set on a created file, and false if the
+// default mode from the receiving side should be kept
+func fileMode(attrs FileAttrs, cfg config.AttributesConfig) (fs.FileMode, bool) {
+	if cfg.PreserveMode {
+		return attrs.Mode &^ cfg.UmaskBit, true
+	}
+	if cfg.FilePerm != 0 {
+		return cfg.FilePerm &^ cfg.UmaskBit, true
+	}
+	if cfg.UmaskBit != 0 {
+		return 0666 &^ cfg.UmaskBit, true
+	}
+	return 0, false
+}
+
+// dirMode returns the mode to set on a created folder, and false if the
+// default mode from the receiving side should be kept
+func dirMode(cfg config.AttributesConfig) (fs.FileMode, bool) {
+	if cfg.DirPerm != 0 {
+		return cfg.DirPerm &^ cfg.UmaskBit, true
+	}
+	if cfg.UmaskBit != 0 {
+		return 0777 &^ cfg.UmaskBit, true
+	}
+	return 0, false
+}
+
+// LocalDirMode is the mode for folders created locally
+func LocalDirMode(cfg config.AttributesConfig) fs.FileMode {
+	if mode, ok := dirMode(cfg); ok {
+		return mode
+	}
+	return default_local_dir_mode
+}
+
+// MkdirAllLocal creates the local folder and its parents, with the
+// configured folder mode
+func MkdirAllLocal(folder string, cfg config.AttributesConfig) error {
+	mode := LocalDirMode(cfg)
+	err := os.MkdirAll(folder, fs.ModeDir|mode)
+	if err != nil {
+		return err
+	}
+	if _, ok := dirMode(cfg); ok {
+		// MkdirAll is subject to the process umask, set the mode explicitly
+		return os.Chmod(folder, mode)
+	}
+	return nil
+}
+
+// MkdirAllRemote creates the remote folder and its parents, applying the
+// configured folder mode to the folders it created
+func MkdirAllRemote(client *sftp.Client, folder string, cfg config.AttributesConfig) error {
+	mode, set_mode := dirMode(cfg)
+	if !set_mode {
+		return client.MkdirAll(folder)
+	}
+
+	stat, err := client.Stat(folder)
+	if err == nil {
+		if !stat.IsDir() {
+			return errors.New("not a directory: " + folder)
+		}
+		return nil
+	}
+
+	parent := path.Dir(folder)
+	if parent != folder && parent != "." && parent != "/" {
+		err = MkdirAllRemote(client, parent, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mkdir(folder)
+	if err != nil {
+		// might have been created by another worker meanwhile
+		stat, staterr := client.Stat(folder)
+		if staterr == nil && stat.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return client.Chmod(folder, mode)
+}
+
+// ApplyLocalAttrs sets mode, times and owner of a local file according to
+// the job config. Errors are collected so one failure does not stop the rest.
+func ApplyLocalAttrs(file string, attrs FileAttrs, cfg config.AttributesConfig) error {
+	var errs []error
+	if mode, ok := fileMode(attrs, cfg); ok {
+		errs = append(errs, os.Chmod(file, mode))
+	}
+	if cfg.PreserveOwner && attrs.HasOwner && os.Geteuid() == 0 {
+		errs = append(errs, os.Lchown(file, mapId(attrs.Uid, cfg.UidMap), mapId(attrs.Gid, cfg.GidMap)))
+	}
+	if cfg.PreserveTimes {
+		errs = append(errs, os.Chtimes(file, attrs.Atime, attrs.Mtime))
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyRemoteAttrs sets mode, times and owner of a remote file according to
+// the job config. Changing the owner usually needs the remote user to be root.
+func ApplyRemoteAttrs(client *sftp.Client, file string, attrs FileAttrs, cfg config.AttributesConfig) error {
+	var errs []error
+	if mode, ok := fileMode(attrs, cfg); ok {
+		errs = append(errs, client.Chmod(file, mode))
+	}
+	if cfg.PreserveOwner && attrs.HasOwner {
+		errs = append(errs, client.Chown(file, mapId(attrs.Uid, cfg.UidMap), mapId(attrs.Gid, cfg.GidMap)))
+	}
+	if cfg.PreserveTimes {
+		errs = append(errs, client.Chtimes(file, attrs.Atime, attrs.Mtime))
+	}
+	return errors.Join(errs...)
+}
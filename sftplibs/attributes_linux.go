@@ -0,0 +1,18 @@
+package sftplibs
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+func fillLocalAttrs(stat fs.FileInfo, attrs *FileAttrs) {
+	sys_stat, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	attrs.Atime = time.Unix(sys_stat.Atim.Unix())
+	attrs.Uid = int(sys_stat.Uid)
+	attrs.Gid = int(sys_stat.Gid)
+	attrs.HasOwner = true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package sftplibs
+
+import "io/fs"
+
+// access time and owner are only read on linux, elsewhere
+// the modified time is used for both times and no owner is set
+func fillLocalAttrs(stat fs.FileInfo, attrs *FileAttrs) {
+}
@@ -33,3 +33,14 @@ func CopyWithCancel(ctx context.Context, dst io.Writer, src io.Reader) (int64, e
 	}))
 	return nBytes, err
 }
+
+// CloseOnCancel closes the given files once ctx is done, which unblocks a
+// copy stuck in a read or write on a stalled connection. Call the returned
+// func after the copy to release it.
+func CloseOnCancel(ctx context.Context, closers ...io.Closer) func() bool {
+	return context.AfterFunc(ctx, func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package sftplibs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteCommandData is what the remote command templates can refer to. The
+// values are single quoted for the remote shell when the command is rendered.
+type RemoteCommandData struct {
+	Job    string
+	Source string
+	Target string
+	File   string
+	Size   int64
+}
+
+type RemoteCommands struct {
+	config.RemoteCommandsConfig
+	before *template.Template
+	after  *template.Template
+	logger logger.Logger
+}
+
+// NewRemoteCommands parses the remote command templates of a job, it returns
+// nil when none is configured. All methods are safe to call on nil.
+func NewRemoteCommands(cfg config.RemoteCommandsConfig, job string) (*RemoteCommands, error) {
+	if cfg.Before == "" && cfg.After == "" {
+		return nil, nil
+	}
+	remote := &RemoteCommands{RemoteCommandsConfig: cfg, logger: logger.NewJobLogger(fmt.Sprintf("remote-command[%s]", job), job, -1)}
+	var err error
+	if cfg.Before != "" {
+		if remote.before, err = template.New("before").Option("missingkey=error").Parse(cfg.Before); err != nil {
+			return nil, fmt.Errorf("before: %v", err)
+		}
+	}
+	if cfg.After != "" {
+		if remote.after, err = template.New("after").Option("missingkey=error").Parse(cfg.After); err != nil {
+			return nil, fmt.Errorf("after: %v", err)
+		}
+	}
+	// catch unknown fields now rather than on the first transfer
+	for _, tmpl := range []*template.Template{remote.before, remote.after} {
+		if tmpl == nil {
+			continue
+		}
+		if _, err = render(tmpl, RemoteCommandData{Job: job, Target: "file"}); err != nil {
+			return nil, err
+		}
+	}
+	return remote, nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func render(tmpl *template.Template, data RemoteCommandData) (string, error) {
+	if data.File == "" {
+		data.File = path.Base(strings.ReplaceAll(data.Target, "\\", "/"))
+	}
+	quoted := struct {
+		Job, Source, Target, File string
+		Size                      int64
+	}{shellQuote(data.Job), shellQuote(data.Source), shellQuote(data.Target), shellQuote(data.File), data.Size}
+	var command bytes.Buffer
+	if err := tmpl.Execute(&command, quoted); err != nil {
+		return "", err
+	}
+	return command.String(), nil
+}
+
+// RunRemoteCommand runs a command in a new session of the ssh client. The
+// session is killed when ctx is done.
+func RunRemoteCommand(ctx context.Context, client *ssh.Client, command string) (string, string, error) {
+	if client == nil {
+		return "", "", fmt.Errorf("not connected")
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err = session.Start(command); err != nil {
+		return "", "", err
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- session.Wait()
+	}()
+	select {
+	case err = <-finished:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		// the output is copied into the buffers until Wait returned
+		<-finished
+		err = ctx.Err()
+	}
+	return stdout.String(), stderr.String(), err
+}
+
+func (remote *RemoteCommands) run(label string, tmpl *template.Template, client *ssh.Client, data RemoteCommandData) error {
+	if remote == nil || tmpl == nil || dryrun.Enabled() {
+		return nil
+	}
+	command, err := render(tmpl, data)
+	if err != nil {
+		return fmt.Errorf("%s command template: %v", label, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(remote.Timeout)*time.Second)
+	defer cancel()
+	remote.logger.Debug(fmt.Sprintf("running %s command: %s", label, command))
+	stdout, stderr, err := RunRemoteCommand(ctx, client, command)
+	if out := strings.TrimSpace(stdout); out != "" {
+		remote.logger.Info(fmt.Sprintf("%s command stdout: %s", label, out))
+	}
+	if out := strings.TrimSpace(stderr); out != "" {
+		remote.logger.Info(fmt.Sprintf("%s command stderr: %s", label, out))
+	}
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("%s command timed out after %d seconds", label, remote.Timeout)
+	} else if err != nil {
+		err = fmt.Errorf("%s command failed: %v", label, err)
+	}
+	if err != nil {
+		remote.logger.Error(err.Error())
+	}
+	return err
+}
+
+// Before runs the before command, an error means the file must be skipped
+func (remote *RemoteCommands) Before(client *ssh.Client, data RemoteCommandData) error {
+	if remote == nil {
+		return nil
+	}
+	return remote.run("before", remote.before, client, data)
+}
+
+// After runs the after command, an error means the transfer must be treated
+// as failed
+func (remote *RemoteCommands) After(client *ssh.Client, data RemoteCommandData) error {
+	if remote == nil {
+		return nil
+	}
+	return remote.run("after", remote.after, client, data)
+}
@@ -25,13 +25,21 @@ func IncrTempIndex() {
 	}
 }
 
-func getConfigForCertLogin(user string, keyfile string, certfile string) (*ssh.ClientConfig, error) {
+// parsePrivateKey parses a private key, encrypted when a passphrase is given
+func parsePrivateKey(key []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(key)
+}
+
+func getConfigForCertLogin(user string, keyfile string, certfile string, passphrase string) (*ssh.ClientConfig, error) {
 	pvtKeyBts, err := os.ReadFile(keyfile)
 	if err != nil {
 		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(pvtKeyBts)
+	signer, err := parsePrivateKey(pvtKeyBts, passphrase)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +72,7 @@ func getConfigForCertLogin(user string, keyfile string, certfile string) (*ssh.C
 	return config, nil
 }
 
-func getConfigForKeyLogin(user string, keyfile string) (*ssh.ClientConfig, error) {
+func getConfigForKeyLogin(user string, keyfile string, passphrase string) (*ssh.ClientConfig, error) {
 	// fmt.Printf("connect using key file: %s\n", keyfile)
 	// var hostKey ssh.PublicKey
 	key, err := os.ReadFile(keyfile)
@@ -73,7 +81,7 @@ func getConfigForKeyLogin(user string, keyfile string) (*ssh.ClientConfig, error
 	}
 
 	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
+	signer, err := parsePrivateKey(key, passphrase)
 	if err != nil {
 		return nil, err
 	}
@@ -100,18 +108,18 @@ func getConfigForPasswordLogin(user string, password string) (*ssh.ClientConfig,
 	return config, nil
 }
 
-func ConnectSftpServer(host_ip string, host_port int, user string, password string, keyfile string, certfile string) (*ssh.Client, *sftp.Client, error) {
+func ConnectSftpServer(host_ip string, host_port int, user string, password string, keyfile string, certfile string, key_passphrase string) (*ssh.Client, *sftp.Client, error) {
 
 	var config *ssh.ClientConfig
 
 	if keyfile != "" && certfile != "" {
-		tmp_config, err := getConfigForCertLogin(user, keyfile, certfile)
+		tmp_config, err := getConfigForCertLogin(user, keyfile, certfile, key_passphrase)
 		if err != nil {
 			return nil, nil, err
 		}
 		config = tmp_config
 	} else if keyfile != "" {
-		tmp_config, err := getConfigForKeyLogin(user, keyfile)
+		tmp_config, err := getConfigForKeyLogin(user, keyfile, key_passphrase)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -0,0 +1,50 @@
+package sftplibs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TransferGuard ties the transfers of a worker to its lifetime, so Stop can
+// cancel an in-flight copy and wait for it to clean up its partial target
+// before the connections are closed.
+type TransferGuard struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+}
+
+func NewTransferGuard() *TransferGuard {
+	guard := new(TransferGuard)
+	guard.ctx, guard.cancel = context.WithCancel(context.Background())
+	return guard
+}
+
+// Begin marks the start of a transfer and returns its context, which is done
+// on timeout or when the guard is stopped. The returned func must be called
+// once the transfer and its cleanup are finished.
+func (guard *TransferGuard) Begin(timeout_seconds int64) (context.Context, func()) {
+	guard.lock.Lock()
+	ctx, cancel := context.WithTimeout(guard.ctx, time.Duration(timeout_seconds)*time.Second)
+	return ctx, func() {
+		cancel()
+		guard.lock.Unlock()
+	}
+}
+
+// Stop cancels the in-flight transfer, if any, and waits up to max_wait for it
+// to finish
+func (guard *TransferGuard) Stop(max_wait time.Duration) {
+	guard.cancel()
+	idle := make(chan struct{})
+	go func() {
+		guard.lock.Lock()
+		guard.lock.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-time.After(max_wait):
+	}
+}
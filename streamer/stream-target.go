@@ -0,0 +1,115 @@
+package streamer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/sftplibs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// minimum wait before trying again to connect a target which dropped out
+const target_reconnect_interval = 60 * time.Second
+
+// --------------------------------
+
+type streamTarget struct {
+	config.StreamTargetConfig
+	sftp_client  *sftp.Client
+	ssh_client   *ssh.Client
+	last_attempt time.Time
+}
+
+func (target *streamTarget) connect(streamer_logger logger.Logger) error {
+	target.last_attempt = time.Now()
+	streamer_logger.Debug(fmt.Sprintf("connecting to target server %s with user %s", target.TargetServer.Ip, target.TargetServer.User))
+	ssh_client, sftp_client, err := sftplibs.ConnectSftpServer(
+		target.TargetServer.Ip,
+		target.TargetServer.Port,
+		target.TargetServer.User,
+		target.TargetServer.Password,
+		target.TargetServer.KeyFile,
+		target.TargetServer.CertFile,
+		target.TargetServer.KeyPassphrase)
+	if err != nil {
+		return err
+	}
+	streamer_logger.Info(fmt.Sprintf("connected to target server %s with user %s", target.TargetServer.Ip, target.TargetServer.User))
+	target.ssh_client = ssh_client
+	target.sftp_client = sftp_client
+	return nil
+}
+
+func (target *streamTarget) connected() bool {
+	return target.sftp_client != nil
+}
+
+func (target *streamTarget) close() {
+	if target.sftp_client != nil {
+		target.sftp_client.Close()
+		target.sftp_client = nil
+	}
+	if target.ssh_client != nil {
+		target.ssh_client.Close()
+		target.ssh_client = nil
+	}
+}
+
+func (target *streamTarget) outputFile(source_path string, file_to_download string, extension string) string {
+	upload_source_relative_path := strings.Replace(file_to_download, source_path, "", 1)
+	output_file := filepath.Join(target.TargetPath, upload_source_relative_path) + extension
+	return strings.ReplaceAll(output_file, "\\", "/")
+}
+
+// --------------------------------
+
+// fanOut writes every chunk to all targets concurrently. A target which
+// fails is dropped and the write carries on with the others, unless fewer
+// than required targets are left.
+type fanOut struct {
+	writers  []io.Writer
+	errs     []error
+	required int
+}
+
+func newFanOut(writers []io.Writer, required int) *fanOut {
+	return &fanOut{writers: writers, errs: make([]error, len(writers)), required: required}
+}
+
+func (fan *fanOut) Write(p []byte) (int, error) {
+	var wg sync.WaitGroup
+	for idx, writer := range fan.writers {
+		if fan.errs[idx] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, writer io.Writer) {
+			defer wg.Done()
+			n, err := writer.Write(p)
+			if err == nil && n < len(p) {
+				err = io.ErrShortWrite
+			}
+			fan.errs[idx] = err
+		}(idx, writer)
+	}
+	wg.Wait()
+
+	alive := 0
+	for _, err := range fan.errs {
+		if err == nil {
+			alive++
+		}
+	}
+	if alive < fan.required {
+		return 0, errors.Join(append([]error{fmt.Errorf("only %d target(s) left, %d required", alive, fan.required)}, fan.errs...)...)
+	}
+	return len(p), nil
+}
@@ -1,18 +1,30 @@
 package streamer
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/downloader"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/notify"
+	"github.com/iambighead/ugoku/internal/pgp"
 	siginthandler "github.com/iambighead/ugoku/internal/sigintHandler"
+	"github.com/iambighead/ugoku/internal/sla"
 	"github.com/iambighead/ugoku/internal/sleepytime"
+	"github.com/iambighead/ugoku/internal/transform"
 	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -45,9 +57,15 @@ type SftpStreamer struct {
 	logger             logger.Logger
 	sftp_client_source *sftp.Client
 	ssh_client_source  *ssh.Client
-	sftp_client_target *sftp.Client
-	ssh_client_target  *ssh.Client
+	targets            []*streamTarget
 	streamer_to_exit   bool
+	guard              *sftplibs.TransferGuard
+	pgp_keys           *pgp.Keys
+	hooks              *hooks.Hooks
+	remote_commands    *sftplibs.RemoteCommands
+	gate               *gate.Gate
+	job                *jobs.Job
+	hasher             *history.Hasher
 }
 
 // --------------------------------
@@ -66,20 +84,107 @@ func (streamer *SftpStreamer) removeSrc(file_to_download string) {
 	}
 }
 
-func (streamer *SftpStreamer) stream(file_to_download string) bool {
+// targetList returns the output of a file on every target, comma separated
+func (streamer *SftpStreamer) targetList(file_to_download string) string {
+	var outputs []string
+	for _, target := range streamer.targets {
+		outputs = append(outputs, fmt.Sprintf("%s:%s", target.Target, target.outputFile(streamer.SourcePath, file_to_download, streamer.pgp_keys.Extension())))
+	}
+	return strings.Join(outputs, ",")
+}
+
+// record adds the stream of a file to the transfer history, with the
+// servers and paths of all targets comma separated
+func (streamer *SftpStreamer) record(fo downloader.FileObj, started time.Time, err error) {
+	var servers, paths []string
+	for _, target := range streamer.targets {
+		servers = append(servers, target.Target)
+		paths = append(paths, target.outputFile(streamer.SourcePath, fo.Path, streamer.pgp_keys.Extension()))
+	}
+	history.Record(history.Entry{Job: streamer.Name, Kind: "streamer", Direction: history.STREAM, SourceServer: streamer.Source, SourcePath: fo.Path,
+		TargetServer: strings.Join(servers, ","), TargetPath: strings.Join(paths, ","), Size: fo.Stat.Size(), Hash: streamer.hasher.Sum(), Start: started}, err)
+}
+
+func (streamer *SftpStreamer) plan(fo downloader.FileObj) {
+	for _, target := range streamer.Targets {
+		output_file := (&streamTarget{StreamTargetConfig: target}).outputFile(streamer.SourcePath, fo.Path, streamer.pgp_keys.Extension())
+		dryrun.Record(dryrun.Entry{Job: streamer.Name, Kind: "streamer", Action: dryrun.ACTION_TRANSFER,
+			Source: fmt.Sprintf("%s:%s", streamer.Source, fo.Path),
+			Target: fmt.Sprintf("%s:%s", target.Target, output_file), Size: fo.Stat.Size()})
+	}
+	dryrun.Record(dryrun.Entry{Job: streamer.Name, Kind: "streamer", Action: dryrun.ACTION_DELETE,
+		Source: fmt.Sprintf("%s:%s", streamer.Source, fo.Path),
+		Reason: fmt.Sprintf("remove source after stream, success policy %s", streamer.SuccessPolicy)})
+}
 
-	upload_source_relative_path := strings.Replace(file_to_download, streamer.SourcePath, "", 1)
-	output_file := filepath.Join(streamer.TargetPath, upload_source_relative_path)
-	output_file = strings.ReplaceAll(output_file, "\\", "/")
+// required returns how many targets must receive a file for the stream to
+// count as successful and the source to be removed
+func (streamer *SftpStreamer) required() int {
+	switch streamer.SuccessPolicy {
+	case "any":
+		return 1
+	case "quorum":
+		return streamer.Quorum
+	default:
+		return len(streamer.targets)
+	}
+}
 
-	streamer.logger.Debug(fmt.Sprintf("streaming file %s to %s:%s", file_to_download, streamer.Target, output_file))
+func (streamer *SftpStreamer) reconnectTargets() {
+	for _, target := range streamer.targets {
+		if target.connected() || time.Since(target.last_attempt) < target_reconnect_interval {
+			continue
+		}
+		err := target.connect(streamer.logger)
+		notify.ConnectionState(streamer.Name, "streamer", target.Target, err)
+		metrics.Connected(streamer.Name, "streamer", target.Target, streamer.id, err)
+		streamer.job.Connection(target.Target, err)
+		if err != nil {
+			streamer.logger.Error(fmt.Sprintf("target %s still unavailable: %s", target.Target, err.Error()))
+		}
+	}
+}
+
+type streamOutput struct {
+	target      *streamTarget
+	output_file string
+	file        *sftp.File
+}
+
+func (streamer *SftpStreamer) openOutput(target *streamTarget, file_to_download string) (*streamOutput, error) {
+	output_file := target.outputFile(streamer.SourcePath, file_to_download, streamer.pgp_keys.Extension())
 	output_parent_folder := strings.ReplaceAll(filepath.Dir(output_file), "\\", "/")
 
-	err := streamer.sftp_client_target.MkdirAll(output_parent_folder)
+	err := sftplibs.MkdirAllRemote(target.sftp_client, output_parent_folder, streamer.Attributes)
 	if err != nil {
-		streamer.logger.Error(fmt.Sprintf("unable to create remote folder: %s: %s: %s", streamer.Target, output_parent_folder, err.Error()))
-		return false
+		return nil, fmt.Errorf("unable to create remote folder: %s: %s: %s", target.Target, output_parent_folder, err.Error())
+	}
+
+	file, err := target.sftp_client.Create(output_file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening target file: %s:%s: %s", target.Target, output_file, err.Error())
+	}
+	return &streamOutput{target: target, output_file: output_file, file: file}, nil
+}
+
+func (streamer *SftpStreamer) removePartial(output *streamOutput) {
+	if !output.target.connected() {
+		return
+	}
+	err := output.target.sftp_client.Remove(output.output_file)
+	if err != nil {
+		streamer.logger.Error(fmt.Sprintf("failed to remove partial target file: %s:%s: %s", output.target.Target, output.output_file, err.Error()))
 	}
+}
+
+func (streamer *SftpStreamer) stream(file_to_download string, stat fs.FileInfo) bool {
+	timeout_to_use := sftplibs.CalculateTimeout(int64(streamer.Throughput), stat.Size(), int64(streamer.MaxTimeout))
+	ctxTimeout, end := streamer.guard.Begin(timeout_to_use)
+	defer end()
+
+	required := streamer.required()
+	streamer.reconnectTargets()
+	streamer.logger.Debug(fmt.Sprintf("streaming file %s to %d target(s), %d required, with %d seconds timeout", file_to_download, len(streamer.targets), required, timeout_to_use))
 
 	start_time := time.Now().UnixMilli()
 	source, err := streamer.sftp_client_source.OpenFile(file_to_download, os.O_RDONLY)
@@ -89,25 +194,114 @@ func (streamer *SftpStreamer) stream(file_to_download string) bool {
 	}
 	defer source.Close()
 
-	target, openerr := streamer.sftp_client_target.Create(output_file)
-	if openerr != nil {
-		streamer.logger.Error(fmt.Sprintf("error opening target file: %s:%s: %s", streamer.Target, output_file, err.Error()))
+	progress := streamer.job.Transfer(streamer.id, fmt.Sprintf("%s:%s", streamer.Source, file_to_download), streamer.targetList(file_to_download), stat.Size(), streamer.hasher.Wrap(source))
+	transformed, err := transform.Wrap(ctxTimeout, progress, streamer.Transforms)
+	if err != nil {
+		streamer.logger.Error(fmt.Sprintf("unable to start transforms: %s: %s", file_to_download, err.Error()))
 		return false
 	}
-	defer target.Close()
 
-	nBytes, err := io.Copy(target, source)
-	if err != nil {
-		streamer.logger.Error(fmt.Sprintf("error streaming file: %s: %s", file_to_download, err.Error()))
+	var payload io.Reader = transformed
+	if streamer.pgp_keys != nil {
+		encrypted := streamer.pgp_keys.EncryptReader(transformed, file_to_download)
+		defer encrypted.Close()
+		payload = encrypted
+	}
+
+	var outputs []*streamOutput
+	for _, target := range streamer.targets {
+		if !target.connected() {
+			streamer.logger.Error(fmt.Sprintf("target %s not connected, skipped for %s", target.Target, file_to_download))
+			continue
+		}
+		output, err := streamer.openOutput(target, file_to_download)
+		if err != nil {
+			streamer.logger.Error(err.Error())
+			target.close()
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+
+	if len(outputs) < required {
+		streamer.logger.Error(fmt.Sprintf("only %d target(s) available for %s, %d required", len(outputs), file_to_download, required))
+		transformed.Close()
+		for _, output := range outputs {
+			output.file.Close()
+			streamer.removePartial(output)
+		}
+		return false
+	}
+
+	writers := make([]io.Writer, len(outputs))
+	closers := []io.Closer{source}
+	for idx, output := range outputs {
+		writers[idx] = output.file
+		closers = append(closers, output.file)
+	}
+	fan := newFanOut(writers, required)
+
+	release := sftplibs.CloseOnCancel(ctxTimeout, closers...)
+	nBytes, copy_err := sftplibs.CopyWithCancel(ctxTimeout, fan, payload)
+	release()
+	transform_err := transformed.Close()
+	if copy_err == nil && transform_err != nil {
+		copy_err = transform_err
+	}
+	if copy_err != nil {
+		if ctxTimeout.Err() != nil {
+			streamer.logger.Error(fmt.Sprintf("stream cancelled or timed out: %s: %v", file_to_download, ctxTimeout.Err()))
+		} else {
+			streamer.logger.With(logger.Fields{"path": file_to_download, "error": copy_err.Error()}).Error(fmt.Sprintf("error streaming file: %s: %s", file_to_download, copy_err.Error()))
+		}
+	}
+
+	succeeded := 0
+	for idx, output := range outputs {
+		// an incomplete copy fails every target, not only the ones which errored
+		output_err := fan.errs[idx]
+		if output_err == nil {
+			output_err = copy_err
+		}
+		close_err := output.file.Close()
+		if output_err == nil {
+			output_err = close_err
+		}
+
+		if output_err != nil {
+			streamer.logger.Error(fmt.Sprintf("failed to stream %s to %s:%s: %s", file_to_download, output.target.Target, output.output_file, output_err.Error()))
+			streamer.removePartial(output)
+			if fan.errs[idx] != nil {
+				// reconnect this target later
+				output.target.close()
+			}
+			continue
+		}
+
+		err = sftplibs.ApplyRemoteAttrs(output.target.sftp_client, output.output_file, sftplibs.RemoteAttrs(stat), streamer.Attributes)
+		if err != nil {
+			streamer.logger.Error(fmt.Sprintf("failed to set file attributes: %s:%s: %s", output.target.Target, output.output_file, err.Error()))
+		}
+		// the after command runs on every target which received the file
+		err = streamer.remote_commands.After(output.target.ssh_client, sftplibs.RemoteCommandData{Job: streamer.Name, Source: file_to_download, Target: output.output_file, Size: stat.Size()})
+		if err != nil {
+			continue
+		}
+		succeeded++
+	}
+
+	if succeeded < required {
+		streamer.logger.Error(fmt.Sprintf("streamed %s to %d of %d target(s), %d required by %s policy", file_to_download, succeeded, len(streamer.targets), required, streamer.SuccessPolicy))
 		return false
 	}
+
 	end_time := time.Now().UnixMilli()
 
 	time_taken := end_time - start_time
 	if time_taken < 1 {
 		time_taken = 1
 	}
-	streamer.logger.Info(fmt.Sprintf("streamed %s with %d bytes in %d ms, %.1f mbps", file_to_download, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
+	streamer.logger.With(logger.Fields{"path": file_to_download, "bytes": nBytes, "duration_ms": time_taken}).Info(fmt.Sprintf("streamed %s to %d of %d target(s) with %d bytes in %d ms, %.1f mbps", file_to_download, succeeded, len(streamer.targets), nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
 	return true
 }
 
@@ -121,7 +315,11 @@ func (streamer *SftpStreamer) connectAndGetClients() error {
 		streamer.SourceServer.User,
 		streamer.SourceServer.Password,
 		streamer.SourceServer.KeyFile,
-		streamer.SourceServer.CertFile)
+		streamer.SourceServer.CertFile,
+		streamer.SourceServer.KeyPassphrase)
+	notify.ConnectionState(streamer.Name, "streamer", streamer.Source, err)
+	metrics.Connected(streamer.Name, "streamer", streamer.Source, streamer.id, err)
+	streamer.job.Connection(streamer.Source, err)
 	if err != nil {
 		return err
 	}
@@ -129,20 +327,23 @@ func (streamer *SftpStreamer) connectAndGetClients() error {
 	streamer.ssh_client_source = ssh_client
 	streamer.sftp_client_source = sftp_client
 
-	streamer.logger.Debug(fmt.Sprintf("connecting to target server %s with user %s", streamer.TargetServer.Ip, streamer.TargetServer.User))
-	ssh_client_target, sftp_client_target, err := sftplibs.ConnectSftpServer(
-		streamer.TargetServer.Ip,
-		streamer.TargetServer.Port,
-		streamer.TargetServer.User,
-		streamer.TargetServer.Password,
-		streamer.TargetServer.KeyFile,
-		streamer.TargetServer.CertFile)
-	if err != nil {
-		return err
+	streamer.targets = make([]*streamTarget, len(streamer.Targets))
+	connected := 0
+	for idx, target_config := range streamer.Targets {
+		streamer.targets[idx] = &streamTarget{StreamTargetConfig: target_config}
+		err := streamer.targets[idx].connect(streamer.logger)
+		notify.ConnectionState(streamer.Name, "streamer", target_config.Target, err)
+		metrics.Connected(streamer.Name, "streamer", target_config.Target, streamer.id, err)
+		streamer.job.Connection(target_config.Target, err)
+		if err != nil {
+			streamer.logger.With(logger.Fields{"target": target_config.Target, "error": err.Error()}).Error(fmt.Sprintf("error connecting to target %s: %s", target_config.Target, err.Error()))
+			continue
+		}
+		connected++
+	}
+	if connected < streamer.required() || connected == 0 {
+		return fmt.Errorf("only %d of %d target(s) connected, %d required", connected, len(streamer.targets), streamer.required())
 	}
-	streamer.logger.Info(fmt.Sprintf("connected to target server %s with user %s", streamer.TargetServer.Ip, streamer.TargetServer.User))
-	streamer.ssh_client_target = ssh_client_target
-	streamer.sftp_client_target = sftp_client_target
 	return nil
 }
 
@@ -151,19 +352,27 @@ func (streamer *SftpStreamer) connectAndGetClients() error {
 func (streamer *SftpStreamer) init() {
 	streamer.started = false
 	streamer.streamer_to_exit = false
-	streamer.logger = logger.NewLogger(fmt.Sprintf("streamer[%s:%d]", streamer.Name, streamer.id))
+	streamer.logger = logger.NewJobLogger(fmt.Sprintf("streamer[%s:%d]", streamer.Name, streamer.id), streamer.Name, streamer.id).With(logger.Fields{"server": streamer.Source})
 
 	var sleepy sleepytime.Sleepytime
 	sleepy.Reset(2, 600)
 	for {
+		streamer.job.WorkerState(streamer.id, jobs.WAITING)
+		if !streamer.gate.WaitOpen() || streamer.job.Stopping() {
+			return
+		}
+		streamer.job.WorkerState(streamer.id, jobs.CONNECTING)
 		err := streamer.connectAndGetClients()
 		if err == nil {
 			break
 		}
 		streamer.Stop()
-		streamer.logger.Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
-		time.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
+		streamer.logger.With(logger.Fields{"error": err.Error()}).Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
+		streamer.job.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
 	}
+	streamer.job.WorkerState(streamer.id, jobs.IDLE)
+	// created after connecting, as a failed connect attempt calls Stop
+	streamer.guard = sftplibs.NewTransferGuard()
 }
 
 // --------------------------------
@@ -171,17 +380,18 @@ func (streamer *SftpStreamer) init() {
 func (streamer *SftpStreamer) Stop() {
 	streamer.started = false
 	streamer.streamer_to_exit = true
+	if streamer.guard != nil {
+		// let an in-flight stream clean up its partial target first
+		streamer.guard.Stop(5 * time.Second)
+	}
 	if streamer.sftp_client_source != nil {
 		streamer.sftp_client_source.Close()
 	}
 	if streamer.ssh_client_source != nil {
 		streamer.ssh_client_source.Close()
 	}
-	if streamer.sftp_client_target != nil {
-		streamer.sftp_client_target.Close()
-	}
-	if streamer.ssh_client_target != nil {
-		streamer.ssh_client_target.Close()
+	for _, target := range streamer.targets {
+		target.close()
 	}
 	streamer.logger.Info("stopped")
 }
@@ -190,22 +400,66 @@ func (streamer *SftpStreamer) Stop() {
 
 func (streamer *SftpStreamer) Start(c chan downloader.FileObj, done chan int) {
 	streamer.init()
+	if streamer.job.Stopping() {
+		return
+	}
 	streamer.started = true
 	streamer.prefix = fmt.Sprintf("%s%d", streamer.Name, streamer.id)
 	var file_to_download string
+	quit := make(chan bool)
+	finished := make(chan bool)
 	go func() {
+		defer close(finished)
 		for {
 			if !streamer.started {
 				return
 			}
-			file_to_download = (<-c).Path
+			var fo downloader.FileObj
+			select {
+			case fo = <-c:
+			case <-quit:
+				return
+			}
+			file_to_download = fo.Path
 			streamer.logger.Debug(fmt.Sprintf("received file from channel: %s", file_to_download))
-			if streamer.stream(file_to_download) {
+			if dryrun.Enabled() {
+				streamer.plan(fo)
+				done <- 1
+				continue
+			}
+			source := fmt.Sprintf("%s:%s", streamer.Source, file_to_download)
+			targets := streamer.targetList(file_to_download)
+			if !streamer.hooks.BeforeTransfer(source, targets, fo.Stat) {
+				streamer.logger.Info(fmt.Sprintf("skipped by pre-transfer hook: %s", file_to_download))
+				done <- hooks.RESULT_SKIPPED
+				continue
+			}
+			// the before command runs on the source server
+			streamer.hasher = history.NewHasher()
+			started := time.Now()
+			remote_err := streamer.remote_commands.Before(streamer.ssh_client_source, sftplibs.RemoteCommandData{Job: streamer.Name, Source: file_to_download, Target: file_to_download, Size: fo.Stat.Size()})
+			if remote_err != nil {
+				metrics.Result(streamer.Name, "streamer", streamer.Source, fo.Stat.Size(), started, metrics.REASON_REMOTE_COMMAND, remote_err)
+				streamer.record(fo, started, remote_err)
+				streamer.hooks.AfterTransfer(source, targets, fo.Stat, remote_err)
+				done <- 0
+				continue
+			}
+			if streamer.stream(file_to_download, fo.Stat) {
+				metrics.Result(streamer.Name, "streamer", streamer.Source, fo.Stat.Size(), started, "", nil)
+				streamer.record(fo, started, nil)
+				streamer.hooks.AfterTransfer(source, targets, fo.Stat, nil)
 				streamer.removeSrc(file_to_download)
+				done <- 1
 			} else {
+				stream_err := errors.New("stream failed")
+				metrics.Result(streamer.Name, "streamer", streamer.Source, fo.Stat.Size(), started, metrics.REASON_TRANSFER, stream_err)
+				streamer.record(fo, started, stream_err)
+				streamer.hooks.AfterTransfer(source, targets, fo.Stat, stream_err)
 				streamer.streamer_to_exit = true
+				done <- 0
 			}
-			done <- 1
+			streamer.job.WorkerState(streamer.id, jobs.IDLE)
 			if streamer.streamer_to_exit {
 				return
 			}
@@ -217,47 +471,98 @@ func (streamer *SftpStreamer) Start(c chan downloader.FileObj, done chan int) {
 		if streamer.streamer_to_exit {
 			return
 		}
+		if !streamer.gate.Open() {
+			// let the current stream finish, then disconnect
+			close(quit)
+			<-finished
+			streamer.logger.Info("outside allowed window, disconnecting")
+			return
+		}
 	}
 }
 
-func setupSigHandler(new_scanner **downloader.SftpScanner, streamers []*SftpStreamer) {
-	siginthandler.Handle("streamer", func() {
-		term_signal = true
-		if new_scanner != nil {
-			(*new_scanner).Stop()
-		}
-		for _, this_streamer := range streamers {
-			if this_streamer != nil {
-				this_streamer.Stop()
-			}
+func stopAll(new_scanner **downloader.SftpScanner, streamers []*SftpStreamer) {
+	if *new_scanner != nil {
+		(*new_scanner).Stop()
+	}
+	for _, this_streamer := range streamers {
+		if this_streamer != nil {
+			this_streamer.Stop()
 		}
+	}
+}
+
+func setupSigHandler(new_scanner **downloader.SftpScanner, streamers []*SftpStreamer) func() {
+	return siginthandler.Handle("streamer", func() {
+		term_signal = true
+		stopAll(new_scanner, streamers)
 	})
 }
 
 func NewStreamer(streamer_config config.StreamerConfig) {
+	if err := transform.Validate(streamer_config.Transforms); err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid transforms, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	pgp_keys, err := pgp.Load(streamer_config.Pgp)
+	if err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: unable to load pgp keys, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	job_hooks := hooks.New(streamer_config.Hooks, streamer_config.Name, "streamer")
+	if err := sla.Register(streamer_config.Name, "streamer", streamer_config.Expectations); err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid expectations, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	remote_commands, err := sftplibs.NewRemoteCommands(streamer_config.RemoteCommands, streamer_config.Name)
+	if err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	job_gate, err := gate.New(streamer_config.ScheduleConfig, streamer_config.Name)
+	if err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid schedule, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+
 	// tempfolder = tf
 	streamers := make([]*SftpStreamer, streamer_config.Worker)
 	var new_scanner *downloader.SftpScanner
 
-	setupSigHandler(&new_scanner, streamers)
+	unregister_sig := setupSigHandler(&new_scanner, streamers)
+	job := jobs.Register(streamer_config.Name, "streamer", func() {
+		NewStreamer(streamer_config)
+	})
+	job_gate.StopOn(job.StopChan())
+	job.OnStop(func() {
+		stopAll(&new_scanner, streamers)
+		unregister_sig()
+	})
 
 	// make a channel
 	c := make(chan downloader.FileObj, streamer_config.Worker*2)
 	done := make(chan int, streamer_config.Worker*2)
 
 	for i := 0; i < streamer_config.Worker; i++ {
+		job.Add()
 		go func(myid int) {
+			defer job.Done()
 			for {
 				var new_streamer SftpStreamer
 				new_streamer.StreamerConfig = streamer_config
 				new_streamer.id = myid
+				new_streamer.pgp_keys = pgp_keys
+				new_streamer.hooks = job_hooks
+				new_streamer.remote_commands = remote_commands
+				new_streamer.gate = job_gate
+				new_streamer.job = job
 				streamers[myid] = &new_streamer
 				new_streamer.Start(c, done)
 				stream_manager_logger.Debug("return from start and calling streamer stop")
 				fmt.Printf("NewStreamer calling stop\n")
 				new_streamer.Stop()
 				streamers[myid] = nil
-				if term_signal {
+				if term_signal || job.Stopping() {
 					return
 				}
 				stream_manager_logger.Info(fmt.Sprintf("streamer [%d] exited, will recreate", myid))
@@ -267,22 +572,24 @@ func NewStreamer(streamer_config config.StreamerConfig) {
 
 	var proxyconfig config.DownloaderConfig
 	proxyconfig.Name = streamer_config.Name
+	proxyconfig.PollingConfig = streamer_config.PollingConfig
 	proxyconfig.Source = streamer_config.Source
 	proxyconfig.SourceServer = streamer_config.SourceServer
 	proxyconfig.SourcePath = streamer_config.SourcePath
 
+	job.Add()
 	go func() {
+		defer job.Done()
 		for {
 			new_scanner = new(downloader.SftpScanner)
 			new_scanner.DownloaderConfig = proxyconfig
-			new_scanner.Default_sleep_time = 60
-			if streamer_config.SleepInterval > 0 {
-				new_scanner.Default_sleep_time = streamer_config.SleepInterval
-			}
+			new_scanner.Hooks = job_hooks
+			new_scanner.Gate = job_gate
+			new_scanner.Job = job
 			new_scanner.Start(c, done, false)
 			new_scanner.Stop()
 			new_scanner = nil
-			if term_signal {
+			if term_signal || job.Stopping() {
 				return
 			}
 			stream_manager_logger.Info("scanner exited, will recreate")
@@ -292,6 +599,26 @@ func NewStreamer(streamer_config config.StreamerConfig) {
 }
 
 func NewOneTimeStreamer(streamer_config config.StreamerConfig) {
+	if err := transform.Validate(streamer_config.Transforms); err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid transforms, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	pgp_keys, err := pgp.Load(streamer_config.Pgp)
+	if err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: unable to load pgp keys, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	job_hooks := hooks.New(streamer_config.Hooks, streamer_config.Name, "streamer")
+	if err := sla.Register(streamer_config.Name, "streamer", streamer_config.Expectations); err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid expectations, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+	remote_commands, err := sftplibs.NewRemoteCommands(streamer_config.RemoteCommands, streamer_config.Name)
+	if err != nil {
+		stream_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, streamer not started: %s", streamer_config.Name, err.Error()))
+		return
+	}
+
 	// tempfolder = tf
 	streamers := make([]*SftpStreamer, streamer_config.Worker)
 	var new_scanner *downloader.SftpScanner
@@ -307,6 +634,9 @@ func NewOneTimeStreamer(streamer_config config.StreamerConfig) {
 			var new_streamer SftpStreamer
 			new_streamer.StreamerConfig = streamer_config
 			new_streamer.id = myid
+			new_streamer.pgp_keys = pgp_keys
+			new_streamer.hooks = job_hooks
+			new_streamer.remote_commands = remote_commands
 			streamers[myid] = &new_streamer
 			new_streamer.Start(c, done)
 			new_streamer.Stop()
@@ -316,20 +646,17 @@ func NewOneTimeStreamer(streamer_config config.StreamerConfig) {
 
 	var proxyconfig config.DownloaderConfig
 	proxyconfig.Name = streamer_config.Name
+	proxyconfig.PollingConfig = streamer_config.PollingConfig
 	proxyconfig.Source = streamer_config.Source
 	proxyconfig.SourceServer = streamer_config.SourceServer
 	proxyconfig.SourcePath = streamer_config.SourcePath
 
 	new_scanner = new(downloader.SftpScanner)
 	new_scanner.DownloaderConfig = proxyconfig
-	new_scanner.Default_sleep_time = 60
-	if streamer_config.SleepInterval > 0 {
-		new_scanner.Default_sleep_time = streamer_config.SleepInterval
-	}
+	new_scanner.Hooks = job_hooks
 	new_scanner.Start(c, done, true)
 	new_scanner.Stop()
 	new_scanner = nil
-	os.Exit(0)
 }
 
 // --------------------------------
@@ -1,16 +1,23 @@
 package syncer
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/notify"
 	"github.com/iambighead/ugoku/internal/sleepytime"
 	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/iambighead/ugoku/uploader"
@@ -20,13 +27,19 @@ import (
 
 type SftpLocalSyncer struct {
 	config.SyncerConfig
-	id          int
-	prefix      string
-	started     bool
-	logger      logger.Logger
-	sftp_client *sftp.Client
-	ssh_client  *ssh.Client
-	to_exit     bool
+	id              int
+	prefix          string
+	started         bool
+	logger          logger.Logger
+	sftp_client     *sftp.Client
+	ssh_client      *ssh.Client
+	to_exit         bool
+	guard           *sftplibs.TransferGuard
+	hooks           *hooks.Hooks
+	remote_commands *sftplibs.RemoteCommands
+	gate            *gate.Gate
+	job             *jobs.Job
+	hasher          *history.Hasher
 }
 
 func (syncer *SftpLocalSyncer) uploadable(file_to_download string, output_file string, stat fs.FileInfo) bool {
@@ -48,14 +61,25 @@ func (syncer *SftpLocalSyncer) uploadable(file_to_download string, output_file s
 	return local_modtime != remote_modtime
 }
 
-func (syncer *SftpLocalSyncer) upload(file_to_upload string, output_file string) {
-	syncer.logger.Debug(fmt.Sprintf("uploading file %s to %s:%s", file_to_upload, syncer.Server, output_file))
+func (syncer *SftpLocalSyncer) removePartial(output_file string) {
+	err := syncer.sftp_client.Remove(output_file)
+	if err != nil {
+		syncer.logger.Error(fmt.Sprintf("failed to remove partial remote file: %s:%s: %s", syncer.Server, output_file, err.Error()))
+	}
+}
+
+func (syncer *SftpLocalSyncer) upload(file_to_upload string, output_file string, size int64) bool {
+	timeout_to_use := sftplibs.CalculateTimeout(int64(syncer.Throughput), size, int64(syncer.MaxTimeout))
+	ctxTimeout, end := syncer.guard.Begin(timeout_to_use)
+	defer end()
+
+	syncer.logger.Debug(fmt.Sprintf("uploading file %s to %s:%s, with %d seconds timeout", file_to_upload, syncer.Server, output_file, timeout_to_use))
 	output_parent_folder := strings.ReplaceAll(filepath.Dir(output_file), "\\", "/")
-	err := syncer.sftp_client.MkdirAll(output_parent_folder)
+	err := sftplibs.MkdirAllRemote(syncer.sftp_client, output_parent_folder, syncer.Attributes)
 	if err != nil {
 		syncer.logger.Error(fmt.Sprintf("unable to create remote folder: %s: %s: %s", syncer.Server, output_parent_folder, err.Error()))
 		syncer.to_exit = true
-		return
+		return false
 	}
 	// syncer.logger.Debug(fmt.Sprintf("created output folder %s", output_parent_folder))
 
@@ -63,23 +87,32 @@ func (syncer *SftpLocalSyncer) upload(file_to_upload string, output_file string)
 	source, err := os.OpenFile(file_to_upload, os.O_RDONLY, 0644)
 	if err != nil {
 		syncer.logger.Error(fmt.Sprintf("unable to open local file: %s: %s", file_to_upload, err.Error()))
-		return
+		return false
 	}
 	defer source.Close()
 
 	target, openerr := syncer.sftp_client.Create(output_file)
 	if openerr != nil {
-		syncer.logger.Error(fmt.Sprintf("error opening remote file: %s:%s: %s", syncer.Server, output_file, err.Error()))
+		syncer.logger.Error(fmt.Sprintf("error opening remote file: %s:%s: %s", syncer.Server, output_file, openerr.Error()))
 		syncer.to_exit = true
-		return
+		return false
 	}
 	defer target.Close()
 
-	nBytes, err := io.Copy(target, source)
+	release := sftplibs.CloseOnCancel(ctxTimeout, source, target)
+	progress := syncer.job.Transfer(syncer.id, file_to_upload, fmt.Sprintf("%s:%s", syncer.Server, output_file), size, syncer.hasher.Wrap(source))
+	nBytes, err := sftplibs.CopyWithCancel(ctxTimeout, target, progress)
+	release()
 	if err != nil {
-		syncer.logger.Error(fmt.Sprintf("error uploading file: %s: %s", file_to_upload, err.Error()))
+		if ctxTimeout.Err() != nil {
+			syncer.logger.Error(fmt.Sprintf("upload cancelled or timed out: %s: %v", file_to_upload, ctxTimeout.Err()))
+		} else {
+			syncer.logger.With(logger.Fields{"path": file_to_upload, "error": err.Error()}).Error(fmt.Sprintf("error uploading file: %s: %s", file_to_upload, err.Error()))
+		}
+		target.Close()
+		syncer.removePartial(output_file)
 		syncer.to_exit = true
-		return
+		return false
 	}
 	end_time := time.Now().UnixMilli()
 
@@ -87,7 +120,8 @@ func (syncer *SftpLocalSyncer) upload(file_to_upload string, output_file string)
 	if time_taken < 1 {
 		time_taken = 1
 	}
-	syncer.logger.Info(fmt.Sprintf("uploaded %s with %d bytes in %d ms, %.1f mbps", file_to_upload, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
+	syncer.logger.With(logger.Fields{"path": file_to_upload, "bytes": nBytes, "duration_ms": time_taken}).Info(fmt.Sprintf("uploaded %s with %d bytes in %d ms, %.1f mbps", file_to_upload, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
+	return true
 }
 
 // --------------------------------
@@ -100,7 +134,8 @@ func (syncer *SftpLocalSyncer) connectAndGetClients() error {
 		syncer.SyncServer.User,
 		syncer.SyncServer.Password,
 		syncer.SyncServer.KeyFile,
-		syncer.SyncServer.CertFile)
+		syncer.SyncServer.CertFile,
+		syncer.SyncServer.KeyPassphrase)
 	if err != nil {
 		return err
 	}
@@ -115,18 +150,28 @@ func (syncer *SftpLocalSyncer) connectAndGetClients() error {
 func (syncer *SftpLocalSyncer) init() {
 	syncer.started = false
 	syncer.to_exit = false
-	syncer.logger = logger.NewLogger(fmt.Sprintf("local-syncer[%s:%d]", syncer.Name, syncer.id))
+	syncer.logger = logger.NewJobLogger(fmt.Sprintf("local-syncer[%s:%d]", syncer.Name, syncer.id), syncer.Name, syncer.id).With(logger.Fields{"server": syncer.Server})
 
 	var sleepy sleepytime.Sleepytime
 	sleepy.Reset(2, 600)
 	for {
+		syncer.job.WorkerState(syncer.id, jobs.WAITING)
+		if !syncer.gate.WaitOpen() || syncer.job.Stopping() {
+			return
+		}
+		syncer.job.WorkerState(syncer.id, jobs.CONNECTING)
 		err := syncer.connectAndGetClients()
+		notify.ConnectionState(syncer.Name, "syncer", syncer.Server, err)
+		metrics.Connected(syncer.Name, "syncer", syncer.Server, syncer.id, err)
+		syncer.job.Connection(syncer.Server, err)
 		if err == nil {
 			break
 		}
-		syncer.logger.Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
-		time.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
+		syncer.logger.With(logger.Fields{"error": err.Error()}).Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
+		syncer.job.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
 	}
+	syncer.job.WorkerState(syncer.id, jobs.IDLE)
+	syncer.guard = sftplibs.NewTransferGuard()
 }
 
 // --------------------------------
@@ -134,6 +179,10 @@ func (syncer *SftpLocalSyncer) init() {
 func (syncer *SftpLocalSyncer) Stop() {
 	syncer.logger.Info("stopping")
 	syncer.started = false
+	if syncer.guard != nil {
+		// let an in-flight upload clean up its partial target first
+		syncer.guard.Stop(5 * time.Second)
+	}
 	if syncer.sftp_client != nil {
 		syncer.sftp_client.Close()
 	}
@@ -145,12 +194,11 @@ func (syncer *SftpLocalSyncer) Stop() {
 
 // --------------------------------
 
-func (syncer *SftpLocalSyncer) updateModTime(output_file string, stat fs.FileInfo) {
-	modtime := stat.ModTime()
+func (syncer *SftpLocalSyncer) updateAttributes(output_file string, stat fs.FileInfo) {
 	file_to_update := strings.ReplaceAll(output_file, "\\", "/")
-	err := syncer.sftp_client.Chtimes(file_to_update, modtime, modtime)
+	err := sftplibs.ApplyRemoteAttrs(syncer.sftp_client, file_to_update, sftplibs.LocalAttrs(stat), syncer.Attributes)
 	if err != nil {
-		syncer.logger.Error(fmt.Sprintf("failed to update modified time: %s: %s", output_file, err.Error()))
+		syncer.logger.Error(fmt.Sprintf("failed to update file attributes: %s: %s", output_file, err.Error()))
 	}
 }
 
@@ -158,20 +206,69 @@ func (syncer *SftpLocalSyncer) updateModTime(output_file string, stat fs.FileInf
 
 func (syncer *SftpLocalSyncer) Start(c chan uploader.FileObj, done chan int) {
 	syncer.init()
+	if syncer.job.Stopping() {
+		return
+	}
 	syncer.started = true
 	syncer.prefix = fmt.Sprintf("%s%d", syncer.Name, syncer.id)
 	defer syncer.Stop()
 	for {
-		fo := <-c
+		var fo uploader.FileObj
+		select {
+		case fo = <-c:
+		case <-time.After(1 * time.Second):
+			if syncer.job.Stopping() {
+				return
+			}
+			if !syncer.gate.Open() {
+				syncer.logger.Info("outside allowed window, disconnecting")
+				return
+			}
+			continue
+		}
 		syncer.logger.Debug(fmt.Sprintf("received file from channel: %s", fo.Path))
 		upload_source_relative_path := strings.Replace(fo.Path, syncer.LocalPath, "", 1)
 		output_file := filepath.Join(syncer.ServerPath, upload_source_relative_path)
 		output_file = strings.ReplaceAll(output_file, "\\", "/")
+		result := hooks.RESULT_SKIPPED
 		if syncer.uploadable(fo.Path, output_file, fo.Stat) {
-			syncer.upload(fo.Path, output_file)
-			syncer.updateModTime(output_file, fo.Stat)
+			if dryrun.Enabled() {
+				dryrun.Record(dryrun.Entry{Job: syncer.Name, Kind: "syncer", Action: dryrun.ACTION_TRANSFER,
+					Source: fo.Path, Target: fmt.Sprintf("%s:%s", syncer.Server, output_file), Size: fo.Stat.Size(),
+					Reason: "missing or changed on server"})
+				done <- 1
+				continue
+			}
+			target := fmt.Sprintf("%s:%s", syncer.Server, output_file)
+			if !syncer.hooks.BeforeTransfer(fo.Path, target, fo.Stat) {
+				syncer.logger.Info(fmt.Sprintf("skipped by pre-transfer hook: %s", fo.Path))
+			} else {
+				remote_data := sftplibs.RemoteCommandData{Job: syncer.Name, Source: fo.Path, Target: output_file, Size: fo.Stat.Size()}
+				syncer.hasher = history.NewHasher()
+				started := time.Now()
+				err := syncer.remote_commands.Before(syncer.ssh_client, remote_data)
+				reason := metrics.REASON_REMOTE_COMMAND
+				if err == nil && !syncer.upload(fo.Path, output_file, fo.Stat.Size()) {
+					err = errors.New("upload failed")
+					reason = metrics.REASON_TRANSFER
+				}
+				if err == nil {
+					err = syncer.remote_commands.After(syncer.ssh_client, remote_data)
+				}
+				metrics.Result(syncer.Name, "syncer", syncer.Server, fo.Stat.Size(), started, reason, err)
+				history.Record(history.Entry{Job: syncer.Name, Kind: "syncer", Direction: history.UPLOAD, SourcePath: fo.Path,
+					TargetServer: syncer.Server, TargetPath: output_file, Size: fo.Stat.Size(), Hash: syncer.hasher.Sum(), Start: started}, err)
+				syncer.hooks.AfterTransfer(fo.Path, target, fo.Stat, err)
+				if err == nil {
+					syncer.updateAttributes(output_file, fo.Stat)
+					result = hooks.RESULT_TRANSFERRED
+				} else {
+					result = hooks.RESULT_FAILED
+				}
+			}
 		}
-		done <- 1
+		syncer.job.WorkerState(syncer.id, jobs.IDLE)
+		done <- result
 		if syncer.to_exit {
 			return
 		}
@@ -10,9 +10,16 @@ import (
 	"strings"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/downloader"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/notify"
 	"github.com/iambighead/ugoku/internal/sleepytime"
 	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/pkg/sftp"
@@ -21,13 +28,18 @@ import (
 
 type SftpServerSyncer struct {
 	config.SyncerConfig
-	id          int
-	prefix      string
-	started     bool
-	logger      logger.Logger
-	sftp_client *sftp.Client
-	ssh_client  *ssh.Client
-	to_exit     bool
+	id              int
+	prefix          string
+	started         bool
+	logger          logger.Logger
+	sftp_client     *sftp.Client
+	ssh_client      *ssh.Client
+	to_exit         bool
+	hooks           *hooks.Hooks
+	remote_commands *sftplibs.RemoteCommands
+	gate            *gate.Gate
+	job             *jobs.Job
+	hasher          *history.Hasher
 }
 
 func (syncer *SftpServerSyncer) downloadable(file_to_download string, output_file string, stat fs.FileInfo) bool {
@@ -58,7 +70,10 @@ func (syncer *SftpServerSyncer) download(file_to_download string, output_file st
 		syncer.logger.Debug(fmt.Sprintf("downloading file %s to %s", file_to_download, output_file))
 
 		output_parent_folder := filepath.Dir(output_file)
-		os.MkdirAll(output_parent_folder, fs.ModeDir|0764)
+		err := sftplibs.MkdirAllLocal(output_parent_folder, syncer.Attributes)
+		if err != nil {
+			syncer.logger.Error(fmt.Sprintf("unable to create output folder: %s: %s", output_parent_folder, err.Error()))
+		}
 		// syncer.logger.Debug(fmt.Sprintf("created output folder %s", output_parent_folder))
 
 		start_time := time.Now().UnixMilli()
@@ -71,9 +86,10 @@ func (syncer *SftpServerSyncer) download(file_to_download string, output_file st
 		}
 		defer source.Close()
 
-		nBytes, tempfile_path, err := sftplibs.DownloadToTemp(ctxTimeout, tempfolder, source, syncer.prefix)
+		nBytes, tempfile_path, err := sftplibs.DownloadToTemp(ctxTimeout, tempfolder,
+			syncer.job.Transfer(syncer.id, fmt.Sprintf("%s:%s", syncer.Server, file_to_download), output_file, size, syncer.hasher.Wrap(source)), syncer.prefix)
 		if err != nil && !cancelled {
-			syncer.logger.Error(fmt.Sprintf("error downloading file: %s: %s", file_to_download, err.Error()))
+			syncer.logger.With(logger.Fields{"path": file_to_download, "error": err.Error()}).Error(fmt.Sprintf("error downloading file: %s: %s", file_to_download, err.Error()))
 			syncer.to_exit = true
 			done <- 0
 			return
@@ -99,14 +115,14 @@ func (syncer *SftpServerSyncer) download(file_to_download string, output_file st
 		if time_taken < 1 {
 			time_taken = 1
 		}
-		syncer.logger.Info(fmt.Sprintf("downloaded %s with %d bytes in %d ms, %.1f mbps", file_to_download, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
+		syncer.logger.With(logger.Fields{"path": file_to_download, "bytes": nBytes, "duration_ms": time_taken}).Info(fmt.Sprintf("downloaded %s with %d bytes in %d ms, %.1f mbps", file_to_download, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
 		done <- 1
 	}()
 
 	select {
 	case <-ctxTimeout.Done():
 		cancelled = true
-		return fmt.Errorf("download timeout: %v", ctxTimeout.Err())
+		return fmt.Errorf("download timeout: %w", ctxTimeout.Err())
 	case result := <-done:
 		if result > 0 {
 			return nil
@@ -126,7 +142,8 @@ func (syncer *SftpServerSyncer) connectAndGetClients() error {
 		syncer.SyncServer.User,
 		syncer.SyncServer.Password,
 		syncer.SyncServer.KeyFile,
-		syncer.SyncServer.CertFile)
+		syncer.SyncServer.CertFile,
+		syncer.SyncServer.KeyPassphrase)
 	if err != nil {
 		return err
 	}
@@ -141,18 +158,27 @@ func (syncer *SftpServerSyncer) connectAndGetClients() error {
 func (syncer *SftpServerSyncer) init() {
 	syncer.started = false
 	syncer.to_exit = false
-	syncer.logger = logger.NewLogger(fmt.Sprintf("server-syncer[%s:%d]", syncer.Name, syncer.id))
+	syncer.logger = logger.NewJobLogger(fmt.Sprintf("server-syncer[%s:%d]", syncer.Name, syncer.id), syncer.Name, syncer.id).With(logger.Fields{"server": syncer.Server})
 
 	var sleepy sleepytime.Sleepytime
 	sleepy.Reset(2, 600)
 	for {
+		syncer.job.WorkerState(syncer.id, jobs.WAITING)
+		if !syncer.gate.WaitOpen() || syncer.job.Stopping() {
+			return
+		}
+		syncer.job.WorkerState(syncer.id, jobs.CONNECTING)
 		err := syncer.connectAndGetClients()
+		notify.ConnectionState(syncer.Name, "syncer", syncer.Server, err)
+		metrics.Connected(syncer.Name, "syncer", syncer.Server, syncer.id, err)
+		syncer.job.Connection(syncer.Server, err)
 		if err == nil {
 			break
 		}
-		syncer.logger.Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
-		time.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
+		syncer.logger.With(logger.Fields{"error": err.Error()}).Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
+		syncer.job.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
 	}
+	syncer.job.WorkerState(syncer.id, jobs.IDLE)
 }
 
 // --------------------------------
@@ -171,11 +197,10 @@ func (syncer *SftpServerSyncer) Stop() {
 
 // --------------------------------
 
-func (syncer *SftpServerSyncer) updateModTime(output_file string, stat fs.FileInfo) {
-	modtime := stat.ModTime()
-	err := os.Chtimes(output_file, modtime, modtime)
+func (syncer *SftpServerSyncer) updateAttributes(output_file string, stat fs.FileInfo) {
+	err := sftplibs.ApplyLocalAttrs(output_file, sftplibs.RemoteAttrs(stat), syncer.Attributes)
 	if err != nil {
-		syncer.logger.Error(fmt.Sprintf("failed to update modified time: %s: %s", output_file, err.Error()))
+		syncer.logger.Error(fmt.Sprintf("failed to update file attributes: %s: %s", output_file, err.Error()))
 	}
 }
 
@@ -183,19 +208,69 @@ func (syncer *SftpServerSyncer) updateModTime(output_file string, stat fs.FileIn
 
 func (syncer *SftpServerSyncer) Start(c chan downloader.FileObj, done chan int) {
 	syncer.init()
+	if syncer.job.Stopping() {
+		return
+	}
 	syncer.started = true
 	syncer.prefix = fmt.Sprintf("%s%d", syncer.Name, syncer.id)
 
 	for {
-		fo := <-c
+		var fo downloader.FileObj
+		select {
+		case fo = <-c:
+		case <-time.After(1 * time.Second):
+			if syncer.job.Stopping() {
+				return
+			}
+			if !syncer.gate.Open() {
+				syncer.logger.Info("outside allowed window, disconnecting")
+				return
+			}
+			continue
+		}
 		syncer.logger.Debug(fmt.Sprintf("received file from channel: %s", fo.Path))
 		relative_download_path := strings.Replace(fo.Path, syncer.ServerPath, "", 1)
 		output_file := filepath.Join(syncer.LocalPath, relative_download_path)
+		result := hooks.RESULT_SKIPPED
 		if syncer.downloadable(fo.Path, output_file, fo.Stat) {
-			syncer.download(fo.Path, output_file, fo.Stat.Size())
-			syncer.updateModTime(output_file, fo.Stat)
+			if dryrun.Enabled() {
+				dryrun.Record(dryrun.Entry{Job: syncer.Name, Kind: "syncer", Action: dryrun.ACTION_TRANSFER,
+					Source: fmt.Sprintf("%s:%s", syncer.Server, fo.Path), Target: output_file, Size: fo.Stat.Size(),
+					Reason: "missing or changed locally"})
+				done <- 1
+				continue
+			}
+			source := fmt.Sprintf("%s:%s", syncer.Server, fo.Path)
+			if !syncer.hooks.BeforeTransfer(source, output_file, fo.Stat) {
+				syncer.logger.Info(fmt.Sprintf("skipped by pre-transfer hook: %s", fo.Path))
+			} else {
+				remote_data := sftplibs.RemoteCommandData{Job: syncer.Name, Source: fo.Path, Target: output_file, Size: fo.Stat.Size()}
+				syncer.hasher = history.NewHasher()
+				started := time.Now()
+				err := syncer.remote_commands.Before(syncer.ssh_client, remote_data)
+				reason := metrics.REASON_REMOTE_COMMAND
+				if err == nil {
+					err = syncer.download(fo.Path, output_file, fo.Stat.Size())
+					reason = metrics.Reason(err)
+				}
+				if err == nil {
+					err = syncer.remote_commands.After(syncer.ssh_client, remote_data)
+					reason = metrics.REASON_REMOTE_COMMAND
+				}
+				metrics.Result(syncer.Name, "syncer", syncer.Server, fo.Stat.Size(), started, reason, err)
+				history.Record(history.Entry{Job: syncer.Name, Kind: "syncer", Direction: history.DOWNLOAD, SourceServer: syncer.Server, SourcePath: fo.Path,
+					TargetPath: output_file, Size: fo.Stat.Size(), Hash: syncer.hasher.Sum(), Start: started}, err)
+				syncer.hooks.AfterTransfer(source, output_file, fo.Stat, err)
+				if err == nil {
+					syncer.updateAttributes(output_file, fo.Stat)
+					result = hooks.RESULT_TRANSFERRED
+				} else {
+					result = hooks.RESULT_FAILED
+				}
+			}
 		}
-		done <- 1
+		syncer.job.WorkerState(syncer.id, jobs.IDLE)
+		done <- result
 		if syncer.to_exit {
 			return
 		}
@@ -2,12 +2,16 @@ package syncer
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/downloader"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
 	siginthandler "github.com/iambighead/ugoku/internal/sigintHandler"
+	"github.com/iambighead/ugoku/internal/sla"
+	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/iambighead/ugoku/uploader"
 )
 
@@ -37,8 +41,7 @@ func startSyncServer(syncer_config config.SyncerConfig, mode string) {
 	syncers := make([]*SftpServerSyncer, syncer_config.Worker)
 	var new_scanner *downloader.SftpScanner
 
-	siginthandler.Handle("server syncer", func() {
-		term_signal = true
+	stop_all := func() {
 		if new_scanner != nil {
 			new_scanner.Stop()
 		}
@@ -47,23 +50,62 @@ func startSyncServer(syncer_config config.SyncerConfig, mode string) {
 				this_syncer.Stop()
 			}
 		}
-	})
-
+	}
 	// make a channel
 	c := make(chan downloader.FileObj, syncer_config.Worker*2)
 	done := make(chan int, syncer_config.Worker*2)
+	job_hooks := hooks.New(syncer_config.Hooks, syncer_config.Name, "syncer")
+	if err := sla.Register(syncer_config.Name, "syncer", syncer_config.Expectations); err != nil {
+		sync_manager_logger.Error(fmt.Sprintf("%s: invalid expectations, syncer not started: %s", syncer_config.Name, err.Error()))
+		return
+	}
+	remote_commands, err := sftplibs.NewRemoteCommands(syncer_config.RemoteCommands, syncer_config.Name)
+	if err != nil {
+		sync_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, syncer not started: %s", syncer_config.Name, err.Error()))
+		return
+	}
+	unregister_sig := siginthandler.Handle("server syncer", func() {
+		term_signal = true
+		stop_all()
+	})
+
+	// schedules and windows only apply in service mode
+	var job_gate *gate.Gate
+	var job *jobs.Job
+	if mode != "onetime" {
+		job_gate, err = gate.New(syncer_config.ScheduleConfig, syncer_config.Name)
+		if err != nil {
+			sync_manager_logger.Error(fmt.Sprintf("%s: invalid schedule, syncer not started: %s", syncer_config.Name, err.Error()))
+			unregister_sig()
+			return
+		}
+		job = jobs.Register(syncer_config.Name, "syncer", func() {
+			NewSyncer(syncer_config, tempfolder)
+		})
+		job.OnStop(func() {
+			stop_all()
+			unregister_sig()
+		})
+		job_gate.StopOn(job.StopChan())
+	}
 
 	for i := 0; i < syncer_config.Worker; i++ {
+		job.Add()
 		go func(myid int) {
+			defer job.Done()
 			for {
 				var new_server_syncer SftpServerSyncer
 				new_server_syncer.SyncerConfig = syncer_config
 				new_server_syncer.id = myid
+				new_server_syncer.hooks = job_hooks
+				new_server_syncer.remote_commands = remote_commands
+				new_server_syncer.gate = job_gate
+				new_server_syncer.job = job
 				syncers[myid] = &new_server_syncer
 				new_server_syncer.Start(c, done)
 				new_server_syncer.Stop()
 				syncers[myid] = nil
-				if mode == "onetime" || term_signal {
+				if mode == "onetime" || term_signal || job.Stopping() {
 					return
 				}
 				sync_manager_logger.Info(fmt.Sprintf("server syncer [%d] exited, will recreate", myid))
@@ -73,34 +115,32 @@ func startSyncServer(syncer_config config.SyncerConfig, mode string) {
 
 	var proxyconfig config.DownloaderConfig
 	proxyconfig.Name = syncer_config.Name
+	proxyconfig.PollingConfig = syncer_config.PollingConfig
 	proxyconfig.Source = syncer_config.Server
 	proxyconfig.SourceServer = syncer_config.SyncServer
 	proxyconfig.SourcePath = syncer_config.ServerPath
 
 	if mode == "onetime" {
 		new_scanner = new(downloader.SftpScanner)
-		new_scanner.Default_sleep_time = 60
-		if syncer_config.SleepInterval > 0 {
-			new_scanner.Default_sleep_time = syncer_config.SleepInterval
-		}
 		new_scanner.DownloaderConfig = proxyconfig
+		new_scanner.Hooks = job_hooks
 		new_scanner.Start(c, done, true)
 		new_scanner.Stop()
 		new_scanner = nil
-		os.Exit(0)
 	} else {
+		job.Add()
 		go func() {
+			defer job.Done()
 			for {
 				new_scanner = new(downloader.SftpScanner)
-				new_scanner.Default_sleep_time = 60
-				if syncer_config.SleepInterval > 0 {
-					new_scanner.Default_sleep_time = syncer_config.SleepInterval
-				}
 				new_scanner.DownloaderConfig = proxyconfig
+				new_scanner.Hooks = job_hooks
+				new_scanner.Gate = job_gate
+				new_scanner.Job = job
 				new_scanner.Start(c, done, false)
 				new_scanner.Stop()
 				new_scanner = nil
-				if term_signal {
+				if term_signal || job.Stopping() {
 					return
 				}
 				sync_manager_logger.Info("server syncer scanner exited, will recreate")
@@ -114,8 +154,7 @@ func startSyncLocal(syncer_config config.SyncerConfig, mode string) {
 	syncers := make([]*SftpLocalSyncer, syncer_config.Worker)
 	var new_scanner *uploader.FolderScanner
 
-	siginthandler.Handle("local syncer", func() {
-		term_signal = true
+	stop_all := func() {
 		if new_scanner != nil {
 			new_scanner.Stop()
 		}
@@ -124,24 +163,63 @@ func startSyncLocal(syncer_config config.SyncerConfig, mode string) {
 				this_syncer.Stop()
 			}
 		}
-	})
-
+	}
 	// make a channel
 	c := make(chan uploader.FileObj, syncer_config.Worker*2)
 	done := make(chan int, syncer_config.Worker*2)
+	job_hooks := hooks.New(syncer_config.Hooks, syncer_config.Name, "syncer")
+	if err := sla.Register(syncer_config.Name, "syncer", syncer_config.Expectations); err != nil {
+		sync_manager_logger.Error(fmt.Sprintf("%s: invalid expectations, syncer not started: %s", syncer_config.Name, err.Error()))
+		return
+	}
+	remote_commands, err := sftplibs.NewRemoteCommands(syncer_config.RemoteCommands, syncer_config.Name)
+	if err != nil {
+		sync_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, syncer not started: %s", syncer_config.Name, err.Error()))
+		return
+	}
+	unregister_sig := siginthandler.Handle("local syncer", func() {
+		term_signal = true
+		stop_all()
+	})
+
+	// schedules and windows only apply in service mode
+	var job_gate *gate.Gate
+	var job *jobs.Job
+	if mode != "onetime" {
+		job_gate, err = gate.New(syncer_config.ScheduleConfig, syncer_config.Name)
+		if err != nil {
+			sync_manager_logger.Error(fmt.Sprintf("%s: invalid schedule, syncer not started: %s", syncer_config.Name, err.Error()))
+			unregister_sig()
+			return
+		}
+		job = jobs.Register(syncer_config.Name, "syncer", func() {
+			NewSyncer(syncer_config, tempfolder)
+		})
+		job.OnStop(func() {
+			stop_all()
+			unregister_sig()
+		})
+		job_gate.StopOn(job.StopChan())
+	}
 
 	for i := 0; i < syncer_config.Worker; i++ {
 
+		job.Add()
 		go func(myid int) {
+			defer job.Done()
 			for {
 				var new_server_syncer SftpLocalSyncer
 				new_server_syncer.SyncerConfig = syncer_config
 				new_server_syncer.id = myid
+				new_server_syncer.hooks = job_hooks
+				new_server_syncer.remote_commands = remote_commands
+				new_server_syncer.gate = job_gate
+				new_server_syncer.job = job
 				syncers[myid] = &new_server_syncer
 				new_server_syncer.Start(c, done)
 				new_server_syncer.Stop()
 				syncers[myid] = nil
-				if mode == "onetime" || term_signal {
+				if mode == "onetime" || term_signal || job.Stopping() {
 					return
 				}
 				sync_manager_logger.Info(fmt.Sprintf("local syncer [%d] exited, will recreate", myid))
@@ -152,35 +230,35 @@ func startSyncLocal(syncer_config config.SyncerConfig, mode string) {
 
 	var proxyconfig config.UploaderConfig
 	proxyconfig.Name = syncer_config.Name
+	proxyconfig.PollingConfig = syncer_config.PollingConfig
 	proxyconfig.Target = syncer_config.Server
 	proxyconfig.TargetServer = syncer_config.SyncServer
 	proxyconfig.TargetPath = syncer_config.ServerPath
 	proxyconfig.SourcePath = syncer_config.LocalPath
+	proxyconfig.Watch = syncer_config.Watch
+	proxyconfig.RescanInterval = syncer_config.RescanInterval
 
 	if mode == "onetime" {
 		new_scanner = new(uploader.FolderScanner)
-		new_scanner.Default_sleep_time = 60
-		if syncer_config.SleepInterval > 0 {
-			new_scanner.Default_sleep_time = syncer_config.SleepInterval
-		}
 		new_scanner.UploaderConfig = proxyconfig
+		new_scanner.Hooks = job_hooks
 		new_scanner.StartWithWatcher(c, done, true)
 		new_scanner.Stop()
 		new_scanner = nil
-		os.Exit(0)
 	} else {
+		job.Add()
 		go func() {
+			defer job.Done()
 			for {
 				new_scanner = new(uploader.FolderScanner)
-				new_scanner.Default_sleep_time = 60
-				if syncer_config.SleepInterval > 0 {
-					new_scanner.Default_sleep_time = syncer_config.SleepInterval
-				}
 				new_scanner.UploaderConfig = proxyconfig
+				new_scanner.Hooks = job_hooks
+				new_scanner.Gate = job_gate
+				new_scanner.Job = job
 				new_scanner.StartWithWatcher(c, done, false)
 				new_scanner.Stop()
 				new_scanner = nil
-				if term_signal {
+				if term_signal || job.Stopping() {
 					return
 				}
 				sync_manager_logger.Info("local syncer scanner exited, will recreate")
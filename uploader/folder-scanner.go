@@ -4,11 +4,20 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/goutils/utils"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/packaging"
+	"github.com/iambighead/ugoku/internal/sla"
+	"github.com/iambighead/ugoku/internal/sleepytime"
 )
 
 // --------------------------------
@@ -28,6 +37,8 @@ func init() {
 type FileObj struct {
 	Path string
 	Stat fs.FileInfo
+	// source files packed into a bundle, removed once the bundle is uploaded
+	Members []string
 }
 
 type FileLookupObj struct {
@@ -36,36 +47,94 @@ type FileLookupObj struct {
 }
 type FolderScanner struct {
 	config.UploaderConfig
-	started            bool
-	logger             logger.Logger
-	Default_sleep_time int
-	LocalFolderMap     map[string]FileLookupObj
+	started        bool
+	logger         logger.Logger
+	LocalFolderMap map[string]FileLookupObj
+	Hooks          *hooks.Hooks
+	Gate           *gate.Gate
+	Job            *jobs.Job
+	batch          hooks.Batch
 }
 
 func (scanner *FolderScanner) scan(c chan FileObj, done chan int, watch_for_changes bool, scan_one_time_only bool) {
 
-	sleep_time := scanner.Default_sleep_time
+	var sleepy sleepytime.Sleepytime
+	sleepy.Reset(scanner.SleepInterval, scanner.MaxSleepInterval)
+	sleep_time := scanner.SleepInterval
+
+	var watcher folderWatcher
+	var last_full_scan time.Time
+	if scanner.Watch && !scan_one_time_only {
+		var err error
+		watcher, err = newFolderWatcher(scanner.SourcePath, scanner.logger)
+		if err != nil {
+			scanner.logger.Error(fmt.Sprintf("unable to watch source folder, polling instead: %s", err.Error()))
+		} else {
+			scanner.logger.Info("watching source folder for changes")
+			defer watcher.Close()
+		}
+	}
+
 	currnet_pass := 0
 	for {
 		currnet_pass = currnet_pass + 1%10
 
-		if !scanner.started {
+		if !scanner.started || scanner.Job.Stopping() {
 			scanner.logger.Info("folder scanner stopped, exiting scan")
 			return
 		}
+		if !scanner.Gate.Allowed(time.Now()) {
+			scanner.logger.Info("leaving active window, pausing")
+			return
+		}
+		if scanner.Job.Paused() {
+			scanner.Job.ScannerState(jobs.PAUSED)
+			scanner.Job.ScanSleep(1 * time.Second)
+			continue
+		}
+		scanner.Job.ScannerState(jobs.SCANNING)
+
+		sla.Check(scanner.Name)
+		if !scanner.Hooks.BeforeScan() {
+			scanner.logger.Info("scan skipped by pre-scan hook")
+			if scan_one_time_only {
+				return
+			}
+			scanner.Job.ScanSleep(sleepytime.Jitter(sleep_time, scanner.Jitter))
+			continue
+		}
 
 		var dispatched int
+		var to_bundle []string
+		scanner.batch.Reset()
+		scan_started := time.Now()
 
-		// walk a directory
-		filelist, err := utils.ReadFilelist(scanner.SourcePath)
-		if err == nil {
-			// if len(filelist) > 0 {
-			// 	scanner.logger.Debug(fmt.Sprintf("found files: %d", len(filelist)))
-			// }
-		} else {
-			scanner.logger.Error(fmt.Sprintf("failed to scan source folder: %s", err.Error()))
-			scanner.started = false
-			return
+		// with a watcher only the changed files are looked at, with a full
+		// walk now and then in case an event was missed
+		full_scan := true
+		var filelist []string
+		if watcher != nil {
+			changed, overflow := watcher.Changes()
+			if !overflow && time.Since(last_full_scan) < time.Duration(scanner.RescanInterval)*time.Second {
+				full_scan = false
+				filelist = changed
+			}
+		}
+
+		if full_scan {
+			// walk a directory
+			var err error
+			filelist, err = utils.ReadFilelist(scanner.SourcePath)
+			if err == nil {
+				// if len(filelist) > 0 {
+				// 	scanner.logger.Debug(fmt.Sprintf("found files: %d", len(filelist)))
+				// }
+			} else {
+				scanner.logger.Error(fmt.Sprintf("failed to scan source folder: %s", err.Error()))
+				scanner.started = false
+				return
+			}
+			last_full_scan = time.Now()
 		}
 
 		// time.Sleep(1000 * time.Millisecond)
@@ -79,7 +148,10 @@ func (scanner *FolderScanner) scan(c chan FileObj, done chan int, watch_for_chan
 
 			stat, err := os.Stat(newfile)
 			if err != nil {
-				scanner.logger.Error(fmt.Sprintf("unable to stat file: %s", newfile))
+				// a watched file may be gone already, like a renamed temp file
+				if full_scan || !os.IsNotExist(err) {
+					scanner.logger.Error(fmt.Sprintf("unable to stat file: %s", newfile))
+				}
 				continue
 			}
 
@@ -105,27 +177,24 @@ func (scanner *FolderScanner) scan(c chan FileObj, done chan int, watch_for_chan
 				can_dispatch = true
 			}
 
-			if can_dispatch {
-				select {
-				// Put new file in the channel unless it is full
-				case c <- rf:
-					dispatched++
-					scanner.logger.Debug(fmt.Sprintf("sent file to channel: %s, dispatched %d, ch %d/%d", newfile, dispatched, len(c), cap(c)))
-
-				default:
-					scanner.logger.Debug(fmt.Sprintf("channel full (%d dispatched) wait for something done first", dispatched))
-					<-done
-					dispatched--
-					scanner.logger.Debug(fmt.Sprintf("done received, %d dispatched now", dispatched))
-					c <- rf
-					dispatched++
-					scanner.logger.Debug(fmt.Sprintf("sent file to channel: %s, dispatched %d, ch %d/%d", newfile, dispatched, len(c), cap(c)))
-				}
+			if can_dispatch && scanner.Packaging.Bundle != "" {
+				to_bundle = append(to_bundle, newfile)
+			} else if can_dispatch {
+				scanner.dispatch(c, done, rf, &dispatched)
+			}
+		}
+
+		if len(to_bundle) > 0 {
+			bundle, err := scanner.bundle(to_bundle)
+			if err != nil {
+				scanner.logger.Error(fmt.Sprintf("failed to create bundle: %s", err.Error()))
+			} else {
+				scanner.dispatch(c, done, bundle, &dispatched)
 			}
 		}
 
 		for file, fo := range scanner.LocalFolderMap {
-			if fo.Pass != currnet_pass {
+			if full_scan && fo.Pass != currnet_pass {
 				delete(scanner.LocalFolderMap, file)
 				scanner.logger.Debug(fmt.Sprintf("removed file %s", file))
 			}
@@ -136,49 +205,130 @@ func (scanner *FolderScanner) scan(c chan FileObj, done chan int, watch_for_chan
 		// 	scanner.logger.Debug(fmt.Sprintf("file lookup length is now %d", lookup_len))
 		// }
 
+		files_found := dispatched > 0
 		if dispatched > 0 {
 			scanner.logger.Debug(fmt.Sprintf("end of scan, wait for %d more dispatched to be done", dispatched))
 			for {
-				<-done
+				scanner.batch.Done(<-done)
 				dispatched--
+				metrics.Pending(scanner.Name, dispatched)
+				scanner.Job.ScannerState(jobs.SCANNING)
 				scanner.logger.Debug(fmt.Sprintf("received done, dispatched = %d", dispatched))
 				if dispatched < 1 {
 					break
 				}
 			}
 		}
+		scanner.Hooks.AfterBatch(&scanner.batch)
+		metrics.ScanDuration(scanner.Name, scanner.Target, scan_started)
 
 		if scan_one_time_only {
 			// scanner.logger.Info("scan only one time")
 			time.Sleep(1 * time.Second)
 			return
 		}
+		if !files_found {
+			sleep_time = sleepy.GetNextSleep()
+		} else {
+			sleepy.Reset(scanner.SleepInterval, scanner.MaxSleepInterval)
+			sleep_time = scanner.SleepInterval
+		}
+
 		// scanner.logger.Info("sleep and scan again")
 		// scanner.logger.Debug(fmt.Sprintf("sleep for %d seconds", sleep_time))
 		if scanner.started {
-			time.Sleep(time.Duration(sleep_time) * time.Second)
+			scanner.Job.ScannerState(jobs.SLEEPING)
+			scanner.Job.ScanSleep(sleepytime.Jitter(sleep_time, scanner.Jitter))
 		}
 	}
 }
 
+func (scanner *FolderScanner) dispatch(c chan FileObj, done chan int, rf FileObj, dispatched *int) {
+	select {
+	// Put new file in the channel unless it is full
+	case c <- rf:
+		*dispatched++
+		scanner.logger.Debug(fmt.Sprintf("sent file to channel: %s, dispatched %d, ch %d/%d", rf.Path, *dispatched, len(c), cap(c)))
+
+	default:
+		scanner.logger.Debug(fmt.Sprintf("channel full (%d dispatched) wait for something done first", *dispatched))
+		scanner.batch.Done(<-done)
+		*dispatched--
+		scanner.logger.Debug(fmt.Sprintf("done received, %d dispatched now", *dispatched))
+		c <- rf
+		*dispatched++
+		scanner.logger.Debug(fmt.Sprintf("sent file to channel: %s, dispatched %d, ch %d/%d", rf.Path, *dispatched, len(c), cap(c)))
+	}
+	metrics.Pending(scanner.Name, *dispatched)
+	scanner.Job.ScannerState(jobs.SCANNING)
+}
+
+// bundle packs all files found in one scan pass into a single archive in the
+// temp folder. In dry run mode the archive is not written.
+func (scanner *FolderScanner) bundle(files []string) (FileObj, error) {
+	var rf FileObj
+	name, err := packaging.BundleName(scanner.Packaging.BundleName, scanner.Name, len(files), time.Now())
+	if err != nil {
+		return rf, err
+	}
+	rf.Path = filepath.Join(tempfolder, name)
+	rf.Members = files
+	if dryrun.Enabled() {
+		return rf, nil
+	}
+
+	err = packaging.CreateBundle(scanner.Packaging.Bundle, rf.Path, scanner.SourcePath, files)
+	if err != nil {
+		return rf, err
+	}
+	rf.Stat, err = os.Stat(rf.Path)
+	if err != nil {
+		return rf, err
+	}
+	scanner.logger.Info(fmt.Sprintf("bundled %d files into %s", len(files), rf.Path))
+	return rf, nil
+}
+
 func (scanner *FolderScanner) init() {
 	scanner.started = false
 	scanner.LocalFolderMap = make(map[string]FileLookupObj)
-	scanner.logger = logger.NewLogger(fmt.Sprintf("folder-scanner[%s]", scanner.Name))
-	if scanner.Default_sleep_time <= 0 {
-		scanner.Default_sleep_time = 1
+	scanner.logger = logger.NewJobLogger(fmt.Sprintf("folder-scanner[%s]", scanner.Name), scanner.Name, -1)
+	if scanner.SleepInterval <= 0 {
+		scanner.SleepInterval = 1
 	}
+	if scanner.MaxSleepInterval < scanner.SleepInterval {
+		scanner.MaxSleepInterval = scanner.SleepInterval
+	}
+	scanner.Job.ScannerState(jobs.WAITING)
+	// a stopping job is caught by the caller
+	scanner.Gate.WaitTurn()
 }
 
 func (scanner *FolderScanner) Start(c chan FileObj, done chan int, scan_one_time_only bool) {
 	scanner.init()
+	if scanner.Job.Stopping() {
+		return
+	}
 	scanner.started = true
+	if scanner.Gate.Scheduled() {
+		scanner.Gate.Begin()
+		defer scanner.Gate.End()
+		scan_one_time_only = true
+	}
 	scanner.scan(c, done, false, scan_one_time_only)
 }
 
 func (scanner *FolderScanner) StartWithWatcher(c chan FileObj, done chan int, scan_one_time_only bool) {
 	scanner.init()
+	if scanner.Job.Stopping() {
+		return
+	}
 	scanner.started = true
+	if scanner.Gate.Scheduled() {
+		scanner.Gate.Begin()
+		defer scanner.Gate.End()
+		scan_one_time_only = true
+	}
 	scanner.scan(c, done, true, scan_one_time_only)
 }
 
@@ -0,0 +1,10 @@
+package uploader
+
+// folderWatcher reports the files written below a folder, so a scan pass
+// only has to look at them instead of walking the whole tree
+type folderWatcher interface {
+	// Changes returns the files closed after writing or moved in since the
+	// last call, and true when events were lost and a full rescan is needed
+	Changes() ([]string, bool)
+	Close()
+}
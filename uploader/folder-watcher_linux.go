@@ -0,0 +1,153 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/iambighead/ugoku/internal/logger"
+	"golang.org/x/sys/unix"
+)
+
+const watch_mask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+type inotifyWatcher struct {
+	fd       int
+	file     *os.File
+	logger   logger.Logger
+	lock     sync.Mutex
+	dirs     map[int]string
+	changed  map[string]bool
+	overflow bool
+}
+
+func newFolderWatcher(root string, log logger.Logger) (folderWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %v", err)
+	}
+	w := &inotifyWatcher{
+		fd: fd,
+		// non blocking, so a read waits in the runtime poller and Close ends it
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		logger:  log,
+		dirs:    make(map[int]string),
+		changed: make(map[string]bool),
+	}
+	if err := w.addTree(root, false); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+// addTree watches root and the folders below it. Files found in a folder
+// created after the start may be complete before its watch is added, they are
+// reported as changed.
+func (w *inotifyWatcher) addTree(root string, report_files bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if report_files {
+				w.mark(path)
+			}
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, watch_mask)
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %v", path, err)
+		}
+		w.lock.Lock()
+		w.dirs[wd] = path
+		w.lock.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) mark(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.changed[path] = true
+}
+
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.logger.Error(fmt.Sprintf("folder watcher stopped: %s", err.Error()))
+				w.lock.Lock()
+				w.overflow = true
+				w.lock.Unlock()
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_start := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[name_start:name_start+int(event.Len)]), "\x00")
+			w.handle(int(event.Wd), event.Mask, name)
+			offset = name_start + int(event.Len)
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(wd int, mask uint32, name string) {
+	w.lock.Lock()
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		w.overflow = true
+	}
+	dir, ok := w.dirs[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.lock.Unlock()
+	if !ok || name == "" {
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	if mask&unix.IN_ISDIR != 0 {
+		if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			if err := w.addTree(path, true); err != nil {
+				w.logger.Error(fmt.Sprintf("%s, rescanning", err.Error()))
+				w.lock.Lock()
+				w.overflow = true
+				w.lock.Unlock()
+			}
+		}
+		return
+	}
+	// a created file is reported once closed, when it is complete
+	if mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0 {
+		w.mark(path)
+	}
+}
+
+func (w *inotifyWatcher) Changes() ([]string, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	files := make([]string, 0, len(w.changed))
+	for file := range w.changed {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	overflow := w.overflow
+	w.changed = make(map[string]bool)
+	w.overflow = false
+	return files, overflow
+}
+
+func (w *inotifyWatcher) Close() {
+	w.file.Close()
+}
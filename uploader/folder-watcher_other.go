@@ -0,0 +1,14 @@
+//go:build !linux
+
+package uploader
+
+import (
+	"errors"
+
+	"github.com/iambighead/ugoku/internal/logger"
+)
+
+// folder watching uses inotify, elsewhere the scanners poll
+func newFolderWatcher(root string, log logger.Logger) (folderWatcher, error) {
+	return nil, errors.New("folder watching is only supported on linux")
+}
@@ -4,15 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/iambighead/goutils/logger"
 	"github.com/iambighead/ugoku/internal/config"
+	"github.com/iambighead/ugoku/internal/dryrun"
+	"github.com/iambighead/ugoku/internal/gate"
+	"github.com/iambighead/ugoku/internal/history"
+	"github.com/iambighead/ugoku/internal/hooks"
+	"github.com/iambighead/ugoku/internal/jobs"
+	"github.com/iambighead/ugoku/internal/logger"
+	"github.com/iambighead/ugoku/internal/metrics"
+	"github.com/iambighead/ugoku/internal/notify"
+	"github.com/iambighead/ugoku/internal/packaging"
+	"github.com/iambighead/ugoku/internal/pgp"
 	siginthandler "github.com/iambighead/ugoku/internal/sigintHandler"
 	"github.com/iambighead/ugoku/internal/sleepytime"
+	"github.com/iambighead/ugoku/internal/transform"
 	"github.com/iambighead/ugoku/sftplibs"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -22,7 +33,7 @@ import (
 var term_signal bool
 var upload_manager_logger logger.Logger
 
-// var tempfolder string
+var tempfolder string
 
 func init() {
 	upload_manager_logger = logger.NewLogger("upload-manager")
@@ -46,6 +57,12 @@ type SftpUploader struct {
 	sftp_client      *sftp.Client
 	ssh_client       *ssh.Client
 	uploader_to_exit bool
+	pgp_keys         *pgp.Keys
+	hooks            *hooks.Hooks
+	remote_commands  *sftplibs.RemoteCommands
+	gate             *gate.Gate
+	job              *jobs.Job
+	hasher           *history.Hasher
 }
 
 var global_stop_channel = make(chan int, 1)
@@ -68,8 +85,61 @@ func (uper *SftpUploader) removeSrc(file_to_upload string) {
 	}
 }
 
-func (uper *SftpUploader) upload(file_to_upload string, size int64) error {
-	timeout_to_use := sftplibs.CalculateTimeout(int64(uper.Throughput), size, int64(uper.MaxTimeout))
+// removeSources removes the uploaded file, or for a bundle the files packed
+// into it and the bundle itself
+func (uper *SftpUploader) removeSources(fo FileObj) {
+	if fo.Members == nil {
+		uper.removeSrc(fo.Path)
+		return
+	}
+	for _, member := range fo.Members {
+		uper.removeSrc(member)
+	}
+	os.Remove(fo.Path)
+}
+
+func (uper *SftpUploader) outputFile(fo FileObj) string {
+	var output_file string
+	if fo.Members != nil {
+		output_file = filepath.Join(uper.TargetPath, filepath.Base(fo.Path))
+	} else {
+		upload_source_relative_path := strings.Replace(fo.Path, uper.SourcePath, "", 1)
+		output_file = filepath.Join(uper.TargetPath, upload_source_relative_path)
+	}
+	output_file += packaging.CompressExtension(uper.Packaging.Compress) + uper.pgp_keys.Extension()
+	return strings.ReplaceAll(output_file, "\\", "/")
+}
+
+// transforms adds the packaging compression to the configured transforms
+func (uper *SftpUploader) transforms() []config.TransformConfig {
+	if uper.Packaging.Compress == "" {
+		return uper.Transforms
+	}
+	transforms := append([]config.TransformConfig{}, uper.Transforms...)
+	return append(transforms, config.TransformConfig{Type: uper.Packaging.Compress})
+}
+
+func (uper *SftpUploader) plan(fo FileObj) {
+	if fo.Members != nil {
+		dryrun.Record(dryrun.Entry{Job: uper.Name, Kind: "uploader", Action: dryrun.ACTION_TRANSFER,
+			Source: fo.Path, Target: fmt.Sprintf("%s:%s", uper.Target, uper.outputFile(fo)),
+			Reason: fmt.Sprintf("%s bundle of %d files", uper.Packaging.Bundle, len(fo.Members))})
+		for _, member := range fo.Members {
+			dryrun.Record(dryrun.Entry{Job: uper.Name, Kind: "uploader", Action: dryrun.ACTION_DELETE,
+				Source: member, Reason: "remove source after bundle upload"})
+		}
+		return
+	}
+	dryrun.Record(dryrun.Entry{Job: uper.Name, Kind: "uploader", Action: dryrun.ACTION_TRANSFER,
+		Source: fo.Path, Target: fmt.Sprintf("%s:%s", uper.Target, uper.outputFile(fo)), Size: fo.Stat.Size()})
+	dryrun.Record(dryrun.Entry{Job: uper.Name, Kind: "uploader", Action: dryrun.ACTION_DELETE,
+		Source: fo.Path, Reason: "remove source after upload"})
+}
+
+func (uper *SftpUploader) upload(fo FileObj) error {
+	file_to_upload := fo.Path
+	stat := fo.Stat
+	timeout_to_use := sftplibs.CalculateTimeout(int64(uper.Throughput), stat.Size(), int64(uper.MaxTimeout))
 	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout_to_use))
 	defer cancel()
 
@@ -77,13 +147,11 @@ func (uper *SftpUploader) upload(file_to_upload string, size int64) error {
 	cancelled := false
 	go func() {
 
-		upload_source_relative_path := strings.Replace(file_to_upload, uper.SourcePath, "", 1)
-		output_file := filepath.Join(uper.TargetPath, upload_source_relative_path)
-		output_file = strings.ReplaceAll(output_file, "\\", "/")
+		output_file := uper.outputFile(fo)
 		uper.logger.Debug(fmt.Sprintf("uploading file %s to %s:%s, with %d seconds timeout", file_to_upload, uper.Target, output_file, timeout_to_use))
 
 		output_parent_folder := strings.ReplaceAll(filepath.Dir(output_file), "\\", "/")
-		err := uper.sftp_client.MkdirAll(output_parent_folder)
+		err := sftplibs.MkdirAllRemote(uper.sftp_client, output_parent_folder, uper.Attributes)
 		if err != nil {
 			uper.logger.Error(fmt.Sprintf("unable to create remote folder: %s: %s: %s", uper.Target, output_parent_folder, err.Error()))
 			uper.uploader_to_exit = true
@@ -106,7 +174,7 @@ func (uper *SftpUploader) upload(file_to_upload string, size int64) error {
 
 		target, openerr := uper.sftp_client.Create(output_file)
 		if openerr != nil {
-			uper.logger.Error(fmt.Sprintf("error opening remote file: %s:%s: %s", uper.Target, output_file, err.Error()))
+			uper.logger.Error(fmt.Sprintf("error opening remote file: %s:%s: %s", uper.Target, output_file, openerr.Error()))
 			uper.uploader_to_exit = true
 			time.Sleep(1100 * time.Millisecond)
 			done <- 0
@@ -114,10 +182,32 @@ func (uper *SftpUploader) upload(file_to_upload string, size int64) error {
 		}
 		defer target.Close()
 
+		progress := uper.job.Transfer(uper.id, file_to_upload, fmt.Sprintf("%s:%s", uper.Target, output_file), stat.Size(), uper.hasher.Wrap(source))
+		transformed, err := transform.Wrap(ctxTimeout, progress, uper.transforms())
+		if err != nil {
+			uper.logger.Error(fmt.Sprintf("unable to start transforms: %s: %s", file_to_upload, err.Error()))
+			done <- 0
+			return
+		}
+
+		var payload io.Reader = transformed
+		if uper.pgp_keys != nil {
+			encrypted := uper.pgp_keys.EncryptReader(transformed, file_to_upload)
+			defer encrypted.Close()
+			payload = encrypted
+		}
+
 		// nBytes, err := io.Copy(target, source)
-		nBytes, err := sftplibs.CopyWithCancel(ctxTimeout, target, source)
+		nBytes, err := sftplibs.CopyWithCancel(ctxTimeout, target, payload)
+		if transform_err := transformed.Close(); err == nil && transform_err != nil {
+			uper.logger.Error(fmt.Sprintf("error transforming file: %s: %s", file_to_upload, transform_err.Error()))
+			target.Close()
+			uper.sftp_client.Remove(output_file)
+			done <- 0
+			return
+		}
 		if err != nil && !cancelled {
-			uper.logger.Error(fmt.Sprintf("error uploading file: %s: %s", file_to_upload, err.Error()))
+			uper.logger.With(logger.Fields{"path": file_to_upload, "error": err.Error()}).Error(fmt.Sprintf("error uploading file: %s: %s", file_to_upload, err.Error()))
 			uper.uploader_to_exit = true
 			time.Sleep(1100 * time.Millisecond)
 			done <- 0
@@ -130,19 +220,24 @@ func (uper *SftpUploader) upload(file_to_upload string, size int64) error {
 			return
 		}
 
+		err = sftplibs.ApplyRemoteAttrs(uper.sftp_client, output_file, sftplibs.LocalAttrs(stat), uper.Attributes)
+		if err != nil {
+			uper.logger.Error(fmt.Sprintf("failed to set file attributes: %s:%s: %s", uper.Target, output_file, err.Error()))
+		}
+
 		end_time := time.Now().UnixMilli()
 
 		time_taken := end_time - start_time
 		if time_taken < 1 {
 			time_taken = 1
 		}
-		uper.logger.Info(fmt.Sprintf("uploaded %s with %d bytes in %d ms, %.1f mbps", file_to_upload, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
+		uper.logger.With(logger.Fields{"path": file_to_upload, "bytes": nBytes, "duration_ms": time_taken}).Info(fmt.Sprintf("uploaded %s with %d bytes in %d ms, %.1f mbps", file_to_upload, nBytes, time_taken, float64(nBytes/1000*8/time_taken)))
 		done <- 1
 	}()
 
 	select {
 	case <-ctxTimeout.Done():
-		return fmt.Errorf("upload timeout: %v", ctxTimeout.Err())
+		return fmt.Errorf("upload timeout: %w", ctxTimeout.Err())
 	case result := <-done:
 		if result > 0 {
 			return nil
@@ -166,7 +261,8 @@ func (uper *SftpUploader) connectAndGetClients() error {
 		uper.TargetServer.User,
 		uper.TargetServer.Password,
 		uper.TargetServer.KeyFile,
-		uper.TargetServer.CertFile)
+		uper.TargetServer.CertFile,
+		uper.TargetServer.KeyPassphrase)
 	if err != nil {
 		return err
 	}
@@ -181,19 +277,28 @@ func (uper *SftpUploader) connectAndGetClients() error {
 func (uper *SftpUploader) init() {
 	uper.started = false
 	uper.uploader_to_exit = false
-	uper.logger = logger.NewLogger(fmt.Sprintf("uploader[%s:%d]", uper.Name, uper.id))
+	uper.logger = logger.NewJobLogger(fmt.Sprintf("uploader[%s:%d]", uper.Name, uper.id), uper.Name, uper.id).With(logger.Fields{"server": uper.Target})
 
 	var sleepy sleepytime.Sleepytime
 	sleepy.Reset(2, 600)
 	for {
+		uper.job.WorkerState(uper.id, jobs.WAITING)
+		if !uper.gate.WaitOpen() || uper.job.Stopping() {
+			return
+		}
+		uper.job.WorkerState(uper.id, jobs.CONNECTING)
 		err := uper.connectAndGetClients()
+		notify.ConnectionState(uper.Name, "uploader", uper.Target, err)
+		metrics.Connected(uper.Name, "uploader", uper.Target, uper.id, err)
+		uper.job.Connection(uper.Target, err)
 		if err == nil {
 			break
 		}
-		uper.logger.Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
-		time.Sleep(10 * time.Second)
-		time.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
+		uper.logger.With(logger.Fields{"error": err.Error()}).Error(fmt.Sprintf("error connecting to server, will try again: %s", err.Error()))
+		uper.job.Sleep(10 * time.Second)
+		uper.job.Sleep(time.Duration(sleepy.GetNextSleep()) * time.Second)
 	}
+	uper.job.WorkerState(uper.id, jobs.IDLE)
 }
 
 // --------------------------------
@@ -214,24 +319,72 @@ func (uper *SftpUploader) Stop() {
 
 func (uper *SftpUploader) Start(c chan FileObj, done chan int) {
 	uper.init()
+	if uper.job.Stopping() {
+		return
+	}
 	uper.started = true
 	uper.prefix = fmt.Sprintf("%s%d", uper.Name, uper.id)
 	var file_to_upload string
+	quit := make(chan bool)
+	finished := make(chan bool)
 	go func() {
+		defer close(finished)
 		for {
 			if !uper.started {
 				return
 			}
-			fo := <-c
+			var fo FileObj
+			select {
+			case fo = <-c:
+			case <-quit:
+				return
+			}
 			file_to_upload = fo.Path
 			uper.logger.Debug(fmt.Sprintf("received file from channel: %s", file_to_upload))
-			upload_err := uper.upload(file_to_upload, fo.Stat.Size())
+			if dryrun.Enabled() {
+				uper.plan(fo)
+				done <- 1
+				continue
+			}
+			target := fmt.Sprintf("%s:%s", uper.Target, uper.outputFile(fo))
+			if !uper.hooks.BeforeTransfer(file_to_upload, target, fo.Stat) {
+				uper.logger.Info(fmt.Sprintf("skipped by pre-transfer hook: %s", file_to_upload))
+				if fo.Members != nil {
+					os.Remove(fo.Path)
+				}
+				done <- hooks.RESULT_SKIPPED
+				continue
+			}
+			remote_data := sftplibs.RemoteCommandData{Job: uper.Name, Source: file_to_upload, Target: uper.outputFile(fo), Size: fo.Stat.Size()}
+			uper.hasher = history.NewHasher()
+			started := time.Now()
+			upload_err := uper.remote_commands.Before(uper.ssh_client, remote_data)
+			reason := metrics.REASON_REMOTE_COMMAND
+			if upload_err == nil {
+				upload_err = uper.upload(fo)
+				reason = metrics.Reason(upload_err)
+			}
+			if upload_err == nil {
+				upload_err = uper.remote_commands.After(uper.ssh_client, remote_data)
+				reason = metrics.REASON_REMOTE_COMMAND
+			}
+			metrics.Result(uper.Name, "uploader", uper.Target, fo.Stat.Size(), started, reason, upload_err)
+			history.Record(history.Entry{Job: uper.Name, Kind: "uploader", Direction: history.UPLOAD, SourcePath: file_to_upload,
+				TargetServer: uper.Target, TargetPath: uper.outputFile(fo), Size: fo.Stat.Size(), Hash: uper.hasher.Sum(), Start: started}, upload_err)
+			uper.hooks.AfterTransfer(file_to_upload, target, fo.Stat, upload_err)
 			if upload_err == nil {
 				// 	uper.logger.Error(fmt.Sprintf("upload error: %s", upload_err.Error()))
 				// } else {
-				uper.removeSrc(file_to_upload)
+				uper.removeSources(fo)
+				done <- 1
+			} else {
+				if fo.Members != nil {
+					// the files are bundled again on the next scan
+					os.Remove(fo.Path)
+				}
+				done <- 0
 			}
-			done <- 1
+			uper.job.WorkerState(uper.id, jobs.IDLE)
 			if uper.uploader_to_exit {
 				return
 			}
@@ -244,45 +397,92 @@ func (uper *SftpUploader) Start(c chan FileObj, done chan int) {
 		if uper.uploader_to_exit {
 			return
 		}
+		if !uper.gate.Open() {
+			// let the current transfer finish, then disconnect
+			close(quit)
+			<-finished
+			uper.logger.Info("outside allowed window, disconnecting")
+			return
+		}
 	}
 }
 
-func setupSigHandler(new_scanner **FolderScanner, uploaders []*SftpUploader) {
-	siginthandler.Handle("uploader", func() {
-		term_signal = true
-		if *new_scanner != nil {
-			(*new_scanner).Stop()
-		}
-		for _, this_uploader := range uploaders {
-			if this_uploader != nil {
-				this_uploader.Stop()
-			}
+func stopAll(new_scanner **FolderScanner, uploaders []*SftpUploader) {
+	if *new_scanner != nil {
+		(*new_scanner).Stop()
+	}
+	for _, this_uploader := range uploaders {
+		if this_uploader != nil {
+			this_uploader.Stop()
 		}
+	}
+}
+
+func setupSigHandler(new_scanner **FolderScanner, uploaders []*SftpUploader) func() {
+	return siginthandler.Handle("uploader", func() {
+		term_signal = true
+		stopAll(new_scanner, uploaders)
 	})
 }
 
 func NewUploader(uploaderer_config config.UploaderConfig, tf string) {
-	// tempfolder = tf
+	if err := transform.Validate(uploaderer_config.Transforms); err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: invalid transforms, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
+	pgp_keys, err := pgp.Load(uploaderer_config.Pgp)
+	if err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: unable to load pgp keys, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
+	job_hooks := hooks.New(uploaderer_config.Hooks, uploaderer_config.Name, "uploader")
+	remote_commands, err := sftplibs.NewRemoteCommands(uploaderer_config.RemoteCommands, uploaderer_config.Name)
+	if err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
+	job_gate, err := gate.New(uploaderer_config.ScheduleConfig, uploaderer_config.Name)
+	if err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: invalid schedule, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
+
+	tempfolder = tf
 	uploaders := make([]*SftpUploader, uploaderer_config.Worker)
 	var new_scanner *FolderScanner
 
-	setupSigHandler(&new_scanner, uploaders)
+	unregister_sig := setupSigHandler(&new_scanner, uploaders)
+	job := jobs.Register(uploaderer_config.Name, "uploader", func() {
+		NewUploader(uploaderer_config, tf)
+	})
+	job_gate.StopOn(job.StopChan())
+	job.OnStop(func() {
+		stopAll(&new_scanner, uploaders)
+		unregister_sig()
+	})
 
 	// make a channel
 	c := make(chan FileObj, uploaderer_config.Worker*2)
 	done := make(chan int, uploaderer_config.Worker*2)
 
 	for i := 0; i < uploaderer_config.Worker; i++ {
+		job.Add()
 		go func(myid int) {
+			defer job.Done()
 			for {
 				var new_uploader SftpUploader
 				new_uploader.UploaderConfig = uploaderer_config
 				new_uploader.id = myid
+				new_uploader.pgp_keys = pgp_keys
+				new_uploader.hooks = job_hooks
+				new_uploader.remote_commands = remote_commands
+				new_uploader.gate = job_gate
+				new_uploader.job = job
 				uploaders[myid] = &new_uploader
 				new_uploader.Start(c, done)
 				new_uploader.Stop()
 				uploaders[myid] = nil
-				if term_signal {
+				if term_signal || job.Stopping() {
 					return
 				}
 				upload_manager_logger.Info(fmt.Sprintf("uploader [%d] exited, will recreate", myid))
@@ -290,14 +490,19 @@ func NewUploader(uploaderer_config config.UploaderConfig, tf string) {
 		}(i)
 	}
 
+	job.Add()
 	go func() {
+		defer job.Done()
 		for {
 			new_scanner = new(FolderScanner)
 			new_scanner.UploaderConfig = uploaderer_config
+			new_scanner.Hooks = job_hooks
+			new_scanner.Gate = job_gate
+			new_scanner.Job = job
 			new_scanner.Start(c, done, false)
 			new_scanner.Stop()
 			new_scanner = nil
-			if term_signal {
+			if term_signal || job.Stopping() {
 				return
 			}
 			upload_manager_logger.Info("scanner exited, will recreate")
@@ -307,8 +512,23 @@ func NewUploader(uploaderer_config config.UploaderConfig, tf string) {
 }
 
 func NewOneTimeUploader(uploaderer_config config.UploaderConfig, tf string) {
+	if err := transform.Validate(uploaderer_config.Transforms); err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: invalid transforms, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
+	pgp_keys, err := pgp.Load(uploaderer_config.Pgp)
+	if err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: unable to load pgp keys, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
+	job_hooks := hooks.New(uploaderer_config.Hooks, uploaderer_config.Name, "uploader")
+	remote_commands, err := sftplibs.NewRemoteCommands(uploaderer_config.RemoteCommands, uploaderer_config.Name)
+	if err != nil {
+		upload_manager_logger.Error(fmt.Sprintf("%s: invalid remote commands, uploader not started: %s", uploaderer_config.Name, err.Error()))
+		return
+	}
 
-	// tempfolder = tf
+	tempfolder = tf
 	uploaders := make([]*SftpUploader, uploaderer_config.Worker)
 	var new_scanner *FolderScanner
 
@@ -323,6 +543,9 @@ func NewOneTimeUploader(uploaderer_config config.UploaderConfig, tf string) {
 			var new_uploader SftpUploader
 			new_uploader.UploaderConfig = uploaderer_config
 			new_uploader.id = myid
+			new_uploader.pgp_keys = pgp_keys
+			new_uploader.hooks = job_hooks
+			new_uploader.remote_commands = remote_commands
 			uploaders[myid] = &new_uploader
 			new_uploader.Start(c, done)
 			new_uploader.Stop()
@@ -332,10 +555,10 @@ func NewOneTimeUploader(uploaderer_config config.UploaderConfig, tf string) {
 
 	new_scanner = new(FolderScanner)
 	new_scanner.UploaderConfig = uploaderer_config
+	new_scanner.Hooks = job_hooks
 	new_scanner.Start(c, done, true)
 	new_scanner.Stop()
 	new_scanner = nil
-	os.Exit(0)
 }
 
 // --------------------------------